@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+
+	"redisp/redcon"
+)
+
+// admin runs the PROXY command, which inspects and changes the proxy at
+// runtime:
+//
+//	PROXY ROUTE                     returns the routing policy
+//	PROXY ROUTE option value ...    changes the routing policy
+//	PROXY MIGRATE STATUS            returns the migration progress
+//	PROXY MIGRATE CUTOVER           moves to the next cutover phase
+//	PROXY MIGRATE ROLLBACK          moves reads back to the source
+func (p *proxy) admin(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "route":
+		p.adminRoute(conn, cmd.Args[2:])
+	case "migrate":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + " " + string(cmd.Args[1]) + "' command")
+			return
+		}
+		p.adminMigrate(conn, strings.ToLower(string(cmd.Args[2])))
+	}
+}
+
+func (p *proxy) adminMigrate(conn redcon.Conn, subcommand string) {
+	var err error
+	switch subcommand {
+	default:
+		conn.WriteError("ERR unknown subcommand '" + subcommand + "'")
+		return
+	case "status":
+		status := p.migration.status()
+		conn.WriteArray(len(status))
+		for _, s := range status {
+			conn.WriteBulkString(s)
+		}
+		return
+	case "cutover":
+		err = p.migration.cutover()
+	case "rollback":
+		err = p.migration.rollback()
+	}
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteString("OK")
+}
+
+func (p *proxy) adminRoute(conn redcon.Conn, args [][]byte) {
+	r := p.route()
+	if len(args) == 0 {
+		opts := r.options()
+		conn.WriteArray(len(opts))
+		for _, opt := range opts {
+			conn.WriteBulkString(opt)
+		}
+		return
+	}
+	if len(args)%2 != 0 {
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	for i := 0; i < len(args); i += 2 {
+		if err := r.set(string(args[i]), string(args[i+1])); err != nil {
+			conn.WriteError("ERR invalid route option '" + string(args[i]) + " " + string(args[i+1]) + "'")
+			return
+		}
+	}
+	p.setRoute(r)
+	conn.WriteString("OK")
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redisp/redcon"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	dialTimeout  = 5 * time.Second
+	maxIdleConns = 16
+	maxRedirects = 16
+	maxRetries   = 5
+	retryBackoff = 100 * time.Millisecond
+)
+
+var askingCmd = []byte("*1\r\n$6\r\nASKING\r\n")
+
+var errNoNodes = errors.New("no backend nodes available")
+
+// backendConn is a connection to a backend node, speaking the RESP version
+// proto.
+type backendConn struct {
+	conn  net.Conn
+	rd    *redcon.ReplyReader
+	addr  string
+	proto int
+}
+
+func newBackendConn(conn net.Conn, addr string) *backendConn {
+	return &backendConn{conn: conn, rd: redcon.NewReplyReader(conn), addr: addr, proto: 2}
+}
+
+// do sends the raw command to the node and returns its raw reply.
+func (c *backendConn) do(raw []byte) ([]byte, error) {
+	if _, err := c.conn.Write(raw); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// pipeline writes raw, which holds n commands, and passes the raw reply of
+// each of them to fn.
+func (c *backendConn) pipeline(raw []byte, n int, fn func(i int, reply []byte)) error {
+	if _, err := c.conn.Write(raw); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		reply, err := c.readReply()
+		if err != nil {
+			return err
+		}
+		fn(i, reply)
+	}
+	return nil
+}
+
+// doAsking sends ASKING followed by the raw command and returns the raw
+// reply of the command, or the error reply of ASKING. Both replies are
+// read, so the connection can be reused.
+func (c *backendConn) doAsking(raw []byte) ([]byte, error) {
+	if _, err := c.conn.Write(append(askingCmd[:len(askingCmd):len(askingCmd)], raw...)); err != nil {
+		return nil, err
+	}
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if reply[0] != '-' {
+		return c.readReply()
+	}
+	reply = append([]byte(nil), reply...)
+	if _, err := c.readReply(); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// readReply reads a complete reply. The returned bytes are valid until the
+// next call.
+func (c *backendConn) readReply() ([]byte, error) {
+	resp, err := c.rd.ReadReply()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Raw, nil
+}
+
+// pool holds idle connections to a backend node. The new connections
+// select db when it is not 0. The replies are passed on to the clients as
+// is, so a client speaking RESP3 gets a connection switched to RESP3 with
+// HELLO, and the others a RESP2 connection.
+type pool struct {
+	addr string
+	db   int
+	mu   sync.Mutex
+	// idle are the RESP2 and the RESP3 connections
+	idle [2][]*backendConn
+}
+
+// protoIndex returns the index in pool.idle of the connections speaking
+// proto.
+func protoIndex(proto int) int {
+	if proto == 3 {
+		return 1
+	}
+	return 0
+}
+
+// get returns an idle connection speaking proto or dials a new one.
+func (p *pool) get(proto int) (*backendConn, error) {
+	i := protoIndex(proto)
+	p.mu.Lock()
+	if n := len(p.idle[i]); n > 0 {
+		c := p.idle[i][n-1]
+		p.idle[i] = p.idle[i][:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+	conn, err := net.DialTimeout("tcp", p.addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := newBackendConn(conn, p.addr)
+	var setup [][]string
+	if i == 1 {
+		setup = append(setup, []string{"HELLO", "3"})
+		c.proto = 3
+	}
+	if p.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(p.db)})
+	}
+	for _, args := range setup {
+		reply, err := c.do(appendCommand(nil, args...))
+		if err == nil && reply[0] == '-' {
+			err = errors.New(strings.TrimSpace(string(reply[1:])))
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns a connection to the pool. A connection that failed is closed.
+func (p *pool) put(c *backendConn, err error) {
+	if err != nil {
+		c.conn.Close()
+		return
+	}
+	i := protoIndex(c.proto)
+	p.mu.Lock()
+	if len(p.idle[i]) < maxIdleConns {
+		p.idle[i] = append(p.idle[i], c)
+		c = nil
+	}
+	p.mu.Unlock()
+	if c != nil {
+		c.conn.Close()
+	}
+}
+
+// do sends the raw command on a pooled connection speaking proto and passes
+// its raw reply to fn.
+func (p *pool) do(proto int, raw []byte, fn func(reply []byte)) error {
+	c, err := p.get(proto)
+	if err != nil {
+		return err
+	}
+	reply, err := c.do(raw)
+	if err == nil {
+		fn(reply)
+	}
+	p.put(c, err)
+	return err
+}
+
+// upstream forwards raw commands to the masters of a backend, routing each
+// command to the node that serves its slot. All the slots of a standalone
+// or sentinel backend are served by its master, on db.
+type upstream struct {
+	name   string
+	topo   *topology
+	client redis.UniversalClient
+	db     int
+
+	mu    sync.RWMutex
+	slots [slotCount]string
+	addrs []string
+	pools map[string]*pool
+
+	refreshing int32
+}
+
+func newUpstream(name string, topo *topology, client redis.UniversalClient, db int) *upstream {
+	u := &upstream{
+		name:   name,
+		topo:   topo,
+		client: client,
+		db:     db,
+		pools:  make(map[string]*pool),
+	}
+	if err := u.refresh(); err != nil {
+		log.Println(name, "load slots:", err)
+	}
+	return u
+}
+
+// refresh reloads the slot map from the cluster, or the address of the
+// master.
+func (u *upstream) refresh() error {
+	var slots []redis.ClusterSlot
+	if u.topo.mode == modeCluster {
+		var err error
+		if slots, err = u.client.ClusterSlots().Result(); err != nil {
+			return err
+		}
+	} else {
+		addr, err := u.topo.masterAddr()
+		if err != nil {
+			return err
+		}
+		slots = []redis.ClusterSlot{{
+			Start: 0,
+			End:   slotCount - 1,
+			Nodes: []redis.ClusterNode{{Addr: addr}},
+		}}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addrs = u.addrs[:0]
+	for _, slot := range slots {
+		if len(slot.Nodes) == 0 {
+			continue
+		}
+		addr := slot.Nodes[0].Addr
+		for i := slot.Start; i <= slot.End && i < slotCount; i++ {
+			u.slots[i] = addr
+		}
+		if _, ok := u.pools[addr]; !ok {
+			u.pools[addr] = &pool{addr: addr, db: u.db}
+		}
+		u.addrs = append(u.addrs, addr)
+	}
+	return nil
+}
+
+// pool returns the pool of the node serving slot, or of any node when slot
+// is -1.
+func (u *upstream) pool(slot int) (*pool, error) {
+	for i := 0; i < 2; i++ {
+		u.mu.RLock()
+		var addr string
+		if slot == -1 {
+			if len(u.addrs) > 0 {
+				addr = u.addrs[0]
+			}
+		} else {
+			addr = u.slots[slot]
+		}
+		p := u.pools[addr]
+		u.mu.RUnlock()
+		if p != nil {
+			return p, nil
+		}
+		if i == 0 {
+			if err := u.refresh(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, errNoNodes
+}
+
+// masters returns the addresses of the masters serving slots.
+func (u *upstream) masters() []string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range u.addrs {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// do sends the raw command to the node serving slot on a connection
+// speaking proto, and passes its raw reply to fn. The reply is only valid
+// during the call to fn. MOVED and ASK redirects are followed, and TRYAGAIN
+// and CLUSTERDOWN errors are retried a few times before they are passed to
+// fn. A READONLY error of a sentinel backend reloads its master and retries
+// there.
+func (u *upstream) do(slot, proto int, raw []byte, fn func(reply []byte)) error {
+	return u.doBlocking(slot, proto, raw, time.Time{}, nil, fn)
+}
+
+// doBlocking is do for a command that may block. The connection holds the
+// command alone until deadline, or without limit when deadline is zero, and
+// it is closed when cancel is closed, which makes the node drop the command.
+func (u *upstream) doBlocking(slot, proto int, raw []byte, deadline time.Time, cancel <-chan struct{}, fn func(reply []byte)) error {
+	p, err := u.pool(slot)
+	if err != nil {
+		return err
+	}
+	asking := false
+	redirects, retries := 0, 0
+	for {
+		c, err := p.get(proto)
+		if err != nil {
+			if u.topo.mode == modeSentinel {
+				// the master may have failed over
+				u.refresh()
+			}
+			return err
+		}
+		var stop chan struct{}
+		if cancel != nil {
+			c.conn.SetDeadline(deadline)
+			stop = make(chan struct{})
+			go func(c *backendConn) {
+				select {
+				case <-cancel:
+					c.conn.Close()
+				case <-stop:
+				}
+			}(c)
+		}
+		var reply []byte
+		if asking {
+			reply, err = c.doAsking(raw)
+		} else {
+			reply, err = c.do(raw)
+		}
+		if stop != nil {
+			close(stop)
+			if err == nil {
+				err = c.conn.SetDeadline(time.Time{})
+			}
+		}
+		if err != nil {
+			p.put(c, err)
+			return err
+		}
+		next, wait, retry := p, time.Duration(0), false
+		kind, redirectSlot, addr := parseRedirect(reply)
+		switch kind {
+		case "MOVED", "ASK":
+			if redirects < maxRedirects {
+				redirects++
+				addr = redirectAddr(p.addr, addr)
+				if kind == "MOVED" {
+					u.moved(redirectSlot, addr)
+				}
+				next = u.poolAddr(addr)
+				asking = kind == "ASK"
+				retry = true
+			}
+		case "TRYAGAIN", "CLUSTERDOWN":
+			if retries < maxRetries {
+				retries++
+				wait = time.Duration(retries) * retryBackoff
+				retry = true
+			}
+		case "READONLY":
+			// the master of a sentinel backend failed over and is now a
+			// replica, the command was refused
+			if u.topo.mode == modeSentinel && retries < maxRetries {
+				retries++
+				if err := u.refresh(); err != nil {
+					log.Println(u.name, "load master:", err)
+				} else if next, err = u.pool(slot); err == nil {
+					retry = true
+				}
+			}
+		}
+		if !retry {
+			fn(reply)
+		}
+		p.put(c, nil)
+		if !retry {
+			return nil
+		}
+		time.Sleep(wait)
+		p = next
+	}
+}
+
+// redirectAddr returns the address of a redirect from the node at from. A
+// node that does not know its endpoint redirects to ":port", on its host.
+func redirectAddr(from, addr string) string {
+	if !strings.HasPrefix(addr, ":") {
+		return addr
+	}
+	host, _, _ := net.SplitHostPort(from)
+	return net.JoinHostPort(host, addr[1:])
+}
+
+// parseRedirect returns the kind of a MOVED, ASK, TRYAGAIN, CLUSTERDOWN or
+// READONLY error reply, and for redirects the slot and address of the node
+// to ask. It returns an empty kind for the other replies.
+func parseRedirect(reply []byte) (kind string, slot int, addr string) {
+	if len(reply) < 3 || reply[0] != '-' {
+		return "", 0, ""
+	}
+	fields := strings.Fields(string(reply[1 : len(reply)-2]))
+	if len(fields) == 0 {
+		return "", 0, ""
+	}
+	switch fields[0] {
+	case "TRYAGAIN", "CLUSTERDOWN", "READONLY":
+		return fields[0], 0, ""
+	case "MOVED", "ASK":
+		if len(fields) != 3 {
+			return "", 0, ""
+		}
+		slot, err := strconv.Atoi(fields[1])
+		if err != nil || slot < 0 || slot >= slotCount {
+			return "", 0, ""
+		}
+		return fields[0], slot, fields[2]
+	}
+	return "", 0, ""
+}
+
+// poolAddr returns the pool of the node at addr.
+func (u *upstream) poolAddr(addr string) *pool {
+	u.mu.RLock()
+	p := u.pools[addr]
+	u.mu.RUnlock()
+	if p != nil {
+		return p
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if p = u.pools[addr]; p == nil {
+		p = &pool{addr: addr, db: u.db}
+		u.pools[addr] = p
+	}
+	return p
+}
+
+// moved records that slot moved to addr and reloads the whole slot map in
+// the background, since a resharding rarely moves a single slot.
+func (u *upstream) moved(slot int, addr string) {
+	u.poolAddr(addr)
+	u.mu.Lock()
+	u.slots[slot] = addr
+	u.mu.Unlock()
+	if !atomic.CompareAndSwapInt32(&u.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&u.refreshing, 0)
+		if err := u.refresh(); err != nil {
+			log.Println(u.name, "load slots:", err)
+		}
+	}()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"redisp/redcon"
+)
+
+func TestParseRedirect(t *testing.T) {
+	tests := []struct {
+		reply string
+		kind  string
+		slot  int
+		addr  string
+	}{
+		{"-MOVED 3999 127.0.0.1:6381\r\n", "MOVED", 3999, "127.0.0.1:6381"},
+		{"-ASK 0 10.0.0.1:7000\r\n", "ASK", 0, "10.0.0.1:7000"},
+		{"-MOVED 16383 :6380\r\n", "MOVED", 16383, ":6380"},
+		{"-TRYAGAIN Multiple keys request during rehashing of slot\r\n", "TRYAGAIN", 0, ""},
+		{"-CLUSTERDOWN The cluster is down\r\n", "CLUSTERDOWN", 0, ""},
+		{"-READONLY You can't write against a read only replica.\r\n", "READONLY", 0, ""},
+		{"-MOVED 16384 127.0.0.1:6381\r\n", "", 0, ""},
+		{"-MOVED -1 127.0.0.1:6381\r\n", "", 0, ""},
+		{"-MOVED x 127.0.0.1:6381\r\n", "", 0, ""},
+		{"-MOVED 3999\r\n", "", 0, ""},
+		{"-ERR unknown command\r\n", "", 0, ""},
+		{"-\r\n", "", 0, ""},
+		{"+MOVED 3999 127.0.0.1:6381\r\n", "", 0, ""},
+		{"$5\r\nMOVED\r\n", "", 0, ""},
+	}
+	for _, tt := range tests {
+		kind, slot, addr := parseRedirect([]byte(tt.reply))
+		if kind != tt.kind || slot != tt.slot || addr != tt.addr {
+			t.Errorf("%q: expected %q %d %q, got %q %d %q", tt.reply, tt.kind, tt.slot, tt.addr, kind, slot, addr)
+		}
+	}
+}
+
+func TestDoAsking(t *testing.T) {
+	tests := []struct {
+		replies string
+		exp     string
+	}{
+		{"+OK\r\n$3\r\nbar\r\n", "$3\r\nbar\r\n"},
+		{"-ERR not a cluster node\r\n-MOVED 1 127.0.0.1:7000\r\n", "-ERR not a cluster node\r\n"},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			buf := make([]byte, 1024)
+			server.Read(buf)
+			server.Write([]byte(tt.replies + "+PONG\r\n"))
+		}()
+		c := newBackendConn(client, "")
+		reply, err := c.doAsking([]byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"))
+		if err != nil || string(reply) != tt.exp {
+			t.Fatalf("expected %q, got %q %v", tt.exp, reply, err)
+		}
+		// the reply of the command was read, the next one is in order
+		if reply, err = c.readReply(); err != nil || string(reply) != "+PONG\r\n" {
+			t.Fatalf("expected +PONG, got %q %v", reply, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestPoolSelect(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	addr := fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		mu.Lock()
+		sent = append(sent, strings.Join(argStrings(cmd.Args), " "))
+		mu.Unlock()
+		if strings.EqualFold(string(cmd.Args[0]), "select") && string(cmd.Args[1]) == "9" {
+			conn.WriteError("ERR DB index is out of range")
+			return
+		}
+		conn.WriteString("OK")
+	})
+	p := &pool{addr: addr, db: 2}
+	if err := p.do(2, parseCommand("set a 1").Raw, func([]byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.do(2, parseCommand("get a").Raw, func([]byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"SELECT 2", "set a 1", "get a"}
+	mu.Lock()
+	if strings.Join(sent, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected %q, got %q", exp, sent)
+	}
+	mu.Unlock()
+	p = &pool{addr: addr, db: 9}
+	if err := p.do(2, parseCommand("get a").Raw, func([]byte) {}); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Fatalf("expected the SELECT error, got %v", err)
+	}
+}
+
+func TestPoolProtocol(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	addr := fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		mu.Lock()
+		sent = append(sent, strings.Join(argStrings(cmd.Args), " "))
+		mu.Unlock()
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "hello":
+			redcon.Hello(conn, cmd, "standalone")
+		case "hgetall":
+			if conn.Protocol() == 3 {
+				conn.WriteMap(1)
+			} else {
+				conn.WriteArray(2)
+			}
+			conn.WriteBulkString("f")
+			conn.WriteBulkString("v")
+		}
+	})
+	p := &pool{addr: addr}
+	tests := []struct {
+		proto int
+		reply string
+	}{
+		{3, "%1\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{2, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{3, "%1\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{2, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+	}
+	for _, tt := range tests {
+		var reply string
+		if err := p.do(tt.proto, parseCommand("hgetall h").Raw, func(b []byte) { reply = string(b) }); err != nil {
+			t.Fatal(err)
+		}
+		if reply != tt.reply {
+			t.Fatalf("RESP%d: expected %q, got %q", tt.proto, tt.reply, reply)
+		}
+	}
+	// the idle connections are reused by protocol, HELLO is sent once
+	exp := []string{"HELLO 3", "hgetall h", "hgetall h", "hgetall h", "hgetall h"}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(sent, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected %q, got %q", exp, sent)
+	}
+}
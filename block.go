@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redisp/redcon"
+)
+
+// blockGrace is how much longer than its timeout the proxy waits for the
+// reply of a blocking command before it gives up on the backend.
+const blockGrace = 5 * time.Second
+
+// detachedBacklog is the number of commands read ahead from a detached
+// client. A client pipelining more commands behind a blocking command is
+// only seen disconnecting once the command returns.
+const detachedBacklog = 128
+
+var errClientClosed = errors.New("client closed")
+
+// detached is a client detached from the server, to block or to subscribe.
+// Its commands are read ahead by a goroutine, so a client that disconnects
+// while a command blocks is noticed and the command is cancelled.
+type detached struct {
+	redcon.DetachedConn
+	cmds    chan redcon.Command
+	gone    chan struct{} // closed when the client disconnected
+	done    chan struct{} // closed by Close
+	stop    chan struct{} // closed by reattach
+	stopped chan struct{} // closed when the read ahead stopped
+	held    *redcon.Command
+	once    sync.Once
+}
+
+// detach detaches conn from the server, unless it is detached already.
+func detach(conn redcon.Conn) *detached {
+	if d, ok := conn.(*detached); ok {
+		return d
+	}
+	d := &detached{
+		DetachedConn: conn.Detach(),
+		cmds:         make(chan redcon.Command, detachedBacklog),
+		gone:         make(chan struct{}),
+		done:         make(chan struct{}),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	go d.read()
+	return d
+}
+
+func (d *detached) read() {
+	defer close(d.stopped)
+	for {
+		cmd, err := d.DetachedConn.ReadCommand()
+		if err != nil {
+			select {
+			case <-d.stop:
+				// interrupted by reattach
+			default:
+				close(d.gone)
+			}
+			return
+		}
+		select {
+		case d.cmds <- cmd:
+		case <-d.stop:
+			d.held = &cmd
+			return
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// reattach stops the read ahead and hands the client back to the server,
+// with next and the commands read ahead and not run yet.
+func (d *detached) reattach(next ...redcon.Command) {
+	close(d.stop)
+	d.Interrupt()
+	<-d.stopped
+	cmds := append([]redcon.Command(nil), next...)
+	for len(d.cmds) > 0 {
+		cmds = append(cmds, <-d.cmds)
+	}
+	if d.held != nil {
+		cmds = append(cmds, *d.held)
+	}
+	if err := d.Reattach(cmds); err != nil {
+		d.Close()
+	}
+}
+
+// ReadCommand returns the next command of the client.
+func (d *detached) ReadCommand() (redcon.Command, error) {
+	select {
+	case cmd := <-d.cmds:
+		return cmd, nil
+	case <-d.done:
+		return redcon.Command{}, errClientClosed
+	case <-d.gone:
+		select {
+		case cmd := <-d.cmds:
+			return cmd, nil
+		default:
+			return redcon.Command{}, io.EOF
+		}
+	}
+}
+
+// Close closes the client and its session.
+func (d *detached) Close() error {
+	var err error
+	d.once.Do(func() {
+		close(d.done)
+		if s, _ := d.Context().(*session); s != nil {
+			s.close()
+		}
+		err = d.DetachedConn.Close()
+	})
+	return err
+}
+
+// block runs a command that blocks for timeout, or without limit when
+// timeout is 0. The client is detached while the command runs on a backend
+// connection of its own, which is closed when the client disconnects, and
+// it is reattached to the server once the reply is written.
+func (p *proxy) block(conn redcon.Conn, cmd redcon.Command, info *commandInfo, src, tgt *backendCmd, r route, timeout time.Duration) {
+	if d, ok := conn.(*detached); ok {
+		p.blocking(d, cmd, info, src, tgt, r, timeout)
+		return
+	}
+	d := detach(conn)
+	go func() {
+		p.blocking(d, cmd, info, src, tgt, r, timeout)
+		if err := d.Flush(); err != nil {
+			d.Close()
+			return
+		}
+		d.reattach()
+	}()
+}
+
+// blocking runs the blocking command on the primary of the write route,
+// where the writes that unblock it land first. What a blocking write did on
+// the primary is then applied on the secondary without blocking.
+func (p *proxy) blocking(d *detached, cmd redcon.Command, info *commandInfo, src, tgt *backendCmd, r route, timeout time.Duration) {
+	primary, secondary, err := p.writers(r, tgt == nil)
+	if err != nil {
+		d.WriteError(err.Error())
+		return
+	}
+	if info.flags&cmdWrite == 0 {
+		secondary = nil
+	}
+	backend := func(u *upstream) *backendCmd {
+		if u == p.target {
+			return tgt
+		}
+		return src
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout + blockGrace)
+	}
+	var reply []byte
+	bc := backend(primary)
+	err = primary.doBlocking(bc.slot, bc.proto, bc.raw, deadline, d.gone, func(b []byte) {
+		reply = append(reply, b...)
+	})
+	if err != nil {
+		d.WriteError("ERR " + err.Error())
+		return
+	}
+	if secondary != nil && reply[0] != '-' && !isNullReply(reply) {
+		if err := p.replay(secondary, backend(primary), backend(secondary), reply); err != nil {
+			log.Printf("%s %s: %v", secondary.name, cmd.Args[0], err)
+			if r.strict {
+				d.WriteError("ERR " + secondary.name + " write failed: " + err.Error())
+				return
+			}
+		}
+	}
+	d.WriteRaw(reply)
+}
+
+// replay applies on u, the secondary, what a blocking command did on the
+// primary. The keys are taken from the command for the secondary, which has
+// them renamed.
+func (p *proxy) replay(u *upstream, pc, sc *backendCmd, reply []byte) error {
+	raw := unblocked(pc.raw, sc.raw, reply)
+	if raw == nil {
+		return nil
+	}
+	var replyErr error
+	err := u.do(sc.slot, sc.proto, raw, func(b []byte) {
+		if b[0] == '-' {
+			replyErr = errors.New(string(b[1 : len(b)-2]))
+		}
+	})
+	if err == nil {
+		err = replyErr
+	}
+	return err
+}
+
+// unblocked returns the command that does without blocking what the
+// blocking command did with reply, given the command for the primary and
+// for the secondary. It returns nil when there is nothing to do.
+func unblocked(primaryRaw, secondaryRaw, reply []byte) []byte {
+	pc, err := redcon.Parse(primaryRaw)
+	if err != nil {
+		return nil
+	}
+	sc, err := redcon.Parse(secondaryRaw)
+	if err != nil || len(sc.Args) != len(pc.Args) {
+		return nil
+	}
+	_, resp := redcon.ReadNextRESP(reply)
+	items := respItems(resp)
+	pargs, sargs := pc.Args, sc.Args
+	// key returns the key of the secondary at the position of the key of
+	// the primary named in the reply, among the keys from start to end
+	key := func(start, end int) []byte {
+		if len(items) == 0 {
+			return nil
+		}
+		for i := start; i < end && i < len(pargs); i++ {
+			if bytes.Equal(pargs[i], items[0].Data) {
+				return sargs[i]
+			}
+		}
+		return nil
+	}
+	// keys returns the range of the keys of BLMPOP and BZMPOP
+	keys := func() (int, int) {
+		n := numKeys(2)(pargs)
+		if len(n) == 0 {
+			return 0, 0
+		}
+		return n[0], n[len(n)-1] + 1
+	}
+	switch name := strings.ToLower(string(pargs[0])); name {
+	case "blpop", "brpop":
+		if k := key(1, len(pargs)-1); k != nil {
+			return appendArgs(nil, []byte(name[1:]), k)
+		}
+	case "bzpopmin", "bzpopmax":
+		if k := key(1, len(pargs)-1); k != nil && len(items) == 3 {
+			return appendArgs(nil, []byte("zrem"), k, items[1].Data)
+		}
+	case "brpoplpush":
+		return appendArgs(nil, []byte("rpoplpush"), sargs[1], sargs[2])
+	case "blmove":
+		return appendArgs(nil, []byte("lmove"), sargs[1], sargs[2], sargs[3], sargs[4])
+	case "blmpop":
+		start, end := keys()
+		if k := key(start, end); k != nil && len(items) == 2 && end < len(sargs) {
+			pop := "lpop"
+			if strings.EqualFold(string(sargs[end]), "right") {
+				pop = "rpop"
+			}
+			count := len(respItems(items[1]))
+			return appendArgs(nil, []byte(pop), k, []byte(strconv.Itoa(count)))
+		}
+	case "bzmpop":
+		start, end := keys()
+		if k := key(start, end); k != nil && len(items) == 2 {
+			args := [][]byte{[]byte("zrem"), k}
+			for _, e := range respItems(items[1]) {
+				if member := respItems(e); len(member) > 0 {
+					args = append(args, member[0].Data)
+				}
+			}
+			return appendArgs(nil, args...)
+		}
+	case "xreadgroup":
+		// the same entries are read when the streams are in sync
+		for i := 1; i < len(sargs); i++ {
+			switch strings.ToLower(string(sargs[i])) {
+			case "streams":
+				return nil
+			case "group":
+				i += 2
+			case "count":
+				i++
+			case "block":
+				if i+1 < len(sargs) {
+					args := append(append([][]byte(nil), sargs[:i]...), sargs[i+2:]...)
+					return appendArgs(nil, args...)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// respItems returns the elements of an array reply.
+func respItems(resp redcon.RESP) []redcon.RESP {
+	if resp.Type != redcon.Array {
+		return nil
+	}
+	var items []redcon.RESP
+	resp.ForEach(func(e redcon.RESP) bool {
+		items = append(items, e)
+		return true
+	})
+	return items
+}
+
+// appendArgs appends a command of args to b.
+func appendArgs(b []byte, args ...[]byte) []byte {
+	b = redcon.AppendArray(b, len(args))
+	for _, arg := range args {
+		b = redcon.AppendBulk(b, arg)
+	}
+	return b
+}
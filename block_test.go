@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestUnblocked(t *testing.T) {
+	tests := []struct {
+		primary   string
+		secondary string
+		reply     string
+		exp       string // empty when there is nothing to do
+	}{
+		{"blpop a b 0", "blpop x:a x:b 0", "*2\r\n$1\r\nb\r\n$1\r\nv\r\n", "lpop x:b"},
+		{"brpop a b 1.5", "brpop x:a x:b 1.5", "*2\r\n$1\r\na\r\n$1\r\nv\r\n", "rpop x:a"},
+		{"blpop a 0", "blpop x:a 0", "*2\r\n$1\r\nc\r\n$1\r\nv\r\n", ""},
+		{"bzpopmin a 0", "bzpopmin x:a 0", "*3\r\n$1\r\na\r\n$1\r\nm\r\n$1\r\n1\r\n", "zrem x:a m"},
+		{"bzpopmax a b 0", "bzpopmax x:a x:b 0", "*3\r\n$1\r\nb\r\n$1\r\nm\r\n$1\r\n1\r\n", "zrem x:b m"},
+		{"bzpopmax a 0", "bzpopmax x:a 0", "*2\r\n$1\r\na\r\n$1\r\nm\r\n", ""},
+		{"brpoplpush a b 0", "brpoplpush x:a x:b 0", "$1\r\nv\r\n", "rpoplpush x:a x:b"},
+		{"blmove a b left right 0", "blmove x:a x:b left right 0", "$1\r\nv\r\n", "lmove x:a x:b left right"},
+		{"blmpop 0 2 a b left", "blmpop 0 2 x:a x:b left", "*2\r\n$1\r\nb\r\n*1\r\n$1\r\nv\r\n", "lpop x:b 1"},
+		{"blmpop 0 2 a b RIGHT count 2", "blmpop 0 2 x:a x:b RIGHT count 2",
+			"*2\r\n$1\r\na\r\n*2\r\n$1\r\nv\r\n$1\r\nw\r\n", "rpop x:a 2"},
+		{"bzmpop 0 1 a min count 2", "bzmpop 0 1 x:a min count 2",
+			"*2\r\n$1\r\na\r\n*2\r\n*2\r\n$1\r\nm\r\n$1\r\n1\r\n*2\r\n$1\r\nn\r\n$1\r\n2\r\n", "zrem x:a m n"},
+		{"xreadgroup group g c block 100 streams s >", "xreadgroup group g c block 100 streams x:s >",
+			"*1\r\n*2\r\n$1\r\ns\r\n*0\r\n", "xreadgroup group g c streams x:s >"},
+		{"xreadgroup group g c count 1 block 0 streams s >", "xreadgroup group g c count 1 block 0 streams x:s >",
+			"*1\r\n*2\r\n$1\r\ns\r\n*0\r\n", "xreadgroup group g c count 1 streams x:s >"},
+		{"xreadgroup group block c streams s >", "xreadgroup group block c streams x:s >",
+			"*1\r\n*2\r\n$1\r\ns\r\n*0\r\n", ""},
+		// the arguments do not match
+		{"blpop a b 0", "blpop x:a 0", "*2\r\n$1\r\na\r\n$1\r\nv\r\n", ""},
+		{"blpop a 0", "blpop x:a 0", "not resp", ""},
+	}
+	for _, tt := range tests {
+		var exp []byte
+		if tt.exp != "" {
+			exp = appendArgs(nil, parseArgs(tt.exp)...)
+		}
+		primary := appendArgs(nil, parseArgs(tt.primary)...)
+		secondary := appendArgs(nil, parseArgs(tt.secondary)...)
+		if raw := unblocked(primary, secondary, []byte(tt.reply)); string(raw) != string(exp) {
+			t.Errorf("%q: expected %q, got %q", tt.primary, exp, raw)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"redisp/redcon"
+)
+
+// proxyNode is a proxy instance presented to the clients as a cluster
+// master serving the slots from start to end.
+type proxyNode struct {
+	id     string
+	host   string
+	port   int
+	start  int
+	end    int
+	myself bool
+}
+
+// proxyNodes returns the proxy instances of -proxies, or this instance
+// alone, with the slots split evenly between them. A proxy listening on all
+// interfaces is presented with the address the client connected to.
+func proxyNodes(conn redcon.Conn) []proxyNode {
+	addrs := proxyAddrs
+	if len(addrs) == 0 {
+		addrs = []string{selfAddr()}
+	}
+	nodes := make([]proxyNode, 0, len(addrs))
+	for i, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			if local, ok := conn.NetConn().LocalAddr().(*net.TCPAddr); ok {
+				host = local.IP.String()
+			}
+		}
+		n := proxyNode{
+			id:     nodeID(addr),
+			host:   host,
+			start:  i * slotCount / len(addrs),
+			end:    (i+1)*slotCount/len(addrs) - 1,
+			myself: isMyself(conn, addr),
+		}
+		n.port, _ = strconv.Atoi(port)
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// selfAddr returns the address of this instance among -proxies.
+func selfAddr() string {
+	if announceAddr != "" {
+		return announceAddr
+	}
+	return proxyAddr
+}
+
+// isMyself reports whether addr, one of -proxies, is this instance: the
+// -announce address, or else -p or the address the client connected to,
+// which -p does not name when it listens on all interfaces.
+func isMyself(conn redcon.Conn, addr string) bool {
+	if addr == selfAddr() {
+		return true
+	}
+	if announceAddr != "" {
+		return false
+	}
+	local, ok := conn.NetConn().LocalAddr().(*net.TCPAddr)
+	return ok && addr == local.String()
+}
+
+// nodeID returns the 40 characters cluster node id of a proxy address.
+func nodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// cluster runs the CLUSTER command, presenting the proxy instances as the
+// masters of a cluster so that cluster clients send every slot to them.
+func (p *proxy) cluster(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	nodes := proxyNodes(conn)
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try CLUSTER HELP.")
+	case "slots":
+		conn.WriteArray(len(nodes))
+		for _, n := range nodes {
+			conn.WriteArray(3)
+			conn.WriteInt(n.start)
+			conn.WriteInt(n.end)
+			conn.WriteArray(3)
+			conn.WriteBulkString(n.host)
+			conn.WriteInt(n.port)
+			conn.WriteBulkString(n.id)
+		}
+	case "shards":
+		conn.WriteArray(len(nodes))
+		for _, n := range nodes {
+			conn.WriteArray(4)
+			conn.WriteBulkString("slots")
+			conn.WriteArray(2)
+			conn.WriteInt(n.start)
+			conn.WriteInt(n.end)
+			conn.WriteBulkString("nodes")
+			conn.WriteArray(1)
+			conn.WriteArray(14)
+			conn.WriteBulkString("id")
+			conn.WriteBulkString(n.id)
+			conn.WriteBulkString("port")
+			conn.WriteInt(n.port)
+			conn.WriteBulkString("ip")
+			conn.WriteBulkString(n.host)
+			conn.WriteBulkString("endpoint")
+			conn.WriteBulkString(n.host)
+			conn.WriteBulkString("role")
+			conn.WriteBulkString("master")
+			conn.WriteBulkString("replication-offset")
+			conn.WriteInt(0)
+			conn.WriteBulkString("health")
+			conn.WriteBulkString("online")
+		}
+	case "nodes":
+		var b strings.Builder
+		for i, n := range nodes {
+			flags := "master"
+			if n.myself {
+				flags = "myself,master"
+			}
+			fmt.Fprintf(&b, "%s %s:%d@%d %s - 0 0 %d connected %d-%d\n",
+				n.id, n.host, n.port, n.port+10000, flags, i+1, n.start, n.end)
+		}
+		conn.WriteBulkString(b.String())
+	case "info":
+		epoch := 0
+		for i, n := range nodes {
+			if n.myself {
+				epoch = i + 1
+			}
+		}
+		conn.WriteBulkString(fmt.Sprintf("cluster_enabled:1\r\n"+
+			"cluster_state:ok\r\n"+
+			"cluster_slots_assigned:%d\r\n"+
+			"cluster_slots_ok:%d\r\n"+
+			"cluster_slots_pfail:0\r\n"+
+			"cluster_slots_fail:0\r\n"+
+			"cluster_known_nodes:%d\r\n"+
+			"cluster_size:%d\r\n"+
+			"cluster_current_epoch:%d\r\n"+
+			"cluster_my_epoch:%d\r\n",
+			slotCount, slotCount, len(nodes), len(nodes), len(nodes), epoch))
+	case "myid":
+		id := nodeID(selfAddr())
+		for _, n := range nodes {
+			if n.myself {
+				id = n.id
+			}
+		}
+		conn.WriteBulkString(id)
+	case "keyslot":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster|keyslot' command")
+			return
+		}
+		conn.WriteInt(keySlot(cmd.Args[2]))
+	case "countkeysinslot":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster|countkeysinslot' command")
+			return
+		}
+		slot, err := strconv.Atoi(string(cmd.Args[2]))
+		if err != nil || slot < 0 || slot >= slotCount {
+			conn.WriteError("ERR Invalid slot")
+			return
+		}
+		// the keys are counted where reads are served
+		u := p.target
+		if p.route().read == readSource {
+			u = p.source
+		}
+		p.reply(conn, u, &backendCmd{raw: cmd.Raw, slot: slot, proto: conn.Protocol()})
+	}
+}
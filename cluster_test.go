@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"redisp/redcon"
+)
+
+// testConn is a client connection writing its replies to a buffer, connected
+// to the proxy at local.
+type testConn struct {
+	redcon.Conn
+	wr    *redcon.Writer
+	local net.Addr
+	ctx   interface{}
+}
+
+func newTestConn(local string) *testConn {
+	addr, _ := net.ResolveTCPAddr("tcp", local)
+	return &testConn{wr: redcon.NewWriter(nil), local: addr}
+}
+
+func (c *testConn) Context() interface{}        { return c.ctx }
+func (c *testConn) SetContext(v interface{})    { c.ctx = v }
+func (c *testConn) NetConn() net.Conn           { return testNetConn{local: c.local} }
+func (c *testConn) Protocol() int               { return 2 }
+func (c *testConn) WriteError(msg string)       { c.wr.WriteError(msg) }
+func (c *testConn) WriteString(str string)      { c.wr.WriteString(str) }
+func (c *testConn) WriteBulk(bulk []byte)       { c.wr.WriteBulk(bulk) }
+func (c *testConn) WriteBulkString(bulk string) { c.wr.WriteBulkString(bulk) }
+func (c *testConn) WriteInt(num int)            { c.wr.WriteInt(num) }
+func (c *testConn) WriteArray(count int)        { c.wr.WriteArray(count) }
+func (c *testConn) WriteNull()                  { c.wr.WriteNull() }
+func (c *testConn) WriteRaw(data []byte)        { c.wr.WriteRaw(data) }
+
+// reply returns the replies written so far and clears them.
+func (c *testConn) reply() interface{} {
+	_, resp := redcon.ReadNextRESP(c.wr.Buffer())
+	c.wr.SetBuffer(nil)
+	return respValue(resp)
+}
+
+type testNetConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c testNetConn) LocalAddr() net.Addr { return c.local }
+
+// respValue returns a reply as nested arrays of ints and strings.
+func respValue(resp redcon.RESP) interface{} {
+	switch resp.Type {
+	case redcon.Array:
+		vals := []interface{}{}
+		resp.ForEach(func(e redcon.RESP) bool {
+			vals = append(vals, respValue(e))
+			return true
+		})
+		return vals
+	case redcon.Integer:
+		n, _ := strconv.Atoi(string(resp.Data))
+		return n
+	}
+	return string(resp.Data)
+}
+
+// setProxies sets the proxy address flags until the test ends.
+func setProxies(t *testing.T, addr string, addrs []string) {
+	savedAddr, savedAddrs := proxyAddr, proxyAddrs
+	t.Cleanup(func() { proxyAddr, proxyAddrs = savedAddr, savedAddrs })
+	proxyAddr, proxyAddrs = addr, addrs
+}
+
+func runCluster(conn *testConn, args string) interface{} {
+	cmd := redcon.Command{Args: parseArgs("cluster " + args)}
+	(&proxy{}).cluster(conn, cmd)
+	return conn.reply()
+}
+
+func TestClusterSlots(t *testing.T) {
+	setProxies(t, "10.0.0.1:7000", []string{"10.0.0.1:7000", "10.0.0.2:7001"})
+	exp := []interface{}{
+		[]interface{}{0, 8191, []interface{}{"10.0.0.1", 7000, nodeID("10.0.0.1:7000")}},
+		[]interface{}{8192, 16383, []interface{}{"10.0.0.2", 7001, nodeID("10.0.0.2:7001")}},
+	}
+	if reply := runCluster(newTestConn("10.0.0.1:7000"), "slots"); !reflect.DeepEqual(reply, exp) {
+		t.Fatalf("expected %v, got %v", exp, reply)
+	}
+
+	// a proxy listening on all interfaces is presented with the address the
+	// client connected to
+	setProxies(t, "0.0.0.0:6380", nil)
+	exp = []interface{}{
+		[]interface{}{0, 16383, []interface{}{"127.0.0.1", 6380, nodeID("0.0.0.0:6380")}},
+	}
+	if reply := runCluster(newTestConn("127.0.0.1:6380"), "slots"); !reflect.DeepEqual(reply, exp) {
+		t.Fatalf("expected %v, got %v", exp, reply)
+	}
+}
+
+func TestClusterShards(t *testing.T) {
+	setProxies(t, "10.0.0.1:7000", []string{"10.0.0.1:7000", "10.0.0.2:7001"})
+	shard := func(start, end int, host string, port int) interface{} {
+		return []interface{}{
+			"slots", []interface{}{start, end},
+			"nodes", []interface{}{[]interface{}{
+				"id", nodeID(host + ":" + strconv.Itoa(port)),
+				"port", port,
+				"ip", host,
+				"endpoint", host,
+				"role", "master",
+				"replication-offset", 0,
+				"health", "online",
+			}},
+		}
+	}
+	exp := []interface{}{
+		shard(0, 8191, "10.0.0.1", 7000),
+		shard(8192, 16383, "10.0.0.2", 7001),
+	}
+	if reply := runCluster(newTestConn("10.0.0.1:7000"), "shards"); !reflect.DeepEqual(reply, exp) {
+		t.Fatalf("expected %v, got %v", exp, reply)
+	}
+}
+
+func TestClusterNodes(t *testing.T) {
+	setProxies(t, "10.0.0.2:7001", []string{"10.0.0.1:7000", "10.0.0.2:7001", "10.0.0.3:7002"})
+	exp := nodeID("10.0.0.1:7000") + " 10.0.0.1:7000@17000 master - 0 0 1 connected 0-5460\n" +
+		nodeID("10.0.0.2:7001") + " 10.0.0.2:7001@17001 myself,master - 0 0 2 connected 5461-10921\n" +
+		nodeID("10.0.0.3:7002") + " 10.0.0.3:7002@17002 master - 0 0 3 connected 10922-16383\n"
+	conn := newTestConn("10.0.0.2:7001")
+	if reply := runCluster(conn, "nodes"); reply != exp {
+		t.Fatalf("expected %q, got %q", exp, reply)
+	}
+	info, _ := runCluster(conn, "info").(string)
+	for _, field := range []string{"cluster_state:ok", "cluster_slots_assigned:16384", "cluster_known_nodes:3", "cluster_my_epoch:2"} {
+		if !strings.Contains(info, field+"\r\n") {
+			t.Fatalf("expected %s in %q", field, info)
+		}
+	}
+	if reply := runCluster(conn, "myid"); reply != nodeID("10.0.0.2:7001") {
+		t.Fatalf("expected %s, got %v", nodeID("10.0.0.2:7001"), reply)
+	}
+}
+
+func TestClusterMyself(t *testing.T) {
+	proxies := []string{"10.0.0.1:7000", "10.0.0.2:7000"}
+	tests := []struct {
+		addr     string
+		announce string
+		local    string
+		myself   int
+	}{
+		{"10.0.0.2:7000", "", "10.0.0.2:7000", 1},
+		{":7000", "", "10.0.0.2:7000", 1},
+		{"0.0.0.0:7000", "", "10.0.0.1:7000", 0},
+		{"0.0.0.0:7000", "10.0.0.2:7000", "192.168.0.1:7000", 1},
+		{"0.0.0.0:7000", "10.0.0.2:7000", "10.0.0.1:7000", 1},
+		{"0.0.0.0:7000", "", "192.168.0.1:7000", -1},
+	}
+	saved := announceAddr
+	defer func() { announceAddr = saved }()
+	for _, tt := range tests {
+		setProxies(t, tt.addr, proxies)
+		announceAddr = tt.announce
+		myself := -1
+		for i, n := range proxyNodes(newTestConn(tt.local)) {
+			if n.myself {
+				myself = i
+			}
+		}
+		if myself != tt.myself {
+			t.Errorf("-p %s -announce %q from %s: expected node %d, got %d", tt.addr, tt.announce, tt.local, tt.myself, myself)
+		}
+	}
+}
+
+func TestClusterKeyslot(t *testing.T) {
+	conn := newTestConn("127.0.0.1:6380")
+	if reply := runCluster(conn, "keyslot foo"); reply != 12182 {
+		t.Fatalf("expected 12182, got %v", reply)
+	}
+	if reply := runCluster(conn, "keyslot"); reply != "ERR wrong number of arguments for 'cluster|keyslot' command" {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+}
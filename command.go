@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"redisp/redcon"
+)
+
+// command flags
+const (
+	cmdRead = 1 << iota
+	cmdWrite
+	cmdScript
+)
+
+// merge kinds of the multi-key commands split by slot
+const (
+	mergeNone  = iota
+	mergeArray // an array with an element per key, like MGET
+	mergeSum   // the sum of integers, like DEL
+	mergeOK    // OK once all parts are, like MSET
+)
+
+// commandInfo describes a command the proxy forwards to the backends. The
+// key positions follow the COMMAND reply of redis: first and last are the
+// positions of the first and last key (a negative last counts from the end)
+// and step is the distance between keys. A command with movable keys has a
+// keys func instead, returning the positions of the keys. A command that
+// may block has a timeout func, returning its timeout (0 blocks without
+// limit) and whether it blocks. A command whose keys may hash to different
+// slots is split by slot when merge is set, which tells how the replies of
+// the parts are merged.
+type commandInfo struct {
+	arity   int // negative means at least -arity arguments
+	flags   int
+	first   int
+	last    int
+	step    int
+	keys    func(args [][]byte) []int
+	timeout func(args [][]byte) (time.Duration, bool)
+	merge   int
+}
+
+func readCmd(arity, first, last, step int) *commandInfo {
+	return &commandInfo{arity: arity, flags: cmdRead, first: first, last: last, step: step}
+}
+
+func writeCmd(arity, first, last, step int) *commandInfo {
+	return &commandInfo{arity: arity, flags: cmdWrite, first: first, last: last, step: step}
+}
+
+func movableKeys(info *commandInfo, keys func(args [][]byte) []int) *commandInfo {
+	info.keys = keys
+	return info
+}
+
+func scriptCmd(info *commandInfo) *commandInfo {
+	info.flags |= cmdScript
+	return info
+}
+
+func splitCmd(info *commandInfo, merge int) *commandInfo {
+	info.merge = merge
+	return info
+}
+
+func blockingCmd(info *commandInfo, timeout func(args [][]byte) (time.Duration, bool)) *commandInfo {
+	info.timeout = timeout
+	return info
+}
+
+// commands is the table of commands that are forwarded to the backends.
+var commands = map[string]*commandInfo{
+	// strings
+	"get":         readCmd(2, 1, 1, 1),
+	"set":         writeCmd(-3, 1, 1, 1),
+	"setnx":       writeCmd(3, 1, 1, 1),
+	"setex":       writeCmd(4, 1, 1, 1),
+	"psetex":      writeCmd(4, 1, 1, 1),
+	"getset":      writeCmd(3, 1, 1, 1),
+	"getdel":      writeCmd(2, 1, 1, 1),
+	"getex":       writeCmd(-2, 1, 1, 1),
+	"getrange":    readCmd(4, 1, 1, 1),
+	"substr":      readCmd(4, 1, 1, 1),
+	"setrange":    writeCmd(4, 1, 1, 1),
+	"append":      writeCmd(3, 1, 1, 1),
+	"strlen":      readCmd(2, 1, 1, 1),
+	"incr":        writeCmd(2, 1, 1, 1),
+	"decr":        writeCmd(2, 1, 1, 1),
+	"incrby":      writeCmd(3, 1, 1, 1),
+	"decrby":      writeCmd(3, 1, 1, 1),
+	"incrbyfloat": writeCmd(3, 1, 1, 1),
+	"mget":        splitCmd(readCmd(-2, 1, -1, 1), mergeArray),
+	"mset":        splitCmd(writeCmd(-3, 1, -1, 2), mergeOK),
+	"msetnx":      writeCmd(-3, 1, -1, 2),
+	"lcs":         readCmd(-3, 1, 2, 1),
+
+	// keys
+	"del":         splitCmd(writeCmd(-2, 1, -1, 1), mergeSum),
+	"unlink":      splitCmd(writeCmd(-2, 1, -1, 1), mergeSum),
+	"exists":      splitCmd(readCmd(-2, 1, -1, 1), mergeSum),
+	"touch":       splitCmd(readCmd(-2, 1, -1, 1), mergeSum),
+	"expire":      writeCmd(-3, 1, 1, 1),
+	"pexpire":     writeCmd(-3, 1, 1, 1),
+	"expireat":    writeCmd(-3, 1, 1, 1),
+	"pexpireat":   writeCmd(-3, 1, 1, 1),
+	"expiretime":  readCmd(2, 1, 1, 1),
+	"pexpiretime": readCmd(2, 1, 1, 1),
+	"ttl":         readCmd(2, 1, 1, 1),
+	"pttl":        readCmd(2, 1, 1, 1),
+	"persist":     writeCmd(2, 1, 1, 1),
+	"type":        readCmd(2, 1, 1, 1),
+	"rename":      writeCmd(3, 1, 2, 1),
+	"renamenx":    writeCmd(3, 1, 2, 1),
+	"copy":        writeCmd(-3, 1, 2, 1),
+	"dump":        readCmd(2, 1, 1, 1),
+	"restore":     writeCmd(-4, 1, 1, 1),
+	"object":      readCmd(-2, 2, 2, 1),
+	"sort":        writeCmd(-2, 1, 1, 1),
+	"sort_ro":     readCmd(-2, 1, 1, 1),
+
+	// hashes
+	"hset":         writeCmd(-4, 1, 1, 1),
+	"hsetnx":       writeCmd(4, 1, 1, 1),
+	"hmset":        writeCmd(-4, 1, 1, 1),
+	"hget":         readCmd(3, 1, 1, 1),
+	"hmget":        readCmd(-3, 1, 1, 1),
+	"hincrby":      writeCmd(4, 1, 1, 1),
+	"hincrbyfloat": writeCmd(4, 1, 1, 1),
+	"hdel":         writeCmd(-3, 1, 1, 1),
+	"hlen":         readCmd(2, 1, 1, 1),
+	"hstrlen":      readCmd(3, 1, 1, 1),
+	"hkeys":        readCmd(2, 1, 1, 1),
+	"hvals":        readCmd(2, 1, 1, 1),
+	"hgetall":      readCmd(2, 1, 1, 1),
+	"hexists":      readCmd(3, 1, 1, 1),
+	"hscan":        readCmd(-3, 1, 1, 1),
+	"hrandfield":   readCmd(-2, 1, 1, 1),
+
+	// lists
+	"lpush":     writeCmd(-3, 1, 1, 1),
+	"rpush":     writeCmd(-3, 1, 1, 1),
+	"lpushx":    writeCmd(-3, 1, 1, 1),
+	"rpushx":    writeCmd(-3, 1, 1, 1),
+	"lpop":      writeCmd(-2, 1, 1, 1),
+	"rpop":      writeCmd(-2, 1, 1, 1),
+	"llen":      readCmd(2, 1, 1, 1),
+	"lindex":    readCmd(3, 1, 1, 1),
+	"lset":      writeCmd(4, 1, 1, 1),
+	"lrange":    readCmd(4, 1, 1, 1),
+	"ltrim":     writeCmd(4, 1, 1, 1),
+	"lrem":      writeCmd(4, 1, 1, 1),
+	"linsert":   writeCmd(5, 1, 1, 1),
+	"lpos":      readCmd(-3, 1, 1, 1),
+	"rpoplpush": writeCmd(3, 1, 2, 1),
+	"lmove":     writeCmd(5, 1, 2, 1),
+	"lmpop":     movableKeys(writeCmd(-4, 0, 0, 0), numKeys(1)),
+
+	// blocking lists
+	"blpop":      blockingCmd(writeCmd(-3, 1, -2, 1), secondsAt(-1)),
+	"brpop":      blockingCmd(writeCmd(-3, 1, -2, 1), secondsAt(-1)),
+	"brpoplpush": blockingCmd(writeCmd(4, 1, 2, 1), secondsAt(3)),
+	"blmove":     blockingCmd(writeCmd(6, 1, 2, 1), secondsAt(5)),
+	"blmpop":     blockingCmd(movableKeys(writeCmd(-5, 0, 0, 0), numKeys(2)), secondsAt(1)),
+
+	// sets
+	"sadd":        writeCmd(-3, 1, 1, 1),
+	"srem":        writeCmd(-3, 1, 1, 1),
+	"smembers":    readCmd(2, 1, 1, 1),
+	"sismember":   readCmd(3, 1, 1, 1),
+	"smismember":  readCmd(-3, 1, 1, 1),
+	"scard":       readCmd(2, 1, 1, 1),
+	"spop":        writeCmd(-2, 1, 1, 1),
+	"srandmember": readCmd(-2, 1, 1, 1),
+	"smove":       writeCmd(4, 1, 2, 1),
+	"sinter":      readCmd(-2, 1, -1, 1),
+	"sinterstore": writeCmd(-3, 1, -1, 1),
+	"sintercard":  movableKeys(readCmd(-3, 0, 0, 0), numKeys(1)),
+	"sunion":      readCmd(-2, 1, -1, 1),
+	"sunionstore": writeCmd(-3, 1, -1, 1),
+	"sdiff":       readCmd(-2, 1, -1, 1),
+	"sdiffstore":  writeCmd(-3, 1, -1, 1),
+	"sscan":       readCmd(-3, 1, 1, 1),
+
+	// sorted sets
+	"zadd":             writeCmd(-4, 1, 1, 1),
+	"zincrby":          writeCmd(4, 1, 1, 1),
+	"zrem":             writeCmd(-3, 1, 1, 1),
+	"zcard":            readCmd(2, 1, 1, 1),
+	"zcount":           readCmd(4, 1, 1, 1),
+	"zscore":           readCmd(3, 1, 1, 1),
+	"zmscore":          readCmd(-3, 1, 1, 1),
+	"zrank":            readCmd(-3, 1, 1, 1),
+	"zrevrank":         readCmd(-3, 1, 1, 1),
+	"zrange":           readCmd(-4, 1, 1, 1),
+	"zrevrange":        readCmd(-4, 1, 1, 1),
+	"zrangebyscore":    readCmd(-4, 1, 1, 1),
+	"zrevrangebyscore": readCmd(-4, 1, 1, 1),
+	"zrangebylex":      readCmd(-4, 1, 1, 1),
+	"zrevrangebylex":   readCmd(-4, 1, 1, 1),
+	"zlexcount":        readCmd(4, 1, 1, 1),
+	"zremrangebyrank":  writeCmd(4, 1, 1, 1),
+	"zremrangebyscore": writeCmd(4, 1, 1, 1),
+	"zremrangebylex":   writeCmd(4, 1, 1, 1),
+	"zpopmin":          writeCmd(-2, 1, 1, 1),
+	"zpopmax":          writeCmd(-2, 1, 1, 1),
+	"zrandmember":      readCmd(-2, 1, 1, 1),
+	"zscan":            readCmd(-3, 1, 1, 1),
+	"zrangestore":      writeCmd(-5, 1, 2, 1),
+	"zunionstore":      movableKeys(writeCmd(-4, 0, 0, 0), storeNumKeys),
+	"zinterstore":      movableKeys(writeCmd(-4, 0, 0, 0), storeNumKeys),
+	"zdiffstore":       movableKeys(writeCmd(-4, 0, 0, 0), storeNumKeys),
+	"zunion":           movableKeys(readCmd(-3, 0, 0, 0), numKeys(1)),
+	"zinter":           movableKeys(readCmd(-3, 0, 0, 0), numKeys(1)),
+	"zdiff":            movableKeys(readCmd(-3, 0, 0, 0), numKeys(1)),
+	"zintercard":       movableKeys(readCmd(-3, 0, 0, 0), numKeys(1)),
+	"zmpop":            movableKeys(writeCmd(-4, 0, 0, 0), numKeys(1)),
+
+	// blocking sorted sets
+	"bzpopmin": blockingCmd(writeCmd(-3, 1, -2, 1), secondsAt(-1)),
+	"bzpopmax": blockingCmd(writeCmd(-3, 1, -2, 1), secondsAt(-1)),
+	"bzmpop":   blockingCmd(movableKeys(writeCmd(-5, 0, 0, 0), numKeys(2)), secondsAt(1)),
+
+	// streams
+	"xadd":       writeCmd(-5, 1, 1, 1),
+	"xlen":       readCmd(2, 1, 1, 1),
+	"xrange":     readCmd(-4, 1, 1, 1),
+	"xrevrange":  readCmd(-4, 1, 1, 1),
+	"xdel":       writeCmd(-3, 1, 1, 1),
+	"xtrim":      writeCmd(-4, 1, 1, 1),
+	"xack":       writeCmd(-4, 1, 1, 1),
+	"xclaim":     writeCmd(-6, 1, 1, 1),
+	"xautoclaim": writeCmd(-6, 1, 1, 1),
+	"xpending":   readCmd(-3, 1, 1, 1),
+	"xsetid":     writeCmd(-3, 1, 1, 1),
+	"xgroup":     writeCmd(-2, 2, 2, 1),
+	"xinfo":      readCmd(-2, 2, 2, 1),
+	"xread":      blockingCmd(movableKeys(readCmd(-4, 0, 0, 0), streamKeys), streamBlock),
+	"xreadgroup": blockingCmd(movableKeys(writeCmd(-7, 0, 0, 0), streamKeys), streamBlock),
+
+	// hyperloglog
+	"pfadd":   writeCmd(-2, 1, 1, 1),
+	"pfcount": readCmd(-2, 1, -1, 1),
+	"pfmerge": writeCmd(-2, 1, -1, 1),
+
+	// bitmaps
+	"setbit":      writeCmd(4, 1, 1, 1),
+	"getbit":      readCmd(3, 1, 1, 1),
+	"bitcount":    readCmd(-2, 1, 1, 1),
+	"bitpos":      readCmd(-3, 1, 1, 1),
+	"bitfield":    writeCmd(-2, 1, 1, 1),
+	"bitfield_ro": readCmd(-2, 1, 1, 1),
+	"bitop":       writeCmd(-4, 2, -1, 1),
+
+	// geo
+	"geoadd":               writeCmd(-5, 1, 1, 1),
+	"geodist":              readCmd(-4, 1, 1, 1),
+	"geohash":              readCmd(-2, 1, 1, 1),
+	"geopos":               readCmd(-2, 1, 1, 1),
+	"georadius":            writeCmd(-6, 1, 1, 1),
+	"georadius_ro":         readCmd(-6, 1, 1, 1),
+	"georadiusbymember":    writeCmd(-5, 1, 1, 1),
+	"georadiusbymember_ro": readCmd(-5, 1, 1, 1),
+	"geosearch":            readCmd(-7, 1, 1, 1),
+	"geosearchstore":       writeCmd(-8, 1, 2, 1),
+
+	// scripting
+	"eval":       movableKeys(scriptCmd(writeCmd(-3, 0, 0, 0)), numKeys(2)),
+	"evalsha":    movableKeys(scriptCmd(writeCmd(-3, 0, 0, 0)), numKeys(2)),
+	"eval_ro":    movableKeys(scriptCmd(readCmd(-3, 0, 0, 0)), numKeys(2)),
+	"evalsha_ro": movableKeys(scriptCmd(readCmd(-3, 0, 0, 0)), numKeys(2)),
+	"fcall":      movableKeys(scriptCmd(writeCmd(-3, 0, 0, 0)), numKeys(2)),
+	"fcall_ro":   movableKeys(scriptCmd(readCmd(-3, 0, 0, 0)), numKeys(2)),
+
+	// pub/sub, the channel of SPUBLISH is hashed like a key
+	"publish":  writeCmd(3, 0, 0, 0),
+	"spublish": writeCmd(3, 1, 1, 1),
+
+	// keyless
+	"ping": readCmd(-1, 0, 0, 0),
+	"echo": readCmd(2, 0, 0, 0),
+	"time": readCmd(1, 0, 0, 0),
+}
+
+// unsupported are the commands the proxy refuses, with the reason.
+var unsupported = map[string]string{
+	// a node counts the acks of the writes made on the connection of WAIT,
+	// and the writes of a client go through pooled connections
+	"wait":    "ERR WAIT is not supported by the proxy, the writes of a client are not made on a single connection",
+	"waitaof": "ERR WAITAOF is not supported by the proxy, the writes of a client are not made on a single connection",
+}
+
+// numKeys returns a keys func for commands with the number of keys at pos,
+// followed by the keys, like ZUNION numkeys key [key ...].
+func numKeys(pos int) func(args [][]byte) []int {
+	return func(args [][]byte) []int {
+		if pos >= len(args) {
+			return nil
+		}
+		n, err := strconv.Atoi(string(args[pos]))
+		if err != nil || n < 0 || pos+1+n > len(args) {
+			return nil
+		}
+		return span(pos+1, pos+1+n)
+	}
+}
+
+// storeNumKeys returns the keys of commands like ZUNIONSTORE destination
+// numkeys key [key ...].
+func storeNumKeys(args [][]byte) []int {
+	keys := numKeys(2)(args)
+	if keys == nil {
+		return nil
+	}
+	return append([]int{1}, keys...)
+}
+
+// streamKeys returns the keys of XREAD and XREADGROUP, which are the first
+// half of the arguments after STREAMS.
+func streamKeys(args [][]byte) []int {
+	for i := 1; i < len(args); i++ {
+		if bytes.EqualFold(args[i], []byte("streams")) {
+			n := len(args) - i - 1
+			if n == 0 || n%2 != 0 {
+				return nil
+			}
+			return span(i+1, i+1+n/2)
+		}
+	}
+	return nil
+}
+
+// secondsAt returns a timeout func for commands with a timeout in seconds
+// at pos, which counts from the end when negative.
+func secondsAt(pos int) func(args [][]byte) (time.Duration, bool) {
+	return func(args [][]byte) (time.Duration, bool) {
+		i := pos
+		if i < 0 {
+			i += len(args)
+		}
+		if i < 0 || i >= len(args) {
+			return 0, true
+		}
+		// an invalid timeout is refused by the backend at once
+		secs, err := strconv.ParseFloat(string(args[i]), 64)
+		if err != nil || secs < 0 {
+			return 0, true
+		}
+		return time.Duration(secs * float64(time.Second)), true
+	}
+}
+
+// millisAt returns a timeout func for commands with a timeout in
+// milliseconds at pos.
+func millisAt(pos int) func(args [][]byte) (time.Duration, bool) {
+	return func(args [][]byte) (time.Duration, bool) {
+		if pos >= len(args) {
+			return 0, true
+		}
+		ms, err := strconv.ParseInt(string(args[pos]), 10, 64)
+		if err != nil || ms < 0 {
+			return 0, true
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+}
+
+// streamBlock returns the timeout of the BLOCK option of XREAD and
+// XREADGROUP, which only block with it.
+func streamBlock(args [][]byte) (time.Duration, bool) {
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "streams":
+			return 0, false
+		case "group":
+			i += 2
+		case "count":
+			i++
+		case "block":
+			return millisAt(i + 1)(args)
+		}
+	}
+	return 0, false
+}
+
+// span returns the positions from start up to end.
+func span(start, end int) []int {
+	pos := make([]int, 0, end-start)
+	for i := start; i < end; i++ {
+		pos = append(pos, i)
+	}
+	return pos
+}
+
+// keyPositions returns the positions of the keys of cmd in args.
+func keyPositions(info *commandInfo, args [][]byte) []int {
+	if info.keys != nil {
+		return info.keys(args)
+	}
+	if info.first == 0 {
+		return nil
+	}
+	last := info.last
+	if last < 0 {
+		last += len(args)
+	}
+	var pos []int
+	for i := info.first; i <= last && i < len(args); i += info.step {
+		pos = append(pos, i)
+	}
+	return pos
+}
+
+// commandKeys returns the keys of cmd.
+func commandKeys(info *commandInfo, args [][]byte) [][]byte {
+	var keys [][]byte
+	for _, i := range keyPositions(info, args) {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// lookupCommand returns the info of cmd, or an error reply when the
+// command is unknown or has the wrong number of arguments.
+func lookupCommand(cmd redcon.Command) (*commandInfo, string) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	info, ok := commands[name]
+	if msg, refused := unsupported[name]; refused {
+		return nil, msg
+	}
+	if !ok {
+		return nil, "ERR unknown command '" + string(cmd.Args[0]) + "'"
+	}
+	if (info.arity > 0 && len(cmd.Args) != info.arity) ||
+		(info.arity < 0 && len(cmd.Args) < -info.arity) {
+		return nil, "ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command"
+	}
+	return info, ""
+}
+
+// commandSlot returns the slot of the keys of cmd, -1 for a command without
+// keys. It returns an error reply when the keys hash to different slots.
+func commandSlot(info *commandInfo, cmd redcon.Command) (int, string) {
+	slot := -1
+	for _, key := range commandKeys(info, cmd.Args) {
+		s := keySlot(key)
+		if slot != -1 && s != slot {
+			return 0, "CROSSSLOT Keys in request don't hash to the same slot"
+		}
+		slot = s
+	}
+	return slot, ""
+}
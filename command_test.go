@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"redisp/redcon"
+)
+
+// parseArgs returns the arguments of a command separated by spaces.
+func parseArgs(cmd string) [][]byte {
+	var args [][]byte
+	for _, arg := range strings.Fields(cmd) {
+		args = append(args, []byte(arg))
+	}
+	return args
+}
+
+func TestKeyPositions(t *testing.T) {
+	tests := []struct {
+		cmd string
+		pos []int
+	}{
+		{"get k", []int{1}},
+		{"set k v ex 10", []int{1}},
+		{"mget a b c", []int{1, 2, 3}},
+		{"mset a 1 b 2", []int{1, 3}},
+		{"del a b", []int{1, 2}},
+		{"rename a b", []int{1, 2}},
+		{"lmove a b left right", []int{1, 2}},
+		{"object encoding k", []int{2}},
+		{"bitop and dst a b", []int{2, 3, 4}},
+		{"blpop a b 0", []int{1, 2}},
+		{"lmpop 2 a b left", []int{2, 3}},
+		{"blmpop 0 2 a b left count 2", []int{3, 4}},
+		{"sintercard 2 a b limit 1", []int{2, 3}},
+		{"zunion 2 a b withscores", []int{2, 3}},
+		{"zunionstore dst 2 a b", []int{1, 3, 4}},
+		{"eval script 2 a b arg", []int{3, 4}},
+		{"eval script 0 arg", []int{}},
+		{"fcall f 1 a arg", []int{3}},
+		{"xread count 1 streams a b 0 0", []int{4, 5}},
+		{"xread block 0 streams a $", []int{4}},
+		{"xreadgroup group g c count 1 streams a >", []int{7}},
+		{"echo k", nil},
+		// invalid arguments have no keys, the backend refuses the command
+		{"lmpop x a left", nil},
+		{"lmpop -1 a left", nil},
+		{"lmpop 3 a b", nil},
+		{"zunionstore dst x a", nil},
+		{"xread streams a b 0", nil},
+		{"xread streams", nil},
+		{"xread count 1", nil},
+	}
+	for _, tt := range tests {
+		args := parseArgs(tt.cmd)
+		info := commands[string(args[0])]
+		if info == nil {
+			t.Fatalf("%s: unknown command", args[0])
+		}
+		if pos := keyPositions(info, args); !reflect.DeepEqual(pos, tt.pos) {
+			t.Errorf("%q: expected %v, got %v", tt.cmd, tt.pos, pos)
+		}
+	}
+}
+
+func TestCommandSlot(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		slot   int
+		errMsg string
+	}{
+		{"get foo", 12182, ""},
+		{"mget {user}a {user}b", keySlot([]byte("user")), ""},
+		{"mget a b", 0, "CROSSSLOT Keys in request don't hash to the same slot"},
+		{"eval script 0", -1, ""},
+		{"zunionstore {z}dst 2 {z}a {z}b", keySlot([]byte("z")), ""},
+	}
+	for _, tt := range tests {
+		args := parseArgs(tt.cmd)
+		info := commands[string(args[0])]
+		slot, errMsg := commandSlot(info, redcon.Command{Args: args})
+		if slot != tt.slot || errMsg != tt.errMsg {
+			t.Errorf("%q: expected %d %q, got %d %q", tt.cmd, tt.slot, tt.errMsg, slot, errMsg)
+		}
+	}
+}
+
+func TestLookupCommand(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		errMsg string
+	}{
+		{"GET k", ""},
+		{"get", "ERR wrong number of arguments for 'get' command"},
+		{"get a b", "ERR wrong number of arguments for 'get' command"},
+		{"mget a b c", ""},
+		{"nosuchcommand", "ERR unknown command 'nosuchcommand'"},
+		{"wait 1 0", unsupported["wait"]},
+	}
+	for _, tt := range tests {
+		info, errMsg := lookupCommand(redcon.Command{Args: parseArgs(tt.cmd)})
+		if errMsg != tt.errMsg || (errMsg == "") != (info != nil) {
+			t.Errorf("%q: expected %q, got %v %q", tt.cmd, tt.errMsg, info, errMsg)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// scanPage is a page of SCAN. Its cursor is checkpointed once all the
+// batches of the page are copied.
+type scanPage struct {
+	cursor uint64
+	wg     sync.WaitGroup
+}
+
+// copyBatch is a batch of keys copied with one pipeline.
+type copyBatch struct {
+	keys []string
+	page *scanPage
+}
+
+// nodeMigrate copies the keys of a source node to the target. One goroutine
+// scans the node and splits the pages into batches, copyWorkers goroutines
+// copy the batches, and the pages are checkpointed in scan order. Once stop
+// is closed the pages already scanned are copied and checkpointed, and the
+// copy resumes from there.
+func nodeMigrate(name string, sourceClient *redis.Client, targetClient redis.UniversalClient, state *migrateState, t *throttle, stop <-chan struct{}) {
+	node := state.node(name)
+	if node.Cursor > 0 {
+		log.Println("resume", node.Addr, "from cursor:", node.Cursor, "keys:", node.Keys)
+	}
+	if adaptive {
+		done := make(chan struct{})
+		defer close(done)
+		go t.adapt(sourceClient, maxOps, maxLatency, done)
+	}
+
+	batches := make(chan copyBatch, copyWorkers)
+	pages := make(chan *scanPage, copyWorkers)
+	keys, errs, skips := node.Keys, node.Errors, node.Skipped
+	var wg sync.WaitGroup
+	for i := 0; i < copyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				t.acquire(len(b.keys))
+				copied, failed, skipped, size := copyKeys(sourceClient, targetClient, b.keys, true)
+				t.release(size)
+				atomic.AddInt64(&keys, int64(copied))
+				atomic.AddInt64(&errs, int64(failed))
+				atomic.AddInt64(&skips, int64(skipped))
+				b.page.wg.Done()
+			}
+		}()
+	}
+	go func() {
+		defer close(pages)
+		defer close(batches)
+		scanNode(sourceClient, targetClient, node.Cursor, pages, batches, stop)
+	}()
+
+	for page := range pages {
+		page.wg.Wait()
+		node.Cursor = page.cursor
+		node.Done = page.cursor == 0
+		node.Keys = atomic.LoadInt64(&keys)
+		node.Errors = atomic.LoadInt64(&errs)
+		node.Skipped = atomic.LoadInt64(&skips)
+		if err := state.checkpoint(node); err != nil {
+			log.Println("checkpoint:", err)
+		}
+		if node.Done {
+			log.Println("congratulation, migrate done ...")
+		}
+	}
+	wg.Wait()
+	if !node.Done {
+		log.Println("stop", node.Addr, "at cursor:", node.Cursor, "keys:", node.Keys)
+	}
+}
+
+// scanNode scans the source node from cursor and queues its pages and
+// batches. It stops at the end of the scan, when the target uses more memory
+// than limitMemory or when stop is closed.
+func scanNode(sourceClient *redis.Client, targetClient redis.UniversalClient, cursor uint64, pages chan<- *scanPage, batches chan<- copyBatch, stop <-chan struct{}) {
+	r, _ := regexp.Compile(".*used_memory:(.*).*")
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		keys, next, err := sourceClient.Scan(cursor, keyRules.scanPattern(), 1000).Result()
+		if err != nil {
+			log.Println(err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		log.Println("cursor:", next)
+		page := &scanPage{cursor: next}
+		n := (len(keys) + copyBatchSize - 1) / copyBatchSize
+		page.wg.Add(n)
+		pages <- page
+		for i := 0; i < len(keys); i += copyBatchSize {
+			j := i + copyBatchSize
+			if j > len(keys) {
+				j = len(keys)
+			}
+			batches <- copyBatch{keys: keys[i:j], page: page}
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+		if limitMemory > 0 {
+			val, _ := targetClient.Info("Memory").Result()
+			used, _ := strconv.Atoi(strings.TrimSpace(strings.Split(r.FindString(val)+":", ":")[1]))
+			log.Println("info Memory:", used)
+			if used > limitMemory {
+				log.Println("target memory limit reached, stop at cursor:", cursor)
+				return
+			}
+		}
+	}
+}
+
+// copyKeys copies keys from source to target in two round-trips: one
+// pipeline of DUMP and PTTL to the source, and one pipeline of RESTORE to
+// the target. The restores are sorted by slot so the commands of a target
+// node are sent together. Keys whose payload the target rejects are copied
+// by type when replacing. Keys not selected by the rules are left out and
+// the others are renamed. Without replace a key already on the target is
+// left alone, it was written there after it was read from the source. It
+// returns the number of keys copied, failed and skipped because they
+// expired or were deleted after the scan, and the size of the payloads.
+func copyKeys(source, target redis.Cmdable, keys []string, replace bool) (copied, failed, skipped, size int) {
+	var selected []string
+	for _, key := range keys {
+		if keyRules.matchName(key) {
+			selected = append(selected, key)
+		}
+	}
+	keys = selected
+	dumps := make([]*redis.StringCmd, len(keys))
+	pttls := make([]*redis.DurationCmd, len(keys))
+	types := make([]*redis.StatusCmd, len(keys))
+	source.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			dumps[i] = pipe.Dump(key)
+			pttls[i] = pipe.PTTL(key)
+			if keyRules.needType() {
+				types[i] = pipe.Type(key)
+			}
+		}
+		return nil
+	})
+
+	type restore struct {
+		key     string
+		name    string
+		slot    int
+		ttl     time.Duration
+		payload string
+		cmd     *redis.StatusCmd
+	}
+	var restores []*restore
+	for i, key := range keys {
+		err := dumps[i].Err()
+		if err == nil {
+			err = pttls[i].Err()
+		}
+		if err == redis.Nil {
+			// the key expired or was deleted after it was scanned
+			skipped++
+			continue
+		}
+		if err != nil {
+			log.Println("migrate key:", key, err)
+			failed++
+			continue
+		}
+		ttl, ok := restoreTTL(pttls[i].Val())
+		if !ok {
+			skipped++
+			continue
+		}
+		payload := dumps[i].Val()
+		var typ string
+		if types[i] != nil {
+			typ = types[i].Val()
+		}
+		if !keyRules.matchValue(typ, ttl, len(payload)) {
+			continue
+		}
+		size += len(payload)
+		name := keyRules.rename(key)
+		restores = append(restores, &restore{key: key, name: name, slot: keySlot([]byte(name)), ttl: ttl, payload: payload})
+	}
+	sort.Slice(restores, func(i, j int) bool { return restores[i].slot < restores[j].slot })
+
+	target.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, r := range restores {
+			if replace {
+				r.cmd = pipe.RestoreReplace(r.name, r.ttl, r.payload)
+			} else {
+				r.cmd = pipe.Restore(r.name, r.ttl, r.payload)
+			}
+		}
+		return nil
+	})
+	for _, r := range restores {
+		err := r.cmd.Err()
+		if err != nil && !replace && strings.HasPrefix(err.Error(), "BUSYKEY") {
+			copied++
+			continue
+		}
+		if err != nil && replace && isPayloadError(err) {
+			// a copy by type deletes the key first, so it replaces
+			var e *entry
+			if e, err = readEntry(source, r.key); err == nil && e != nil {
+				e.Key = r.name
+				err = writeEntry(target, e)
+			}
+		}
+		if err != nil {
+			log.Println("migrate key:", r.key, err)
+			failed++
+			continue
+		}
+		copied++
+	}
+	return copied, failed, skipped, size
+}
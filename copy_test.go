@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"redisp/redcon"
+
+	"github.com/go-redis/redis"
+)
+
+func TestCopyKeysSkipped(t *testing.T) {
+	source := fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		key := string(cmd.Args[1])
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "dump":
+			if key == "deleted" {
+				conn.WriteNull()
+			} else {
+				conn.WriteBulkString("payload")
+			}
+		case "pttl":
+			if key == "expired" {
+				conn.WriteInt(-2)
+			} else {
+				conn.WriteInt(-1)
+			}
+		}
+	})
+	target := fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		if string(cmd.Args[1]) == "bad" {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		conn.WriteString("OK")
+	})
+	saved := keyRules
+	defer func() { keyRules = saved }()
+	keyRules = parseRules(t)
+	sourceClient := redis.NewClient(&redis.Options{Addr: source})
+	defer sourceClient.Close()
+	targetClient := redis.NewClient(&redis.Options{Addr: target})
+	defer targetClient.Close()
+
+	copied, failed, skipped, size := copyKeys(sourceClient, targetClient, []string{"a", "deleted", "expired", "b", "bad"}, true)
+	if copied != 2 || failed != 1 || skipped != 2 || size != 3*len("payload") {
+		t.Fatalf("expected 2 copied, 1 failed and 2 skipped, got %d %d %d, size %d", copied, failed, skipped, size)
+	}
+}
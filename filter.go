@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"redisp/redcon"
+)
+
+// rules select the keys that are migrated and rename them on the target.
+// The bulk copy applies all the rules. The proxy, the live sync and the
+// import only know the key names of most commands and apply the name rules
+// and the renames; the import also filters by type and ttl.
+type rules struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	types   map[string]bool
+	minTTL  time.Duration
+	maxTTL  time.Duration
+	minSize int
+	maxSize int
+
+	stripPrefix string
+	addPrefix   string
+	replace     []replaceRule
+	dbs         map[int]int
+
+	// pattern is the SCAN MATCH pattern of the bulk copy
+	pattern string
+}
+
+// replaceRule renames the keys matching re to repl, which can refer to the
+// submatches of re like regexp.ReplaceAllString.
+type replaceRule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// keyRules are the rules of the migration, nil when there are none.
+var keyRules *rules
+
+// listFlag is a flag that can be repeated.
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// ruleFlags defines the flags of the rules on fs. The returned func builds
+// the rules once fs is parsed.
+func ruleFlags(fs *flag.FlagSet) func() (*rules, error) {
+	var (
+		include, exclude, includeRegex, excludeRegex listFlag
+		types, renames, dbs                          listFlag
+		minTTL, maxTTL                               time.Duration
+		minSize, maxSize                             int
+		stripPrefix, addPrefix                       string
+	)
+	fs.Var(&include, "include", "migrate only the keys matching the glob pattern, can be repeated")
+	fs.Var(&exclude, "exclude", "do not migrate the keys matching the glob pattern, can be repeated")
+	fs.Var(&includeRegex, "include-regex", "migrate only the keys matching the regexp, can be repeated")
+	fs.Var(&excludeRegex, "exclude-regex", "do not migrate the keys matching the regexp, can be repeated")
+	fs.Var(&types, "type", "migrate only the keys of the type, can be repeated")
+	fs.DurationVar(&minTTL, "min-ttl", 0, "do not migrate the keys expiring sooner")
+	fs.DurationVar(&maxTTL, "max-ttl", 0, "do not migrate the keys without ttl or expiring later, 0 is unlimited")
+	fs.IntVar(&minSize, "min-size", 0, "do not migrate the keys with a smaller DUMP payload")
+	fs.IntVar(&maxSize, "max-size", 0, "do not migrate the keys with a bigger DUMP payload, 0 is unlimited")
+	fs.StringVar(&stripPrefix, "strip-prefix", "", "remove the prefix from the migrated keys")
+	fs.StringVar(&addPrefix, "add-prefix", "", "add the prefix to the migrated keys, after -strip-prefix and -rename")
+	fs.Var(&renames, "rename", "rename the keys matching the regexp with regexp=replacement, can be repeated")
+	fs.Var(&dbs, "db-map", "write the keys of a source db to a target db with source:target, can be repeated")
+	return func() (*rules, error) {
+		r := &rules{
+			minTTL:      minTTL,
+			maxTTL:      maxTTL,
+			minSize:     minSize,
+			maxSize:     maxSize,
+			stripPrefix: stripPrefix,
+			addPrefix:   addPrefix,
+		}
+		for _, pattern := range include {
+			r.include = append(r.include, globRegexp(pattern))
+		}
+		for _, pattern := range exclude {
+			r.exclude = append(r.exclude, globRegexp(pattern))
+		}
+		if len(include) == 1 && len(includeRegex) == 0 {
+			r.pattern = include[0]
+		}
+		for _, expr := range includeRegex {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			r.include = append(r.include, re)
+		}
+		for _, expr := range excludeRegex {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			r.exclude = append(r.exclude, re)
+		}
+		for _, t := range types {
+			if r.types == nil {
+				r.types = make(map[string]bool)
+			}
+			r.types[strings.ToLower(t)] = true
+		}
+		for _, rename := range renames {
+			i := strings.Index(rename, "=")
+			if i == -1 {
+				return nil, fmt.Errorf("invalid rename %q, expected regexp=replacement", rename)
+			}
+			re, err := regexp.Compile(rename[:i])
+			if err != nil {
+				return nil, err
+			}
+			r.replace = append(r.replace, replaceRule{re: re, repl: rename[i+1:]})
+		}
+		for _, m := range dbs {
+			var src, dst int
+			if _, err := fmt.Sscanf(m, "%d:%d", &src, &dst); err != nil {
+				return nil, fmt.Errorf("invalid db-map %q, expected source:target", m)
+			}
+			if r.dbs == nil {
+				r.dbs = make(map[int]int)
+			}
+			r.dbs[src] = dst
+		}
+		if r.empty() {
+			return nil, nil
+		}
+		return r, nil
+	}
+}
+
+func (r *rules) empty() bool {
+	return len(r.include) == 0 && len(r.exclude) == 0 && r.types == nil &&
+		r.minTTL == 0 && r.maxTTL == 0 && r.minSize == 0 && r.maxSize == 0 &&
+		!r.renames() && r.dbs == nil
+}
+
+// globRegexp converts a redis glob pattern to a regexp.
+func globRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString("(?s:.*)")
+		case '?':
+			b.WriteString("(?s:.)")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j == -1 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+j]
+			b.WriteString("[")
+			if strings.HasPrefix(class, "^") || strings.HasPrefix(class, "!") {
+				b.WriteString("^")
+				class = class[1:]
+			}
+			b.WriteString(strings.Replace(class, `\`, `\\`, -1))
+			b.WriteString("]")
+			i += j + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return regexp.MustCompile("^" + regexp.QuoteMeta(pattern) + "$")
+	}
+	return re
+}
+
+// scanPattern returns the SCAN MATCH pattern of the bulk copy.
+func (r *rules) scanPattern() string {
+	if r == nil || r.pattern == "" {
+		return "*"
+	}
+	return r.pattern
+}
+
+// matchName reports whether key is selected by the include and exclude
+// rules.
+func (r *rules) matchName(key string) bool {
+	if r == nil {
+		return true
+	}
+	ok := len(r.include) == 0
+	for _, re := range r.include {
+		if re.MatchString(key) {
+			ok = true
+			break
+		}
+	}
+	for _, re := range r.exclude {
+		if re.MatchString(key) {
+			return false
+		}
+	}
+	return ok
+}
+
+// needType reports whether the type of the keys must be read.
+func (r *rules) needType() bool {
+	return r != nil && r.types != nil
+}
+
+// matchValue reports whether a key of type typ with ttl, 0 when the key
+// does not expire, and a DUMP payload of size bytes is selected. A negative
+// size is unknown and not checked.
+func (r *rules) matchValue(typ string, ttl time.Duration, size int) bool {
+	if r == nil {
+		return true
+	}
+	if r.types != nil && !r.types[typ] {
+		return false
+	}
+	if r.minTTL > 0 && ttl > 0 && ttl < r.minTTL {
+		return false
+	}
+	if r.maxTTL > 0 && (ttl == 0 || ttl > r.maxTTL) {
+		return false
+	}
+	if size >= 0 && (size < r.minSize || (r.maxSize > 0 && size > r.maxSize)) {
+		return false
+	}
+	return true
+}
+
+func (r *rules) renames() bool {
+	return r.stripPrefix != "" || r.addPrefix != "" || len(r.replace) > 0
+}
+
+// rename returns the name of key on the target.
+func (r *rules) rename(key string) string {
+	if r == nil {
+		return key
+	}
+	key = strings.TrimPrefix(key, r.stripPrefix)
+	for _, rr := range r.replace {
+		key = rr.re.ReplaceAllString(key, rr.repl)
+	}
+	return r.addPrefix + key
+}
+
+// targetDB returns the target db of the keys of the source db. It reports
+// false when the db is not migrated. Without a db map each db is written to
+// the same db of the target.
+func (r *rules) targetDB(db int) (int, bool) {
+	if r == nil || r.dbs == nil {
+		return db, true
+	}
+	dst, ok := r.dbs[db]
+	return dst, ok
+}
+
+// sourceDBs returns the source dbs whose keys are written to db of the
+// target.
+func (r *rules) sourceDBs(db int) []int {
+	if r == nil || r.dbs == nil {
+		return []int{db}
+	}
+	var dbs []int
+	for src, dst := range r.dbs {
+		if dst == db {
+			dbs = append(dbs, src)
+		}
+	}
+	sort.Ints(dbs)
+	return dbs
+}
+
+var errExcluded = errors.New("ERR key excluded from the migration")
+
+// rewriteArgs returns the arguments of a command for the target with its
+// keys renamed. It returns errExcluded when a key is not selected by the
+// name rules. args is not modified.
+func (r *rules) rewriteArgs(info *commandInfo, args [][]byte) ([][]byte, error) {
+	if r == nil {
+		return args, nil
+	}
+	var out [][]byte
+	for _, i := range keyPositions(info, args) {
+		key := string(args[i])
+		if !r.matchName(key) {
+			return nil, errExcluded
+		}
+		if !r.renames() {
+			continue
+		}
+		if out == nil {
+			out = append([][]byte(nil), args...)
+		}
+		out[i] = []byte(r.rename(key))
+	}
+	if out == nil {
+		return args, nil
+	}
+	return out, nil
+}
+
+// rewriteCommand returns the raw command and slot of cmd for the target.
+// The commands of the proxy run on db 0 of the source, so every key is
+// excluded when db 0 is not migrated.
+func (r *rules) rewriteCommand(info *commandInfo, cmd redcon.Command, slot int) ([]byte, int, error) {
+	if _, ok := r.targetDB(0); !ok {
+		return nil, 0, errExcluded
+	}
+	args, err := r.rewriteArgs(info, cmd.Args)
+	if err != nil || r == nil || !r.renames() {
+		return cmd.Raw, slot, err
+	}
+	raw := redcon.AppendArray(nil, len(args))
+	for _, arg := range args {
+		raw = redcon.AppendBulk(raw, arg)
+	}
+	slot, errMsg := commandSlot(info, redcon.Command{Raw: raw, Args: args})
+	if errMsg != "" {
+		return nil, 0, errors.New(errMsg + " after renaming")
+	}
+	return raw, slot, nil
+}
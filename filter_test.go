@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+// parseRules builds the rules of the flags in args.
+func parseRules(t *testing.T, args ...string) *rules {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	build := ruleFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	r, err := build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "a\nb", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users:1", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"user:?", "user:\n", true},
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[!e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h\?`, "h?", true},
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{"a+(b)", "a+(b)", true},
+		{"h[llo", "h[llo", true},
+		{"h[llo", "hello", false},
+		{"key", "prefix:key", false},
+		{"key", "key:suffix", false},
+	}
+	for _, tt := range tests {
+		if match := globRegexp(tt.pattern).MatchString(tt.key); match != tt.match {
+			t.Errorf("%q %q: expected %v, got %v", tt.pattern, tt.key, tt.match, match)
+		}
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		args  []string
+		key   string
+		match bool
+	}{
+		{[]string{"-include", "user:*"}, "user:1", true},
+		{[]string{"-include", "user:*"}, "order:1", false},
+		{[]string{"-include", "user:*", "-include", "order:*"}, "order:1", true},
+		{[]string{"-exclude", "tmp:*"}, "tmp:1", false},
+		{[]string{"-exclude", "tmp:*"}, "user:1", true},
+		{[]string{"-include", "user:*", "-exclude", "user:tmp:*"}, "user:tmp:1", false},
+		{[]string{"-include-regex", `^user:\d+$`}, "user:12", true},
+		{[]string{"-include-regex", `^user:\d+$`}, "user:x", false},
+		{[]string{"-exclude-regex", `:tmp$`}, "user:tmp", false},
+	}
+	for _, tt := range tests {
+		if match := parseRules(t, tt.args...).matchName(tt.key); match != tt.match {
+			t.Errorf("%v %q: expected %v, got %v", tt.args, tt.key, tt.match, match)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	tests := []struct {
+		args []string
+		key  string
+		exp  string
+	}{
+		{nil, "user:1", "user:1"},
+		{[]string{"-strip-prefix", "old:"}, "old:user:1", "user:1"},
+		{[]string{"-strip-prefix", "old:"}, "user:1", "user:1"},
+		{[]string{"-add-prefix", "new:"}, "user:1", "new:user:1"},
+		{[]string{"-strip-prefix", "old:", "-add-prefix", "new:"}, "old:user:1", "new:user:1"},
+		{[]string{"-rename", `^user:(\d+)$=account:$1`}, "user:12", "account:12"},
+		{[]string{"-rename", `^user:(\d+)$=account:$1`}, "user:x", "user:x"},
+		{[]string{"-rename", "a=b", "-rename", "b=c"}, "a", "c"},
+		{[]string{"-rename", "x=y=z"}, "x", "y=z"},
+		// the prefix is stripped before the renames and added after them
+		{[]string{"-strip-prefix", "old:", "-rename", "^old:=x:", "-add-prefix", "new:"}, "old:old:1", "new:x:1"},
+	}
+	for _, tt := range tests {
+		if key := parseRules(t, tt.args...).rename(tt.key); key != tt.exp {
+			t.Errorf("%v %q: expected %q, got %q", tt.args, tt.key, tt.exp, key)
+		}
+	}
+}
+
+func TestTargetDB(t *testing.T) {
+	tests := []struct {
+		args []string
+		db   int
+		dst  int
+		ok   bool
+	}{
+		{nil, 0, 0, true},
+		{nil, 3, 3, true},
+		{[]string{"-include", "user:*"}, 5, 5, true},
+		{[]string{"-db-map", "0:2"}, 0, 2, true},
+		{[]string{"-db-map", "0:2"}, 1, 0, false},
+		{[]string{"-db-map", "0:0", "-db-map", "3:0"}, 3, 0, true},
+	}
+	for _, tt := range tests {
+		dst, ok := parseRules(t, tt.args...).targetDB(tt.db)
+		if dst != tt.dst || ok != tt.ok {
+			t.Errorf("%v %d: expected %d %v, got %d %v", tt.args, tt.db, tt.dst, tt.ok, dst, ok)
+		}
+	}
+}
+
+func TestRewriteCommandDB(t *testing.T) {
+	cmd := parseCommand("get a")
+	info, _ := lookupCommand(cmd)
+	if _, _, err := parseRules(t, "-db-map", "0:2").rewriteCommand(info, cmd, 0); err != nil {
+		t.Fatalf("db 0 mapped: expected no error, got %v", err)
+	}
+	if _, _, err := parseRules(t, "-db-map", "1:0").rewriteCommand(info, cmd, 0); err != errExcluded {
+		t.Fatalf("db 0 not mapped: expected %v, got %v", errExcluded, err)
+	}
+}
+
+func TestRuleFlagsInvalid(t *testing.T) {
+	tests := [][]string{
+		{"-rename", "norepl"},
+		{"-rename", "(=x"},
+		{"-include-regex", "("},
+		{"-exclude-regex", "["},
+		{"-db-map", "1"},
+		{"-db-map", "a:b"},
+	}
+	for _, args := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		build := ruleFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := build(); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"redisp/rdb"
+
+	"github.com/go-redis/redis"
+)
+
+// importMain runs the import command, which loads an rdb file into the
+// target.
+func importMain(args []string) {
+	var (
+		rdbPath string
+		db      int
+	)
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.StringVar(&rdbPath, "rdb", "dump.rdb", "rdb file to import")
+	fs.StringVar(&targetAddr, "t", "localhost:6379", "target redis addresses, comma separated")
+	fs.IntVar(&db, "db", 0, "logical database of the rdb file to import, -1 for all")
+	buildTarget := topologyFlags(fs, "target")
+	buildRules := ruleFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: redisp import [-rdb dump.rdb] [-t target] [-target-mode mode]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if keyRules, err = buildRules(); err != nil {
+		log.Fatal(err)
+	}
+	if targetTopo, err = buildTarget(targetAddr); err != nil {
+		log.Fatal("target: ", err)
+	}
+
+	f, err := os.Open(rdbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	targetClient := targetTopo.client(0)
+	log.Printf("import %s\ntarget: %s\n", rdbPath, targetTopo)
+
+	keys, err := importRDB(f, targetClient, db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("congratulation, import done, keys:", keys)
+}
+
+// importRDB writes the keys of the rdb read from r to target. Only the keys
+// of db are written, unless db is -1. Keys that already expired or are not
+// selected by the rules are skipped, the others are renamed.
+func importRDB(r io.Reader, target redis.UniversalClient, db int) (int64, error) {
+	var keys int64
+	d := rdb.NewDecoder(r)
+	for {
+		re, err := d.Next()
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return keys, err
+		}
+		if db != -1 && re.DB != db {
+			continue
+		}
+		dst, ok := keyRules.targetDB(re.DB)
+		if !ok || !keyRules.matchName(re.Key) {
+			continue
+		}
+		e := rdbEntry(re)
+		if e == nil || !keyRules.matchValue(e.Type, e.TTL, -1) {
+			continue
+		}
+		e.Key = keyRules.rename(e.Key)
+		client, err := targetTopo.selectDB(target, dst)
+		if err != nil {
+			return keys, err
+		}
+		if err := writeEntry(client, e); err != nil {
+			log.Println("import key:", e.Key, err)
+			continue
+		}
+		keys++
+	}
+}
+
+// rdbEntry converts a decoded rdb key into an entry for writeEntry. It
+// returns nil when the key already expired. The fields of a hash that
+// already expired are left out.
+func rdbEntry(re *rdb.Entry) *entry {
+	e := &entry{Key: re.Key, Type: re.Type}
+	if !re.ExpireAt.IsZero() {
+		e.TTL = time.Until(re.ExpireAt)
+		if e.TTL < time.Millisecond {
+			return nil
+		}
+	}
+	switch v := re.Value.(type) {
+	case map[string]string:
+		for field, at := range re.FieldExpireAt {
+			ttl := time.Until(at)
+			if ttl < time.Millisecond {
+				delete(v, field)
+				continue
+			}
+			if e.FieldTTL == nil {
+				e.FieldTTL = make(map[string]time.Duration)
+			}
+			e.FieldTTL[field] = ttl
+		}
+		if len(v) == 0 {
+			return nil
+		}
+		e.Value = v
+	case []rdb.ZMember:
+		zset := make([]redis.Z, len(v))
+		for i, m := range v {
+			zset[i] = redis.Z{Score: m.Score, Member: m.Member}
+		}
+		e.Value = zset
+	case *rdb.Stream:
+		msgs := make([]redis.XMessage, len(v.Entries))
+		for i, se := range v.Entries {
+			values := make(map[string]interface{}, len(se.Fields)/2)
+			for j := 0; j < len(se.Fields); j += 2 {
+				values[se.Fields[j]] = se.Fields[j+1]
+			}
+			msgs[i] = redis.XMessage{ID: se.ID.String(), Values: values}
+		}
+		e.Value = msgs
+		e.LastID = v.LastID.String()
+		for _, g := range v.Groups {
+			if e.Groups == nil {
+				e.Groups = make(map[string]string)
+			}
+			e.Groups[g.Name] = g.LastID.String()
+		}
+	default:
+		e.Value = v
+	}
+	return e
+}
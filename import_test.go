@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"redisp/rdb"
+
+	"github.com/go-redis/redis"
+)
+
+func TestRDBEntry(t *testing.T) {
+	if e := rdbEntry(&rdb.Entry{Key: "k", Type: "string", Value: "v", ExpireAt: time.Now().Add(-time.Second)}); e != nil {
+		t.Fatalf("expected an expired key to be skipped, got %+v", e)
+	}
+
+	e := rdbEntry(&rdb.Entry{Key: "s", Type: "stream", Value: &rdb.Stream{
+		Entries: []rdb.StreamEntry{{ID: rdb.StreamID{Ms: 10, Seq: 1}, Fields: []string{"f", "v"}}},
+		LastID:  rdb.StreamID{Ms: 12},
+		Groups:  []rdb.StreamGroup{{Name: "g", LastID: rdb.StreamID{Ms: 10, Seq: 1}}},
+	}})
+	exp := &entry{Key: "s", Type: "stream",
+		Value:  []redis.XMessage{{ID: "10-1", Values: map[string]interface{}{"f": "v"}}},
+		LastID: "12-0",
+		Groups: map[string]string{"g": "10-1"},
+	}
+	if !reflect.DeepEqual(e, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, e)
+	}
+
+	now := time.Now()
+	e = rdbEntry(&rdb.Entry{Key: "h", Type: "hash",
+		Value: map[string]string{"live": "1", "gone": "2", "kept": "3"},
+		FieldExpireAt: map[string]time.Time{
+			"live": now.Add(time.Hour),
+			"gone": now.Add(-time.Second),
+		},
+	})
+	if !reflect.DeepEqual(e.Value, map[string]string{"live": "1", "kept": "3"}) {
+		t.Fatalf("expected the expired field to be dropped, got %v", e.Value)
+	}
+	if ttl, ok := e.FieldTTL["live"]; len(e.FieldTTL) != 1 || !ok || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("expected the ttl of live only, got %v", e.FieldTTL)
+	}
+
+	e = rdbEntry(&rdb.Entry{Key: "h", Type: "hash",
+		Value:         map[string]string{"gone": "1"},
+		FieldExpireAt: map[string]time.Time{"gone": now.Add(-time.Second)},
+	})
+	if e != nil {
+		t.Fatalf("expected a hash without fields left to be skipped, got %+v", e)
+	}
+}
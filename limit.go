@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	minBackoff = 10 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// limiter is a token bucket refilled at rate tokens per second and holding
+// at most one second of tokens. A rate of 0 disables the limiter.
+type limiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64) *limiter {
+	return &limiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take removes n tokens and sleeps until the bucket is no longer in debt.
+// Taking tokens after the work is done, when its size is known, makes the
+// next caller wait instead.
+func (l *limiter) take(n int) {
+	if l == nil || l.rate <= 0 || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / l.rate * float64(time.Second)))
+	}
+}
+
+// limits are the throttling settings of the copy. Zero values are
+// unlimited.
+type limits struct {
+	keys     float64 // keys per second
+	bytes    float64 // payload bytes per second
+	inflight int     // pipelines running at the same time
+}
+
+// throttle slows down the copy of a node, or of all nodes when it is the
+// parent of the node throttles.
+type throttle struct {
+	parent   *throttle
+	keys     *limiter
+	bytes    *limiter
+	inflight chan struct{}
+	// backoff is the pause in nanoseconds before each pipeline, raised by
+	// adapt while the source is overloaded
+	backoff int64
+}
+
+func newThrottle(l limits, parent *throttle) *throttle {
+	t := &throttle{
+		parent: parent,
+		keys:   newLimiter(l.keys),
+		bytes:  newLimiter(l.bytes),
+	}
+	if l.inflight > 0 {
+		t.inflight = make(chan struct{}, l.inflight)
+	}
+	return t
+}
+
+// acquire waits until a pipeline of n keys may be sent.
+func (t *throttle) acquire(n int) {
+	if t == nil {
+		return
+	}
+	t.parent.acquire(n)
+	if d := atomic.LoadInt64(&t.backoff); d > 0 {
+		time.Sleep(time.Duration(d))
+	}
+	t.keys.take(n)
+	if t.inflight != nil {
+		t.inflight <- struct{}{}
+	}
+}
+
+// release ends a pipeline that copied size bytes.
+func (t *throttle) release(size int) {
+	if t == nil {
+		return
+	}
+	if t.inflight != nil {
+		<-t.inflight
+	}
+	t.bytes.take(size)
+	t.parent.release(size)
+}
+
+// adapt polls the source node every second until done is closed, doubling
+// the backoff while its instantaneous_ops_per_sec is above maxOps or its
+// latency is above maxLatency, and halving it once the load drops.
+func (t *throttle) adapt(client *redis.Client, maxOps int64, maxLatency time.Duration, done chan struct{}) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+		start := time.Now()
+		info, err := client.Info("stats").Result()
+		latency := time.Since(start)
+		if err != nil {
+			log.Println("adapt", client.Options().Addr, err)
+			continue
+		}
+		ops, _ := strconv.ParseInt(infoField(info, "instantaneous_ops_per_sec"), 10, 64)
+		old := time.Duration(atomic.LoadInt64(&t.backoff))
+		overloaded := (maxOps > 0 && ops > maxOps) || (maxLatency > 0 && latency > maxLatency)
+		if d := nextBackoff(old, overloaded); d != old {
+			log.Println("adapt", client.Options().Addr, "ops:", ops, "latency:", latency, "backoff:", d)
+			atomic.StoreInt64(&t.backoff, int64(d))
+		}
+	}
+}
+
+// nextBackoff returns the backoff following old, doubled from minBackoff up
+// to maxBackoff while the source is overloaded and halved down to 0
+// otherwise.
+func nextBackoff(old time.Duration, overloaded bool) time.Duration {
+	if !overloaded {
+		if d := old / 2; d >= minBackoff {
+			return d
+		}
+		return 0
+	}
+	d := old * 2
+	if d < minBackoff {
+		d = minBackoff
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterTake(t *testing.T) {
+	tests := []struct {
+		rate   float64
+		takes  []int
+		tokens float64 // left after the takes, without refill
+		wait   time.Duration
+	}{
+		{0, []int{100}, 0, 0},
+		{100, []int{0, -5}, 100, 0},
+		{100, []int{40}, 60, 0},
+		{100, []int{40, 60}, 0, 0},
+		{1000, []int{1020}, -20, 20 * time.Millisecond},
+		{1000, []int{500, 530}, -30, 30 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		l := newLimiter(tt.rate)
+		start := time.Now()
+		for _, n := range tt.takes {
+			l.take(n)
+		}
+		elapsed := time.Since(start)
+		if elapsed < tt.wait || elapsed > tt.wait+time.Second/2 {
+			t.Errorf("%v %v: expected to wait %v, waited %v", tt.rate, tt.takes, tt.wait, elapsed)
+		}
+		// the refill during the takes is at most the wait plus some slack
+		slack := (elapsed.Seconds() + 0.01) * tt.rate
+		if l.tokens < tt.tokens || l.tokens > tt.tokens+slack {
+			t.Errorf("%v %v: expected %v tokens, got %v", tt.rate, tt.takes, tt.tokens, l.tokens)
+		}
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l := newLimiter(100)
+	l.take(100)
+	// the bucket holds at most a second of tokens
+	l.last = l.last.Add(-10 * time.Second)
+	l.take(1)
+	if l.tokens < 98 || l.tokens > 99 {
+		t.Fatalf("expected 99 tokens, got %v", l.tokens)
+	}
+	var nilLimiter *limiter
+	nilLimiter.take(10)
+}
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		old        time.Duration
+		overloaded bool
+		exp        time.Duration
+	}{
+		{0, false, 0},
+		{0, true, minBackoff},
+		{minBackoff, true, 2 * minBackoff},
+		{time.Millisecond, true, minBackoff},
+		{3 * time.Second, true, maxBackoff},
+		{maxBackoff, true, maxBackoff},
+		{maxBackoff, false, maxBackoff / 2},
+		{2 * minBackoff, false, minBackoff},
+		{minBackoff, false, 0},
+		{15 * time.Millisecond, false, 0},
+	}
+	for _, tt := range tests {
+		if d := nextBackoff(tt.old, tt.overloaded); d != tt.exp {
+			t.Errorf("%v %v: expected %v, got %v", tt.old, tt.overloaded, tt.exp, d)
+		}
+	}
+}
+
+func TestThrottleInflight(t *testing.T) {
+	tests := []struct {
+		node, all int
+		running   int
+	}{
+		{0, 0, 3},
+		{2, 0, 2},
+		{0, 1, 1},
+		{2, 1, 1},
+	}
+	for _, tt := range tests {
+		all := newThrottle(limits{inflight: tt.all}, nil)
+		node := newThrottle(limits{inflight: tt.node}, all)
+		started := make(chan struct{}, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				node.acquire(1)
+				started <- struct{}{}
+			}()
+		}
+		running := 0
+		timeout := time.After(50 * time.Millisecond)
+	wait:
+		for running < 3 {
+			select {
+			case <-started:
+				running++
+			case <-timeout:
+				break wait
+			}
+		}
+		if running != tt.running {
+			t.Errorf("node %d all %d: expected %d pipelines running, got %d", tt.node, tt.all, tt.running, running)
+		}
+		for ; running < 3; running++ {
+			node.release(0)
+			<-started
+		}
+	}
+	var nilThrottle *throttle
+	nilThrottle.acquire(1)
+	nilThrottle.release(1)
+}
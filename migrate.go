@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// entry is a key read from the source in a type-aware form, so it can be
+// written to a target that does not understand the source's DUMP payload.
+type entry struct {
+	Key  string
+	Type string
+	// Value is a string, []string (list, set), map[string]string (hash),
+	// []redis.Z (zset) or []redis.XMessage (stream).
+	Value interface{}
+	// TTL is the remaining time to live, 0 when the key does not expire.
+	TTL time.Duration
+	// FieldTTL is the remaining time to live of the fields of a hash that
+	// expire.
+	FieldTTL map[string]time.Duration
+	// LastID is the last id of a stream and Groups the last delivered id of
+	// each of its consumer groups, when they are known.
+	LastID string
+	Groups map[string]string
+}
+
+// migrateKey copies key from source to target with DUMP/RESTORE, keeping its
+// ttl in milliseconds. When the target rejects the payload (e.g. it runs an
+// older redis version) the value is read and written again by type.
+func migrateKey(source, target redis.Cmdable, key string) error {
+	var (
+		dump *redis.StringCmd
+		pttl *redis.DurationCmd
+	)
+	_, err := source.Pipelined(func(pipe redis.Pipeliner) error {
+		dump = pipe.Dump(key)
+		pttl = pipe.PTTL(key)
+		return nil
+	})
+	if err == redis.Nil {
+		// the key expired or was deleted after it was scanned
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttl, ok := restoreTTL(pttl.Val())
+	if !ok {
+		return nil
+	}
+	err = target.RestoreReplace(key, ttl, dump.Val()).Err()
+	if err == nil || !isPayloadError(err) {
+		return err
+	}
+	e, err := readEntry(source, key)
+	if err != nil || e == nil {
+		return err
+	}
+	return writeEntry(target, e)
+}
+
+// restoreTTL converts a PTTL reply into a ttl usable by RESTORE and PEXPIRE.
+// It reports false when the key no longer exists.
+func restoreTTL(pttl time.Duration) (time.Duration, bool) {
+	switch {
+	case pttl == -2*time.Millisecond:
+		return 0, false
+	case pttl < 0:
+		return 0, true
+	case pttl == 0:
+		// less than a millisecond left, RESTORE treats 0 as persistent
+		return time.Millisecond, true
+	}
+	return pttl, true
+}
+
+// isPayloadError reports whether err is the target refusing a DUMP payload
+// produced by a different redis version, or RESTORE not being available.
+func isPayloadError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "payload version") ||
+		strings.Contains(msg, "Bad data format") ||
+		strings.HasPrefix(msg, "ERR unknown command")
+}
+
+// readEntry reads key from source by type. It returns nil when the key no
+// longer exists.
+func readEntry(source redis.Cmdable, key string) (*entry, error) {
+	typ, err := source.Type(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{Key: key, Type: typ}
+	switch typ {
+	case "none":
+		return nil, nil
+	case "string":
+		e.Value, err = source.Get(key).Result()
+	case "list":
+		e.Value, err = source.LRange(key, 0, -1).Result()
+	case "set":
+		e.Value, err = source.SMembers(key).Result()
+	case "hash":
+		e.Value, err = source.HGetAll(key).Result()
+	case "zset":
+		e.Value, err = source.ZRangeWithScores(key, 0, -1).Result()
+	case "stream":
+		// consumer groups are not part of the value and are not copied
+		e.Value, err = source.XRange(key, "-", "+").Result()
+	default:
+		return nil, fmt.Errorf("unsupported type %q", typ)
+	}
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pttl, err := source.PTTL(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	ttl, ok := restoreTTL(pttl)
+	if !ok {
+		return nil, nil
+	}
+	e.TTL = ttl
+	return e, nil
+}
+
+// writeEntry replaces e.Key on target with the value and ttl of e. All
+// writes for the key are sent in a single transaction.
+func writeEntry(target redis.Cmdable, e *entry) error {
+	_, err := target.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(e.Key)
+		switch v := e.Value.(type) {
+		case string:
+			pipe.Set(e.Key, v, 0)
+		case []string:
+			if len(v) == 0 {
+				return nil
+			}
+			members := make([]interface{}, len(v))
+			for i := range v {
+				members[i] = v[i]
+			}
+			if e.Type == "set" {
+				pipe.SAdd(e.Key, members...)
+			} else {
+				pipe.RPush(e.Key, members...)
+			}
+		case map[string]string:
+			if len(v) == 0 {
+				return nil
+			}
+			fields := make(map[string]interface{}, len(v))
+			for f, val := range v {
+				fields[f] = val
+			}
+			pipe.HMSet(e.Key, fields)
+			for f, ttl := range e.FieldTTL {
+				pipe.Do("hpexpire", e.Key, int64(ttl/time.Millisecond), "fields", 1, f)
+			}
+		case []redis.Z:
+			if len(v) == 0 {
+				return nil
+			}
+			pipe.ZAdd(e.Key, v...)
+		case []redis.XMessage:
+			for _, msg := range v {
+				pipe.XAdd(&redis.XAddArgs{
+					Stream: e.Key,
+					ID:     msg.ID,
+					Values: msg.Values,
+				})
+			}
+			for name, id := range e.Groups {
+				pipe.Do("xgroup", "create", e.Key, name, id, "mkstream")
+			}
+			if e.LastID != "" && (len(v) > 0 || len(e.Groups) > 0) {
+				pipe.Do("xsetid", e.Key, e.LastID)
+			}
+		default:
+			return fmt.Errorf("unsupported value %T for key %q", e.Value, e.Key)
+		}
+		if e.TTL > 0 {
+			pipe.PExpire(e.Key, e.TTL)
+		}
+		return nil
+	})
+	return err
+}
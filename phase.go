@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// phase is a step of the migration. The proxy moves through the phases in
+// order:
+//
+//	copying         the keys are copied
+//	syncing         the copy is done, waiting for the sync lag to drop
+//	verifying       the target is up to date and is compared with the source
+//	cutover         reads are served by the target, writes still go to both
+//	source-retired  the source no longer receives any command
+//
+// The first three phases advance on their own and keep the configured
+// routing policy. CUTOVER and ROLLBACK move between the last ones, and
+// CUTOVER refuses until a verification found no mismatch. The phase and
+// the routing policy to restore on rollback are saved in the state file,
+// so a resumed proxy continues from the same phase.
+type phase int
+
+const (
+	phaseCopying phase = iota
+	phaseSyncing
+	phaseVerifying
+	phaseCutover
+	phaseSourceRetired
+)
+
+var phaseNames = []string{"copying", "syncing", "verifying", "cutover", "source-retired"}
+
+func (ph phase) String() string { return phaseNames[ph] }
+
+// cutoverRoutes are the routing policies of the cutover phases.
+var cutoverRoutes = map[phase]route{
+	phaseCutover:       {read: readTarget, write: writeBoth, targetPrimary: true},
+	phaseSourceRetired: {read: readTarget, write: writeTarget},
+}
+
+// verifyInterval is the delay before a failed verification runs again.
+const verifyInterval = time.Minute
+
+var (
+	errCopyRunning   = errors.New("the copy is not finished")
+	errSourceGone    = errors.New("the source is retired and missed writes")
+	errVerifyRunning = errors.New("the verification is not finished")
+)
+
+// migration is the state machine that drives a migration.
+type migration struct {
+	proxy  *proxy
+	state  *migrateState
+	maxLag int64
+
+	mu    sync.Mutex
+	phase phase
+	// before is the routing policy to restore on rollback
+	before route
+
+	// verifying is set while a verification runs, and mismatches is the
+	// result of the last one, -1 until one finished
+	verifying  bool
+	mismatches int
+	verifiedAt time.Time
+}
+
+// newMigration returns the migration in the phase recorded in state, with
+// the routing policy of that phase.
+func newMigration(p *proxy, state *migrateState, maxLag int64) *migration {
+	m := &migration{proxy: p, state: state, maxLag: maxLag, mismatches: -1}
+	name, before := state.phase()
+	if name == "" {
+		return m
+	}
+	n, err := parseName(phaseNames, name)
+	if err != nil {
+		log.Println("migration phase:", name, err)
+		return m
+	}
+	m.phase = phase(n)
+	if m.before, err = parseRoute(p.route(), before); err != nil {
+		log.Println("migration route:", before, err)
+		m.before = p.route()
+	}
+	if r, ok := cutoverRoutes[m.phase]; ok {
+		p.setRoute(r)
+	}
+	log.Println("resume migration phase:", m.phase)
+	return m
+}
+
+// run advances the automatic phases until the target is ready for cutover.
+func (m *migration) run() {
+	for range time.Tick(time.Second) {
+		m.advance()
+	}
+}
+
+// advance moves to the next automatic phase when the current one is over,
+// or starts a verification.
+func (m *migration) advance() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch m.phase {
+	case phaseCopying:
+		if m.state.done() {
+			m.setPhase(phaseSyncing)
+		}
+	case phaseSyncing:
+		if lag, err := syncLag(); err == nil && lag <= m.maxLag {
+			m.setPhase(phaseVerifying)
+		}
+	case phaseVerifying:
+		if !m.verifying && m.mismatches != 0 && time.Since(m.verifiedAt) >= verifyInterval {
+			m.verifying = true
+			go m.verify()
+		}
+	}
+}
+
+// verify compares the keys of the source with the target. The target is
+// not scanned for extra keys, the writes to the target alone are expected
+// there. A verification with failed nodes is not complete and runs again.
+func (m *migration) verify() {
+	log.Println("migration verify")
+	// the proxy writes to the mapped db of the target, the verifier maps
+	// each db from db 0
+	target := targetTopo.client(0)
+	defer target.Close()
+	v := &verifier{
+		source:    m.proxy.source.client,
+		target:    target,
+		tolerance: 2 * time.Second,
+	}
+	v.run(false, time.Second)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.verifying = false
+	m.mismatches = len(v.mismatches)
+	m.verifiedAt = time.Now()
+	log.Println("migration verify: keys checked:", v.checked, "mismatches:", m.mismatches)
+	if len(v.failed) > 0 {
+		log.Println("migration verify: failed nodes:", v.failed)
+		m.mismatches = -1
+	}
+}
+
+// setPhase changes the phase and applies the routing policy of the cutover
+// phases. The caller must hold m.mu.
+func (m *migration) setPhase(ph phase) {
+	log.Println("migration phase:", m.phase, "->", ph)
+	if m.phase < phaseCutover && ph >= phaseCutover {
+		m.before = m.proxy.route()
+	}
+	m.phase = ph
+	if r, ok := cutoverRoutes[ph]; ok {
+		m.proxy.setRoute(r)
+	}
+	if err := m.state.setPhase(ph.String(), m.before.options()); err != nil {
+		log.Println("checkpoint:", err)
+	}
+}
+
+// cutover moves reads to the target, and on a second call retires the
+// source. It refuses while the copy runs, the sync lag is too high or the
+// target was not verified.
+func (m *migration) cutover() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch m.phase {
+	case phaseCutover:
+		m.setPhase(phaseSourceRetired)
+		return nil
+	case phaseSourceRetired:
+		return errors.New("the source is already retired")
+	}
+	if !m.state.done() {
+		return errCopyRunning
+	}
+	lag, err := syncLag()
+	if err != nil {
+		return err
+	}
+	if lag > m.maxLag {
+		return fmt.Errorf("sync lag of %d bytes is above %d", lag, m.maxLag)
+	}
+	switch {
+	case m.phase < phaseVerifying, m.mismatches < 0:
+		return errVerifyRunning
+	case m.mismatches > 0:
+		return fmt.Errorf("the verification found %d mismatches", m.mismatches)
+	}
+	m.setPhase(phaseCutover)
+	return nil
+}
+
+// rollback moves reads back to the source after a cutover.
+func (m *migration) rollback() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch m.phase {
+	case phaseCutover:
+		m.proxy.setRoute(m.before)
+		m.setPhase(phaseVerifying)
+		return nil
+	case phaseSourceRetired:
+		return errSourceGone
+	}
+	return errors.New("nothing to roll back in phase " + m.phase.String())
+}
+
+// status returns the migration progress as field/value pairs.
+func (m *migration) status() []string {
+	m.mu.Lock()
+	ph := m.phase
+	verify := "pending"
+	switch {
+	case m.verifying:
+		verify = "running"
+	case m.mismatches >= 0:
+		verify = strconv.Itoa(m.mismatches) + " mismatches"
+	}
+	m.mu.Unlock()
+	var keys, errs, skipped int64
+	var done, nodes int
+	m.state.mu.Lock()
+	for _, n := range m.state.Nodes {
+		keys += n.Keys
+		errs += n.Errors
+		skipped += n.Skipped
+		if n.Done {
+			done++
+		}
+		nodes++
+	}
+	m.state.mu.Unlock()
+	lag, err := syncLag()
+	lagStr := strconv.FormatInt(lag, 10)
+	if err != nil {
+		lagStr = err.Error()
+	}
+	r := m.proxy.route()
+	return []string{
+		"phase", ph.String(),
+		"nodes", strconv.Itoa(nodes),
+		"nodes_done", strconv.Itoa(done),
+		"keys", strconv.FormatInt(keys, 10),
+		"errors", strconv.FormatInt(errs, 10),
+		"skipped", strconv.FormatInt(skipped, 10),
+		"sync_lag", lagStr,
+		"verify", verify,
+		"read", r.read.String(),
+		"write", r.write.String(),
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestMigrationPhases(t *testing.T) {
+	state := newState(tempState(t))
+	state.register("a")
+	state.register("b")
+	before := route{read: readSource, write: writeBoth}
+	p := &proxy{policy: before}
+	m := newMigration(p, state, 0)
+
+	state.checkpoint(nodeState{Addr: "a", Done: true})
+	m.advance()
+	if m.phase != phaseCopying {
+		t.Fatalf("expected %s while b copies, got %s", phaseCopying, m.phase)
+	}
+	if err := m.cutover(); err != errCopyRunning {
+		t.Fatalf("expected %v, got %v", errCopyRunning, err)
+	}
+
+	state.checkpoint(nodeState{Addr: "b", Done: true})
+	m.advance()
+	if m.phase != phaseSyncing {
+		t.Fatalf("expected %s, got %s", phaseSyncing, m.phase)
+	}
+	if err := m.cutover(); err != errVerifyRunning {
+		t.Fatalf("expected %v, got %v", errVerifyRunning, err)
+	}
+	m.advance()
+	if m.phase != phaseVerifying {
+		t.Fatalf("expected %s, got %s", phaseVerifying, m.phase)
+	}
+	if err := m.cutover(); err != errVerifyRunning {
+		t.Fatalf("expected %v before a verification, got %v", errVerifyRunning, err)
+	}
+	m.mismatches = 2
+	if err := m.cutover(); err == nil {
+		t.Fatal("expected an error with mismatches")
+	}
+	if err := m.rollback(); err == nil {
+		t.Fatal("expected an error rolling back before a cutover")
+	}
+
+	m.mismatches = 0
+	if err := m.cutover(); err != nil {
+		t.Fatal(err)
+	}
+	if m.phase != phaseCutover || p.route() != cutoverRoutes[phaseCutover] {
+		t.Fatalf("expected %s with its route, got %s %+v", phaseCutover, m.phase, p.route())
+	}
+	if err := m.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if m.phase != phaseVerifying || p.route() != before {
+		t.Fatalf("expected %s with %+v, got %s %+v", phaseVerifying, before, m.phase, p.route())
+	}
+
+	if err := m.cutover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.cutover(); err != nil {
+		t.Fatal(err)
+	}
+	if m.phase != phaseSourceRetired || p.route() != cutoverRoutes[phaseSourceRetired] {
+		t.Fatalf("expected %s with its route, got %s %+v", phaseSourceRetired, m.phase, p.route())
+	}
+	if err := m.rollback(); err != errSourceGone {
+		t.Fatalf("expected %v, got %v", errSourceGone, err)
+	}
+	if err := m.cutover(); err == nil {
+		t.Fatal("expected an error once the source is retired")
+	}
+}
+
+func TestMigrationResume(t *testing.T) {
+	path := tempState(t)
+	state := newState(path)
+	state.setPhase(phaseCutover.String(), route{read: readSource, write: writeBoth}.options())
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{}
+	m := newMigration(p, state, 0)
+	if m.phase != phaseCutover || p.route() != cutoverRoutes[phaseCutover] {
+		t.Fatalf("expected %s with its route, got %s %+v", phaseCutover, m.phase, p.route())
+	}
+	if m.before != (route{read: readSource, write: writeBoth}) {
+		t.Fatalf("expected the route before the cutover, got %+v", m.before)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"redisp/redcon"
+)
+
+// pipelined is a command of a client pipeline sent in a batch.
+type pipelined struct {
+	u     *upstream
+	bc    *backendCmd
+	write bool
+	reply []byte
+}
+
+// pipeline runs cmd and the commands the client pipelined after it. The
+// commands served by a single backend node are sent in batches, one per
+// node and all at once, and the other commands run in between like they
+// would alone. The replies are written in the order of the commands. It
+// reports false, leaving the pipeline to the server, when a command may
+// detach the client.
+func (p *proxy) pipeline(conn redcon.Conn, cmd redcon.Command) bool {
+	if mayDetach(cmd) {
+		return false
+	}
+	for _, c := range conn.PeekPipeline() {
+		if mayDetach(c) {
+			return false
+		}
+	}
+	cmds := append([]redcon.Command{cmd}, conn.ReadPipeline()...)
+	var batch []*pipelined
+	for _, c := range cmds {
+		if pc := p.batchable(conn, c); pc != nil {
+			batch = append(batch, pc)
+			continue
+		}
+		p.sendBatch(conn, batch)
+		batch = batch[:0]
+		p.handler(conn, c)
+	}
+	p.sendBatch(conn, batch)
+	return true
+}
+
+// mayDetach reports whether cmd may detach the client from the server.
+func mayDetach(cmd redcon.Command) bool {
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "subscribe", "psubscribe", "ssubscribe", "detach":
+		return true
+	}
+	info, _ := lookupCommand(cmd)
+	if info == nil || info.timeout == nil {
+		return false
+	}
+	_, blocks := info.timeout(cmd.Args)
+	return blocks
+}
+
+// batchable returns cmd as a pipelined command when it is served by a
+// single backend node, or nil when it must run alone: a command queued in a
+// transaction, a write to both clusters, a read falling back to the source,
+// a script, a command split by slot or a command the proxy serves itself.
+func (p *proxy) batchable(conn redcon.Conn, cmd redcon.Command) *pipelined {
+	if s, _ := conn.Context().(*session); s != nil && s.tx != nil && s.tx.multi {
+		return nil
+	}
+	info, _ := lookupCommand(cmd)
+	if info == nil || info.flags&cmdScript != 0 || info.timeout != nil {
+		return nil
+	}
+	src, tgt, errMsg := backendCmds(info, cmd, conn.Protocol())
+	if errMsg != "" {
+		return nil
+	}
+	r := p.route()
+	pc := &pipelined{write: info.flags&cmdWrite != 0}
+	if pc.write {
+		primary, secondary, err := p.writers(r, tgt == nil)
+		if err != nil || secondary != nil {
+			return nil
+		}
+		pc.u = primary
+	} else {
+		switch {
+		case r.read == readSource || tgt == nil:
+			pc.u = p.source
+		case r.read == readTarget:
+			pc.u = p.target
+		default:
+			return nil
+		}
+	}
+	pc.bc = src
+	if pc.u == p.target {
+		pc.bc = tgt
+	}
+	return pc
+}
+
+// sendBatch sends the batch, one pipeline per node with the nodes in
+// parallel, and writes the replies. The commands redirected or refused for
+// a moment by a node are sent again alone, in order.
+func (p *proxy) sendBatch(conn redcon.Conn, batch []*pipelined) {
+	if len(batch) == 0 {
+		return
+	}
+	nodes := make(map[*pool][]*pipelined)
+	var order []*pool
+	for _, pc := range batch {
+		pl, err := pc.u.pool(pc.bc.slot)
+		if err != nil {
+			pc.reply = redcon.AppendError(nil, "ERR "+err.Error())
+			continue
+		}
+		if nodes[pl] == nil {
+			order = append(order, pl)
+		}
+		nodes[pl] = append(nodes[pl], pc)
+	}
+	var wg sync.WaitGroup
+	for _, pl := range order {
+		wg.Add(1)
+		go func(pl *pool, cmds []*pipelined) {
+			defer wg.Done()
+			sendNode(pl, conn.Protocol(), cmds)
+		}(pl, nodes[pl])
+	}
+	wg.Wait()
+	for _, pc := range batch {
+		conn.WriteRaw(pc.reply)
+	}
+}
+
+// sendNode sends the commands to the node of pl in a single pipeline, on a
+// connection speaking proto.
+func sendNode(pl *pool, proto int, cmds []*pipelined) {
+	var raw []byte
+	for _, pc := range cmds {
+		raw = append(raw, pc.bc.raw...)
+	}
+	c, err := pl.get(proto)
+	if err == nil {
+		err = c.pipeline(raw, len(cmds), func(i int, reply []byte) {
+			cmds[i].reply = append([]byte(nil), reply...)
+		})
+		pl.put(c, err)
+	}
+	for _, pc := range cmds {
+		switch {
+		case pc.reply == nil:
+			// the command may have run, it is not sent again
+			pc.reply = redcon.AppendError(nil, "ERR "+err.Error())
+		case isRedirect(pc.reply):
+			pc.reply = pc.reply[:0]
+			if err := pc.u.do(pc.bc.slot, proto, pc.bc.raw, func(b []byte) {
+				pc.reply = append(pc.reply, b...)
+			}); err != nil {
+				pc.reply = redcon.AppendError(pc.reply[:0], "ERR "+err.Error())
+			}
+		}
+	}
+}
+
+// isRedirect reports whether reply is a MOVED, ASK, TRYAGAIN or CLUSTERDOWN
+// error, which upstream.do handles.
+func isRedirect(reply []byte) bool {
+	kind, _, _ := parseRedirect(reply)
+	return kind != ""
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"redisp/redcon"
+)
+
+func TestMayDetach(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		detach bool
+	}{
+		{"get k", false},
+		{"SUBSCRIBE ch", true},
+		{"psubscribe ch*", true},
+		{"ssubscribe ch", true},
+		{"blpop k 0", true},
+		{"blpop k 1", true},
+		{"xread count 1 streams s 0", false},
+		{"xread block 100 streams s 0", true},
+		{"nosuchcommand", false},
+	}
+	for _, tt := range tests {
+		if detach := mayDetach(redcon.Command{Args: parseArgs(tt.cmd)}); detach != tt.detach {
+			t.Errorf("%q: expected %v, got %v", tt.cmd, tt.detach, detach)
+		}
+	}
+}
+
+func TestBatchable(t *testing.T) {
+	p := &proxy{source: &upstream{name: "source"}, target: &upstream{name: "target"}}
+	tests := []struct {
+		route route
+		cmd   string
+		multi bool
+		node  string // the upstream of the batched command, empty when alone
+		raw   string
+	}{
+		{route{write: writeSource}, "set k v", false, "source", "set k v"},
+		{route{write: writeTarget}, "set k v", false, "target", "set t:k v"},
+		{route{write: writeBoth}, "set k v", false, "", ""},
+		{route{write: writeSource}, "set k v", true, "", ""},
+		{route{read: readSource}, "get k", false, "source", "get k"},
+		{route{read: readTarget}, "get k", false, "target", "get t:k"},
+		{route{read: readTargetFallbackSource}, "get k", false, "", ""},
+		{route{read: readTarget}, "mget {a}1 {a}2", false, "target", "mget t:{a}1 t:{a}2"},
+		{route{read: readTarget}, "mget a b", false, "", ""},
+		// a key that is not migrated is read from the source, and written
+		// only when the source is written
+		{route{read: readTarget}, "get tmp:1", false, "source", "get tmp:1"},
+		{route{write: writeTarget}, "set tmp:1 v", false, "", ""},
+		{route{write: writeSource}, "eval s 0", false, "", ""},
+		{route{write: writeSource}, "blpop k 0", false, "", ""},
+		{route{write: writeSource}, "nosuchcommand k", false, "", ""},
+	}
+	saved := keyRules
+	defer func() { keyRules = saved }()
+	keyRules = parseRules(t, "-add-prefix", "t:", "-exclude", "tmp:*")
+	for _, tt := range tests {
+		p.policy = tt.route
+		conn := newTestConn("127.0.0.1:6380")
+		if tt.multi {
+			sessionOf(conn).tx = &transaction{multi: true}
+		}
+		pc := p.batchable(conn, parseCommand(tt.cmd))
+		switch {
+		case pc == nil && tt.node == "":
+		case pc == nil || tt.node == "":
+			t.Errorf("%+v %q: expected %q, got %+v", tt.route, tt.cmd, tt.node, pc)
+		case pc.u.name != tt.node || string(pc.bc.raw) != string(parseCommand(tt.raw).Raw):
+			t.Errorf("%+v %q: expected %s %q, got %s %q", tt.route, tt.cmd, tt.node, tt.raw, pc.u.name, pc.bc.raw)
+		}
+	}
+}
+
+// echoNode serves every command with a bulk reply of name and the command,
+// or with a MOVED redirect to moved for the key "moved".
+func echoNode(t *testing.T, name, moved string) string {
+	return fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) > 1 && string(cmd.Args[1]) == "moved" && moved != "" {
+			conn.WriteError("MOVED " + strconv.Itoa(keySlot(cmd.Args[1])) + " " + moved)
+			return
+		}
+		conn.WriteBulkString(name + ": " + strings.Join(argStrings(cmd.Args), " "))
+	})
+}
+
+func argStrings(args [][]byte) []string {
+	var strs []string
+	for _, arg := range args {
+		strs = append(strs, string(arg))
+	}
+	return strs
+}
+
+func TestSendBatch(t *testing.T) {
+	target := echoNode(t, "target", "")
+	source := echoNode(t, "source", target)
+	standalone := func(addr string) *topology {
+		return &topology{mode: modeStandalone, addrs: []string{addr}}
+	}
+	p := &proxy{
+		source: newUpstream("source", standalone(source), nil, 0),
+		target: newUpstream("target", standalone(target), nil, 0),
+	}
+	cmds := []struct {
+		u   *upstream
+		cmd string
+		exp string
+	}{
+		{p.source, "get a", "source: get a"},
+		{p.target, "get b", "target: get b"},
+		{p.source, "get moved", "target: get moved"},
+		{p.source, "set c 1", "source: set c 1"},
+		{p.target, "set d 2", "target: set d 2"},
+	}
+	var batch []*pipelined
+	var exp []byte
+	for _, c := range cmds {
+		cmd := parseCommand(c.cmd)
+		batch = append(batch, &pipelined{u: c.u, bc: &backendCmd{raw: cmd.Raw, slot: keySlot(cmd.Args[1])}})
+		exp = redcon.AppendBulkString(exp, c.exp)
+	}
+	conn := newTestConn("127.0.0.1:6380")
+	p.sendBatch(conn, batch)
+	if reply := string(conn.wr.Buffer()); reply != string(exp) {
+		t.Fatalf("expected %q, got %q", exp, reply)
+	}
+}
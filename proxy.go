@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+
+	"redisp/redcon"
+
+	"github.com/go-redis/redis"
+)
+
+// proxy forwards client commands to the source and target clusters
+// according to its routing policy.
+type proxy struct {
+	source *upstream
+	target *upstream
+
+	mu     sync.RWMutex
+	policy route
+	// synced is set when the live sync applies the writes of the source to
+	// the target, so writing both only writes the source
+	synced bool
+
+	migration *migration
+	scripts   *scriptCache
+
+	subsMu sync.Mutex
+	subs   map[*subscriber]bool
+	// handler is the command handler of the server, which also serves the
+	// detached clients once they leave subscribed mode
+	handler func(conn redcon.Conn, cmd redcon.Command)
+}
+
+// newProxy returns a proxy serving db 0 of the source. Its keys are read
+// and written on the db of the target that -db-map maps db 0 to.
+func newProxy(sourceClient, targetClient redis.UniversalClient, policy route) *proxy {
+	db, _ := keyRules.targetDB(0)
+	if c, err := targetTopo.selectDB(targetClient, db); err != nil {
+		log.Println("target:", err)
+		db = 0
+	} else {
+		targetClient = c
+	}
+	return &proxy{
+		source:  newUpstream("source", sourceTopo, sourceClient, 0),
+		target:  newUpstream("target", targetTopo, targetClient, db),
+		policy:  policy,
+		scripts: newScriptCache(),
+		subs:    make(map[*subscriber]bool),
+	}
+}
+
+// backendCmd is a raw command and its slot on a backend, sent on a
+// connection speaking proto, the RESP version of the client.
+type backendCmd struct {
+	raw   []byte
+	slot  int
+	proto int
+	// script is set for EVAL, EVALSHA and FCALL, which are sent again once
+	// the cached scripts are loaded when the node does not know them
+	script bool
+}
+
+// forward sends cmd to the node serving its slot and writes the reply of
+// the node back to the client unchanged. The keys of the commands sent to
+// the target are renamed by the migration rules, and commands on keys that
+// are not migrated are only sent to the source.
+func (p *proxy) forward(conn redcon.Conn, cmd redcon.Command) {
+	info, errMsg := lookupCommand(cmd)
+	if info == nil {
+		conn.WriteError(errMsg)
+		return
+	}
+	if info.merge != mergeNone && p.split(conn, cmd, info) {
+		return
+	}
+	if info.flags&cmdScript != 0 {
+		p.cacheScript(cmd)
+	}
+	src, tgt, errMsg := backendCmds(info, cmd, conn.Protocol())
+	if errMsg != "" {
+		conn.WriteError(errMsg)
+		return
+	}
+	r := p.route()
+	if info.timeout != nil {
+		if timeout, ok := info.timeout(cmd.Args); ok {
+			p.block(conn, cmd, info, src, tgt, r, timeout)
+			return
+		}
+	}
+	if info.flags&cmdWrite != 0 {
+		p.write(conn, cmd, src, tgt, r)
+	} else {
+		p.read(conn, cmd, info, src, tgt, r)
+	}
+}
+
+// backendCmds returns the command for the source and for the target, which
+// is nil when the keys are not migrated, or an error reply. proto is the
+// RESP version of the client.
+func backendCmds(info *commandInfo, cmd redcon.Command, proto int) (src, tgt *backendCmd, errMsg string) {
+	slot, errMsg := commandSlot(info, cmd)
+	if errMsg != "" {
+		return nil, nil, errMsg
+	}
+	script := info.flags&cmdScript != 0
+	src = &backendCmd{raw: cmd.Raw, slot: slot, proto: proto, script: script}
+	raw, tslot, err := keyRules.rewriteCommand(info, cmd, slot)
+	switch err {
+	case nil:
+		tgt = &backendCmd{raw: raw, slot: tslot, proto: proto, script: script}
+	case errExcluded:
+	default:
+		return nil, nil, err.Error()
+	}
+	return src, tgt, ""
+}
+
+// read serves a read from the cluster selected by the route. tgt is nil
+// when the keys are not migrated, then the source serves the read.
+func (p *proxy) read(conn redcon.Conn, cmd redcon.Command, info *commandInfo, src, tgt *backendCmd, r route) {
+	switch {
+	case r.read == readSource || tgt == nil:
+		p.reply(conn, p.source, src)
+	case r.read == readTarget:
+		p.reply(conn, p.target, tgt)
+	case r.read == readTargetFallbackSource:
+		var reply []byte
+		err := p.do(p.target, tgt, func(b []byte) {
+			reply = append(reply, b...)
+		})
+		if err == nil && (!isEmptyReply(reply) || p.onTarget(info, tgt)) {
+			conn.WriteRaw(reply)
+			return
+		}
+		reply = reply[:0]
+		err = p.do(p.source, src, func(b []byte) {
+			reply = append(reply, b...)
+		})
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteRaw(reply)
+		if keys := commandKeys(info, cmd.Args); len(keys) == 1 &&
+			reply[0] != '-' && !isNullReply(reply) {
+			key := string(keys[0])
+			go func() {
+				// copy the key, so the next read is served by the target,
+				// unless a write created it on the target meanwhile
+				copyKeys(p.source.client, p.target.client, []string{key}, false)
+			}()
+		}
+	}
+}
+
+// write sends a write to the clusters selected by the route. tgt is nil
+// when the keys are not migrated, then only the source is written.
+func (p *proxy) write(conn redcon.Conn, cmd redcon.Command, src, tgt *backendCmd, r route) {
+	primary, secondary, err := p.writers(r, tgt == nil)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if src.script && r.scriptsPrimary {
+		// scripts may not be deterministic, they only run on the primary
+		secondary = nil
+	}
+	backend := func(u *upstream) *backendCmd {
+		if u == p.target {
+			return tgt
+		}
+		return src
+	}
+	if secondary == nil {
+		p.reply(conn, primary, backend(primary))
+		return
+	}
+	var reply []byte
+	bc := backend(primary)
+	err = p.do(primary, bc, func(b []byte) {
+		reply = append(reply, b...)
+	})
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	if reply[0] == '-' {
+		conn.WriteRaw(reply)
+		return
+	}
+	var replyErr error
+	bc = backend(secondary)
+	err = p.do(secondary, bc, func(b []byte) {
+		if b[0] == '-' {
+			replyErr = errors.New(string(b[1 : len(b)-2]))
+		}
+	})
+	if err == nil {
+		err = replyErr
+	}
+	if err != nil {
+		log.Printf("%s %s: %v", secondary.name, cmd.Args[0], err)
+		if r.strict {
+			conn.WriteError("ERR " + secondary.name + " write failed: " + err.Error())
+			return
+		}
+	}
+	conn.WriteRaw(reply)
+}
+
+// writers returns the primary and secondary clusters of a write under r.
+// When the keys are not migrated only the source is written, and
+// errExcluded is returned when r does not write to the source.
+func (p *proxy) writers(r route, excluded bool) (primary, secondary *upstream, err error) {
+	switch r.write {
+	case writeSource:
+		primary = p.source
+	case writeTarget:
+		primary = p.target
+	case writeBoth:
+		primary, secondary = p.source, p.target
+		if r.targetPrimary {
+			primary, secondary = p.target, p.source
+		}
+		if p.synced {
+			primary, secondary = p.source, nil
+		}
+	}
+	if excluded {
+		if primary != p.source && secondary != p.source {
+			return nil, nil, errExcluded
+		}
+		primary, secondary = p.source, nil
+	}
+	return primary, secondary, nil
+}
+
+// reply sends the command to u and writes the reply to the client.
+func (p *proxy) reply(conn redcon.Conn, u *upstream, bc *backendCmd) {
+	if err := p.do(u, bc, conn.WriteRaw); err != nil {
+		conn.WriteError("ERR " + err.Error())
+	}
+}
+
+// onTarget reports whether the keys of the command sent to the target all
+// exist there, so an empty reply of the target is the right one.
+func (p *proxy) onTarget(info *commandInfo, tgt *backendCmd) bool {
+	cmd, err := redcon.Parse(tgt.raw)
+	if err != nil {
+		return false
+	}
+	keys := commandKeys(info, cmd.Args)
+	if len(keys) == 0 {
+		// a keyless command is served by the target
+		return true
+	}
+	n := -1
+	raw := appendArgs(nil, append([][]byte{[]byte("exists")}, keys...)...)
+	p.target.do(tgt.slot, tgt.proto, raw, func(b []byte) {
+		_, resp := redcon.ReadNextRESP(b)
+		if resp.Type == redcon.Integer {
+			n, _ = strconv.Atoi(string(resp.Data))
+		}
+	})
+	return n == len(keys)
+}
+
+// isEmptyReply reports whether reply may be how a command tells that its
+// keys are missing: a null, an empty string or collection, a zero count,
+// the -2 of TTL and PTTL, or the none of TYPE.
+func isEmptyReply(reply []byte) bool {
+	switch string(reply) {
+	case "$0\r\n\r\n", "*0\r\n", "%0\r\n", "~0\r\n", ":0\r\n", ":-2\r\n", "+none\r\n":
+		return true
+	}
+	return isNullReply(reply)
+}
+
+// isNullReply reports whether reply is a null bulk string or array.
+func isNullReply(reply []byte) bool {
+	s := string(reply)
+	return s == "$-1\r\n" || s == "*-1\r\n" || s == "_\r\n"
+}
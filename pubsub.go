@@ -0,0 +1,622 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"redisp/redcon"
+)
+
+// subscriber is a client in subscribed mode. The client is detached from
+// the server and its subscriptions are held by backend connections of the
+// primary of the write route, where the proxy publishes: one connection
+// for the channels and patterns, and one per node for the shard channels.
+// The subscriptions are confirmed from the replies of the backends, with
+// the counts of the proxy, which spans several backend connections. When
+// the primary of the write route changes the subscriptions move to it.
+type subscriber struct {
+	p    *proxy
+	conn redcon.DetachedConn
+
+	// mu guards the writes to conn and the fields below
+	mu       sync.Mutex
+	u        *upstream
+	channels map[string]bool
+	patterns map[string]bool
+	shards   map[string]string // shard channel -> node address
+	classic  *backendConn
+	nodes    map[string]*backendConn
+	// pending are the subscriptions sent to each backend connection and
+	// not confirmed yet, in order
+	pending map[*backendConn][]*pendingSub
+	// running is set while a command runs through the proxy handler, the
+	// replies of the backends are held until it returns
+	running bool
+	held    [][]byte
+	closed  bool
+	// nested is set when the client was detached by a blocking command
+	nested bool
+}
+
+// pendingSub is a subscription command waiting for the confirmations of
+// its channels.
+type pendingSub struct {
+	name string
+	args []string
+	left int
+	// silent is set for a subscription moved to another backend, which the
+	// client already had confirmed
+	silent bool
+}
+
+// subscribe detaches the client and serves it in subscribed mode, starting
+// with cmd.
+func (p *proxy) subscribe(conn redcon.Conn, cmd redcon.Command) {
+	primary, _, err := p.writers(p.route(), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	_, nested := conn.(*detached)
+	s := &subscriber{
+		p:        p,
+		u:        primary,
+		conn:     detach(conn),
+		nested:   nested,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		shards:   make(map[string]string),
+		nodes:    make(map[string]*backendConn),
+		pending:  make(map[*backendConn][]*pendingSub),
+	}
+	p.subsMu.Lock()
+	p.subs[s] = true
+	p.subsMu.Unlock()
+	if nested {
+		s.serve(cmd)
+		return
+	}
+	go s.serve(cmd)
+}
+
+// moveSubscribers moves the subscriptions of the subscribed clients to the
+// primary of the write route, where the proxy publishes.
+func (p *proxy) moveSubscribers() {
+	primary, _, err := p.writers(p.route(), false)
+	if err != nil {
+		return
+	}
+	p.subsMu.Lock()
+	subs := make([]*subscriber, 0, len(p.subs))
+	for s := range p.subs {
+		subs = append(subs, s)
+	}
+	p.subsMu.Unlock()
+	for _, s := range subs {
+		s.move(primary)
+	}
+}
+
+// serve runs the commands of the client until it quits or disconnects, or
+// until it has no subscription left: the client is then reattached to the
+// server, unless it was detached by a blocking command, which returns it.
+func (s *subscriber) serve(cmd redcon.Command) {
+	for {
+		s.mu.Lock()
+		quit := s.handle(cmd)
+		err := s.conn.Flush()
+		s.mu.Unlock()
+		if quit || err != nil {
+			s.close()
+			return
+		}
+		if s.leave() {
+			s.reattach()
+			return
+		}
+		if cmd, err = s.conn.ReadCommand(); err != nil {
+			s.close()
+			return
+		}
+		// the last subscriptions may have been dropped since
+		if s.leave() {
+			s.reattach(cmd)
+			return
+		}
+	}
+}
+
+// leave stops serving the client once it has no subscription left and
+// reports whether it did. A client detached by a blocking command stays.
+func (s *subscriber) leave() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nested || s.subscribed() {
+		return false
+	}
+	s.p.subsMu.Lock()
+	delete(s.p.subs, s)
+	s.p.subsMu.Unlock()
+	s.closed = true
+	s.closeConns()
+	return true
+}
+
+// reattach hands the client that left subscribed mode back to the server,
+// which runs next first.
+func (s *subscriber) reattach(next ...redcon.Command) {
+	s.conn.(*detached).reattach(next...)
+}
+
+// count returns the number of subscriptions of the client.
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns) + len(s.shards)
+}
+
+// subscribed reports whether the client is in subscribed mode, with
+// subscriptions or subscriptions not confirmed yet.
+func (s *subscriber) subscribed() bool {
+	return s.count() > 0 || len(s.pending) > 0
+}
+
+// handle runs a command of the client. The caller must hold s.mu.
+func (s *subscriber) handle(cmd redcon.Command) (quit bool) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	args := make([]string, len(cmd.Args)-1)
+	for i, arg := range cmd.Args[1:] {
+		args[i] = string(arg)
+	}
+	if s.p.queue(s.conn, cmd) {
+		return false
+	}
+	var err error
+	switch name {
+	case "subscribe", "psubscribe", "ssubscribe":
+		if len(args) == 0 {
+			s.conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return false
+		}
+		err = s.subscribe(name, args)
+	case "unsubscribe", "punsubscribe", "sunsubscribe":
+		err = s.unsubscribe(name, args)
+	case "ping":
+		if !s.subscribed() {
+			s.run(cmd)
+			return false
+		}
+		if len(args) > 1 {
+			s.conn.WriteError("ERR wrong number of arguments for 'ping' command")
+			return false
+		}
+		msg := ""
+		if len(args) == 1 {
+			msg = args[0]
+		}
+		s.conn.WriteArray(2)
+		s.conn.WriteBulkString("pong")
+		s.conn.WriteBulkString(msg)
+	case "reset":
+		s.unsubscribeAll()
+		resetSession(s.conn)
+	case "quit":
+		s.conn.WriteString("OK")
+		return true
+	default:
+		if s.subscribed() {
+			s.conn.WriteError("ERR Can't execute '" + name + "': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context")
+			return false
+		}
+		s.run(cmd)
+	}
+	if err != nil {
+		msg := err.Error()
+		if !strings.HasPrefix(msg, "CROSSSLOT") {
+			msg = "ERR " + msg
+		}
+		s.conn.WriteError(msg)
+	}
+	return false
+}
+
+// run runs a command of the client through the proxy handler. s.mu is
+// released meanwhile, so the replies of the backends are still read while
+// the command runs, which may block, and they are written after its reply.
+// The caller must hold s.mu.
+func (s *subscriber) run(cmd redcon.Command) {
+	s.running = true
+	s.mu.Unlock()
+	s.p.handler(s.conn, cmd)
+	s.mu.Lock()
+	s.running = false
+	for _, b := range s.held {
+		s.conn.WriteRaw(b)
+	}
+	s.held = nil
+}
+
+// write writes b to the client, or holds it while a command runs. The
+// caller must hold s.mu.
+func (s *subscriber) write(b []byte) {
+	if s.running {
+		s.held = append(s.held, append([]byte(nil), b...))
+		return
+	}
+	s.conn.WriteRaw(b)
+	s.conn.Flush()
+}
+
+// subscribe sends the subscription to the channels, patterns or shard
+// channels. They are confirmed once the backend replies.
+func (s *subscriber) subscribe(name string, args []string) error {
+	var c *backendConn
+	var err error
+	if name == "ssubscribe" {
+		slot := -1
+		for _, ch := range args {
+			sl := keySlot([]byte(ch))
+			if slot != -1 && sl != slot {
+				return errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+			}
+			slot = sl
+		}
+		c, err = s.nodeConn(slot)
+	} else {
+		c, err = s.classicConn()
+	}
+	if err != nil {
+		return err
+	}
+	return s.send(c, &pendingSub{name: name, args: args, left: len(args)})
+}
+
+// unsubscribe sends the unsubscription from the channels, patterns or
+// shard channels, or from all of them when args is empty. Those the client
+// has no backend connection for are confirmed right away.
+func (s *subscriber) unsubscribe(name string, args []string) error {
+	if name != "sunsubscribe" {
+		if s.classic == nil {
+			s.confirmLocal(name, args)
+			return nil
+		}
+		return s.send(s.classic, &pendingSub{name: name, args: args})
+	}
+	if len(args) == 0 {
+		for ch := range s.shards {
+			args = append(args, ch)
+		}
+		if len(args) == 0 {
+			s.confirmLocal(name, nil)
+			return nil
+		}
+	}
+	nodes := make(map[*backendConn][]string)
+	var local []string
+	for _, ch := range args {
+		if c := s.nodes[s.shards[ch]]; c != nil {
+			nodes[c] = append(nodes[c], ch)
+		} else {
+			local = append(local, ch)
+		}
+	}
+	for c, chs := range nodes {
+		if err := s.send(c, &pendingSub{name: name, args: chs}); err != nil {
+			return err
+		}
+	}
+	if len(local) > 0 {
+		s.confirmLocal(name, local)
+	}
+	return nil
+}
+
+// confirmLocal confirms the unsubscription from channels the client has no
+// subscription to.
+func (s *subscriber) confirmLocal(name string, args []string) {
+	if len(args) == 0 {
+		s.conn.WritePush(3)
+		s.conn.WriteBulkString(name)
+		s.conn.WriteNull()
+		s.conn.WriteInt(s.subCount(name))
+		return
+	}
+	for _, ch := range args {
+		s.conn.WritePush(3)
+		s.conn.WriteBulkString(name)
+		s.conn.WriteBulkString(ch)
+		s.conn.WriteInt(s.subCount(name))
+	}
+}
+
+// classicConn returns the connection of the channels and patterns, which
+// it dials on the first subscription.
+func (s *subscriber) classicConn() (*backendConn, error) {
+	if s.classic == nil {
+		pl, err := s.u.pool(-1)
+		if err != nil {
+			return nil, err
+		}
+		if s.classic, err = s.dial(pl.addr); err != nil {
+			return nil, err
+		}
+	}
+	return s.classic, nil
+}
+
+// nodeConn returns the connection of the shard channels of slot.
+func (s *subscriber) nodeConn(slot int) (*backendConn, error) {
+	pl, err := s.u.pool(slot)
+	if err != nil {
+		return nil, err
+	}
+	c := s.nodes[pl.addr]
+	if c == nil {
+		if c, err = s.dial(pl.addr); err != nil {
+			return nil, err
+		}
+		s.nodes[pl.addr] = c
+	}
+	return c, nil
+}
+
+// unsubscribeAll drops every subscription, like RESET.
+func (s *subscriber) unsubscribeAll() {
+	s.closeConns()
+	s.channels = make(map[string]bool)
+	s.patterns = make(map[string]bool)
+	s.shards = make(map[string]string)
+}
+
+// closeConns closes the backend connections, whose replies are then no
+// longer passed on.
+func (s *subscriber) closeConns() {
+	for _, c := range s.nodes {
+		c.conn.Close()
+	}
+	if s.classic != nil {
+		s.classic.conn.Close()
+	}
+	s.classic = nil
+	s.nodes = make(map[string]*backendConn)
+	s.pending = make(map[*backendConn][]*pendingSub)
+}
+
+// move moves the subscriptions to u. The subscriptions already confirmed
+// are sent again silently, the others are sent again as they were. The
+// client is disconnected when they cannot be moved.
+func (s *subscriber) move(u *upstream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.u == u {
+		return
+	}
+	log.Println("move subscriptions from", s.u.name, "to", u.name)
+	var subs []*pendingSub
+	for _, pending := range s.pending {
+		for _, ps := range pending {
+			if ps.left > 0 {
+				ps.args = ps.args[len(ps.args)-ps.left:]
+			}
+			subs = append(subs, ps)
+		}
+	}
+	s.closeConns()
+	s.u = u
+	for _, kind := range []struct {
+		name string
+		subs map[string]bool
+	}{{"subscribe", s.channels}, {"psubscribe", s.patterns}} {
+		if len(kind.subs) == 0 {
+			continue
+		}
+		var args []string
+		for ch := range kind.subs {
+			args = append(args, ch)
+		}
+		subs = append(subs, &pendingSub{name: kind.name, args: args, left: len(args), silent: true})
+	}
+	for ch := range s.shards {
+		subs = append(subs, &pendingSub{name: "ssubscribe", args: []string{ch}, left: 1, silent: true})
+	}
+	for _, ps := range subs {
+		var c *backendConn
+		var err error
+		if ps.name == "ssubscribe" {
+			c, err = s.nodeConn(keySlot([]byte(ps.args[0])))
+			if err == nil {
+				for _, ch := range ps.args {
+					if _, ok := s.shards[ch]; ok {
+						s.shards[ch] = c.addr
+					}
+				}
+			}
+		} else {
+			c, err = s.classicConn()
+		}
+		if err == nil {
+			err = s.send(c, ps)
+		}
+		if err != nil {
+			log.Println("move subscriptions to", u.name, err)
+			// unblocks serve, which closes the client
+			s.conn.NetConn().Close()
+			return
+		}
+	}
+}
+
+// subCount returns the count reported in the confirmations of name.
+func (s *subscriber) subCount(name string) int {
+	if name == "ssubscribe" || name == "sunsubscribe" {
+		return len(s.shards)
+	}
+	return len(s.channels) + len(s.patterns)
+}
+
+// dial opens a subscription connection to a backend node and starts
+// passing its messages to the client.
+func (s *subscriber) dial(addr string) (*backendConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := newBackendConn(conn, addr)
+	go s.receive(c)
+	return c, nil
+}
+
+// send writes a subscription command to a backend node. The subscriptions
+// wait for their confirmations.
+func (s *subscriber) send(c *backendConn, ps *pendingSub) error {
+	b := redcon.AppendArray(nil, len(ps.args)+1)
+	b = redcon.AppendBulkString(b, ps.name)
+	for _, arg := range ps.args {
+		b = redcon.AppendBulkString(b, arg)
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		return err
+	}
+	if ps.left > 0 {
+		s.pending[c] = append(s.pending[c], ps)
+	}
+	return nil
+}
+
+// receive passes the messages and confirmations of a backend connection to
+// the client until the connection is closed. The client is disconnected
+// when a backend connection it still subscribes through fails.
+func (s *subscriber) receive(c *backendConn) {
+	for {
+		reply, err := c.readReply()
+		if err != nil {
+			s.mu.Lock()
+			lost := !s.closed && (c == s.classic || s.nodes[c.addr] == c)
+			s.mu.Unlock()
+			if lost {
+				log.Println("subscription", c.addr, err)
+				// unblocks serve, which closes the client
+				s.conn.NetConn().Close()
+			}
+			return
+		}
+		s.mu.Lock()
+		if c == s.classic || s.nodes[c.addr] == c {
+			s.reply(c, reply)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// reply handles a reply of a backend connection. The caller must hold
+// s.mu.
+func (s *subscriber) reply(c *backendConn, reply []byte) {
+	_, resp := redcon.ReadNextRESP(reply)
+	if resp.Type == redcon.Error {
+		// the subscription command failed as a whole
+		if pending := s.pending[c]; len(pending) > 0 {
+			s.done(c)
+			if !pending[0].silent {
+				s.write(reply)
+				return
+			}
+		}
+		log.Println("subscription", c.addr, string(resp.Data))
+		return
+	}
+	items := respItems(resp)
+	if len(items) < 3 {
+		return
+	}
+	kind := strings.ToLower(string(items[0].Data))
+	switch kind {
+	case "message", "pmessage", "smessage":
+		if s.conn.Protocol() == 3 {
+			// the backends speak RESP2
+			reply[0] = redcon.Push
+		}
+		s.write(reply)
+		return
+	case "subscribe", "psubscribe", "ssubscribe", "unsubscribe", "punsubscribe", "sunsubscribe":
+	default:
+		return
+	}
+	ch := string(items[1].Data)
+	null := len(items[1].Raw) > 1 && items[1].Raw[1] == '-'
+	silent := false
+	switch kind {
+	case "subscribe":
+		s.channels[ch] = true
+	case "psubscribe":
+		s.patterns[ch] = true
+	case "ssubscribe":
+		s.shards[ch] = c.addr
+	case "unsubscribe":
+		delete(s.channels, ch)
+	case "punsubscribe":
+		delete(s.patterns, ch)
+	case "sunsubscribe":
+		delete(s.shards, ch)
+	}
+	if pending := s.pending[c]; len(pending) > 0 && pending[0].name == kind {
+		silent = pending[0].silent
+		if pending[0].left--; pending[0].left == 0 {
+			s.done(c)
+		}
+	}
+	if silent {
+		return
+	}
+	wr := redcon.NewWriter(nil)
+	wr.SetProtocol(s.conn.Protocol())
+	wr.WritePush(3)
+	wr.WriteBulkString(kind)
+	if null {
+		wr.WriteNull()
+	} else {
+		wr.WriteBulkString(ch)
+	}
+	wr.WriteInt(s.subCount(kind))
+	s.write(wr.Buffer())
+}
+
+// done drops the first pending subscription of c.
+func (s *subscriber) done(c *backendConn) {
+	if pending := s.pending[c]; len(pending) > 1 {
+		s.pending[c] = pending[1:]
+	} else {
+		delete(s.pending, c)
+	}
+}
+
+// close closes the client and its backend connections.
+func (s *subscriber) close() {
+	s.p.subsMu.Lock()
+	delete(s.p.subs, s)
+	s.p.subsMu.Unlock()
+	s.mu.Lock()
+	s.closed = true
+	s.unsubscribeAll()
+	s.mu.Unlock()
+	s.conn.Close()
+}
+
+// unsubscribed answers an UNSUBSCRIBE, PUNSUBSCRIBE or SUNSUBSCRIBE of a
+// client that is not subscribed.
+func unsubscribed(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	if len(cmd.Args) == 1 {
+		conn.WritePush(3)
+		conn.WriteBulkString(name)
+		conn.WriteNull()
+		conn.WriteInt(0)
+		return
+	}
+	for _, ch := range cmd.Args[1:] {
+		conn.WritePush(3)
+		conn.WriteBulkString(name)
+		conn.WriteBulk(ch)
+		conn.WriteInt(0)
+	}
+}
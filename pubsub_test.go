@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"redisp/redcon"
+)
+
+func TestSubscriberReattach(t *testing.T) {
+	node := fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		// a subscription to a single channel
+		conn.WriteArray(3)
+		conn.WriteBulk(cmd.Args[0])
+		conn.WriteBulk(cmd.Args[1])
+		if strings.EqualFold(string(cmd.Args[0]), "subscribe") {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+	})
+	source := newUpstream("source", &topology{mode: modeStandalone, addrs: []string{node}}, nil, 0)
+	p := &proxy{source: source, policy: route{write: writeSource}, subs: make(map[*subscriber]bool)}
+	p.handler = func(conn redcon.Conn, cmd redcon.Command) {
+		if p.queue(conn, cmd) {
+			return
+		}
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "multi", "exec", "discard", "watch", "unwatch":
+			p.transaction(conn, cmd)
+		case "subscribe":
+			p.subscribe(conn, cmd)
+		case "reset":
+			resetSession(conn)
+		default:
+			if _, ok := conn.(*detached); ok {
+				conn.WriteString("DETACHED")
+			} else {
+				conn.WriteString("ATTACHED")
+			}
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go redcon.Serve(ln, p.handler, nil, closeSession)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rd := redcon.NewReplyReader(conn)
+	steps := []struct {
+		cmd   string
+		reply []string
+	}{
+		{"subscribe ch", []string{"*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"}},
+		{"unsubscribe ch", []string{"*3\r\n$11\r\nunsubscribe\r\n$2\r\nch\r\n:0\r\n"}},
+		{"ping", []string{"+ATTACHED\r\n"}},
+		{"multi", []string{"+OK\r\n"}},
+		{"ping", []string{"+QUEUED\r\n"}},
+		{"reset", []string{"+RESET\r\n"}},
+		{"exec", []string{"-ERR EXEC without MULTI\r\n"}},
+		{"subscribe ch", []string{"*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"}},
+		{"reset", []string{"+RESET\r\n"}},
+		{"ping", []string{"+ATTACHED\r\n"}},
+	}
+	for _, step := range steps {
+		if _, err := conn.Write(parseCommand(step.cmd).Raw); err != nil {
+			t.Fatal(err)
+		}
+		for _, exp := range step.reply {
+			resp, err := rd.ReadReply()
+			if err != nil || string(resp.Raw) != exp {
+				t.Fatalf("%s: expected %q, got %q %v", step.cmd, exp, resp.Raw, err)
+			}
+		}
+	}
+	p.subsMu.Lock()
+	defer p.subsMu.Unlock()
+	if len(p.subs) != 0 {
+		t.Fatalf("expected no subscriber left, got %d", len(p.subs))
+	}
+}
@@ -0,0 +1,338 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+var (
+	errCorruptLZF      = errors.New("corrupt lzf data")
+	errCorruptZiplist  = errors.New("corrupt ziplist")
+	errCorruptListpack = errors.New("corrupt listpack")
+	errCorruptIntset   = errors.New("corrupt intset")
+	errCorruptZipmap   = errors.New("corrupt zipmap")
+)
+
+// lzfDecompress decompresses in into a buffer of n bytes.
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, prealloc(uint64(n)))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// literal run
+			ctrl++
+			if i+ctrl > len(in) {
+				return nil, errCorruptLZF
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errCorruptLZF
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errCorruptLZF
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errCorruptLZF
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, errCorruptLZF
+	}
+	return out, nil
+}
+
+// decodeZiplist returns the elements of a ziplist.
+func decodeZiplist(b []byte) ([]string, error) {
+	if len(b) < 11 {
+		return nil, errCorruptZiplist
+	}
+	n := int(binary.LittleEndian.Uint16(b[8:10]))
+	vals := make([]string, 0, n)
+	i := 10
+	for {
+		if i >= len(b) {
+			return nil, errCorruptZiplist
+		}
+		if b[i] == 0xFF {
+			return vals, nil
+		}
+		// previous entry length
+		if b[i] == 0xFE {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errCorruptZiplist
+		}
+		enc := b[i]
+		var size int
+		switch enc >> 6 {
+		case 0:
+			size = int(enc & 0x3f)
+			i++
+		case 1:
+			if i+2 > len(b) {
+				return nil, errCorruptZiplist
+			}
+			size = int(enc&0x3f)<<8 | int(b[i+1])
+			i += 2
+		case 2:
+			if i+5 > len(b) {
+				return nil, errCorruptZiplist
+			}
+			size = int(binary.BigEndian.Uint32(b[i+1 : i+5]))
+			i += 5
+		default:
+			i++
+			var v int64
+			switch {
+			case enc == 0xC0:
+				if i+2 > len(b) {
+					return nil, errCorruptZiplist
+				}
+				v = int64(int16(binary.LittleEndian.Uint16(b[i:])))
+				i += 2
+			case enc == 0xD0:
+				if i+4 > len(b) {
+					return nil, errCorruptZiplist
+				}
+				v = int64(int32(binary.LittleEndian.Uint32(b[i:])))
+				i += 4
+			case enc == 0xE0:
+				if i+8 > len(b) {
+					return nil, errCorruptZiplist
+				}
+				v = int64(binary.LittleEndian.Uint64(b[i:]))
+				i += 8
+			case enc == 0xF0:
+				if i+3 > len(b) {
+					return nil, errCorruptZiplist
+				}
+				v = int64(int32(uint32(b[i])<<8|uint32(b[i+1])<<16|uint32(b[i+2])<<24) >> 8)
+				i += 3
+			case enc == 0xFE:
+				if i+1 > len(b) {
+					return nil, errCorruptZiplist
+				}
+				v = int64(int8(b[i]))
+				i++
+			case enc >= 0xF1 && enc <= 0xFD:
+				v = int64(enc&0x0f) - 1
+			default:
+				return nil, errCorruptZiplist
+			}
+			vals = append(vals, strconv.FormatInt(v, 10))
+			continue
+		}
+		if i+size > len(b) {
+			return nil, errCorruptZiplist
+		}
+		vals = append(vals, string(b[i:i+size]))
+		i += size
+	}
+}
+
+// decodeListpack returns the elements of a listpack.
+func decodeListpack(b []byte) ([]string, error) {
+	if len(b) < 7 {
+		return nil, errCorruptListpack
+	}
+	vals := make([]string, 0, int(binary.LittleEndian.Uint16(b[4:6])))
+	i := 6
+	for {
+		if i >= len(b) {
+			return nil, errCorruptListpack
+		}
+		if b[i] == 0xFF {
+			return vals, nil
+		}
+		val, n, err := listpackEntry(b[i:])
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+		i += n
+	}
+}
+
+// listpackEntry decodes the listpack entry at the start of b and returns its
+// value and total size, including the backlen.
+func listpackEntry(b []byte) (string, int, error) {
+	enc := b[0]
+	var (
+		hdr, size int
+		v         int64
+		isInt     bool
+	)
+	switch {
+	case enc&0x80 == 0:
+		// 7 bit unsigned int
+		v, isInt, hdr = int64(enc&0x7f), true, 1
+	case enc&0xC0 == 0x80:
+		// 6 bit string length
+		size, hdr = int(enc&0x3f), 1
+	case enc&0xE0 == 0xC0:
+		// 13 bit signed int
+		if len(b) < 2 {
+			return "", 0, errCorruptListpack
+		}
+		v = int64(enc&0x1f)<<8 | int64(b[1])
+		if v >= 1<<12 {
+			v -= 1 << 13
+		}
+		isInt, hdr = true, 2
+	case enc&0xF0 == 0xE0:
+		// 12 bit string length
+		if len(b) < 2 {
+			return "", 0, errCorruptListpack
+		}
+		size, hdr = int(enc&0x0f)<<8|int(b[1]), 2
+	case enc == 0xF0:
+		// 32 bit string length
+		if len(b) < 5 {
+			return "", 0, errCorruptListpack
+		}
+		size, hdr = int(binary.LittleEndian.Uint32(b[1:5])), 5
+	case enc >= 0xF1 && enc <= 0xF4:
+		var width int
+		switch enc {
+		case 0xF1:
+			width = 2
+		case 0xF2:
+			width = 3
+		case 0xF3:
+			width = 4
+		case 0xF4:
+			width = 8
+		}
+		if len(b) < 1+width {
+			return "", 0, errCorruptListpack
+		}
+		var u uint64
+		for j := width; j > 0; j-- {
+			u = u<<8 | uint64(b[j])
+		}
+		// sign extend
+		shift := uint(64 - width*8)
+		v, isInt, hdr = int64(u<<shift)>>shift, true, 1+width
+	default:
+		return "", 0, errCorruptListpack
+	}
+	n := hdr + size
+	if n > len(b) {
+		return "", 0, errCorruptListpack
+	}
+	var val string
+	if isInt {
+		val = strconv.FormatInt(v, 10)
+	} else {
+		val = string(b[hdr:n])
+	}
+	n += backlenSize(n)
+	if n > len(b) {
+		return "", 0, errCorruptListpack
+	}
+	return val, n, nil
+}
+
+// backlenSize returns the number of bytes used to store the length of an
+// entry of n bytes at its end.
+func backlenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// decodeIntset returns the members of an intset.
+func decodeIntset(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, errCorruptIntset
+	}
+	width := int(binary.LittleEndian.Uint32(b[0:4]))
+	n := int(binary.LittleEndian.Uint32(b[4:8]))
+	if width != 2 && width != 4 && width != 8 || len(b) < 8+n*width {
+		return nil, errCorruptIntset
+	}
+	vals := make([]string, n)
+	for i := range vals {
+		p := b[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		vals[i] = strconv.FormatInt(v, 10)
+	}
+	return vals, nil
+}
+
+// decodeZipmap returns the field/value pairs of a zipmap.
+func decodeZipmap(b []byte) ([]string, error) {
+	var vals []string
+	i := 1
+	for {
+		if i >= len(b) {
+			return nil, errCorruptZipmap
+		}
+		if b[i] == 0xFF {
+			if len(vals)%2 != 0 {
+				return nil, errCorruptZipmap
+			}
+			return vals, nil
+		}
+		size := int(b[i])
+		i++
+		if size == 254 {
+			if i+4 > len(b) {
+				return nil, errCorruptZipmap
+			}
+			size = int(binary.LittleEndian.Uint32(b[i:]))
+			i += 4
+		} else if size == 255 {
+			return nil, errCorruptZipmap
+		}
+		free := 0
+		if len(vals)%2 == 1 {
+			// values are followed by a count of unused bytes
+			if i >= len(b) {
+				return nil, errCorruptZipmap
+			}
+			free = int(b[i])
+			i++
+		}
+		if i+size+free > len(b) {
+			return nil, errCorruptZipmap
+		}
+		vals = append(vals, string(b[i:i+size]))
+		i += size + free
+	}
+}
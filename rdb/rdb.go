@@ -0,0 +1,779 @@
+// Package rdb implements a decoder for Redis RDB files
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// RDB opcodes
+const (
+	opSlotInfo     = 0xF4
+	opFunction2    = 0xF5
+	opFunction     = 0xF6
+	opModuleAux    = 0xF7
+	opIdle         = 0xF8
+	opFreq         = 0xF9
+	opAux          = 0xFA
+	opResizeDB     = 0xFB
+	opExpireTimeMs = 0xFC
+	opExpireTime   = 0xFD
+	opSelectDB     = 0xFE
+	opEOF          = 0xFF
+)
+
+// RDB object types
+const (
+	typeString           = 0
+	typeList             = 1
+	typeSet              = 2
+	typeZSet             = 3
+	typeHash             = 4
+	typeZSet2            = 5
+	typeModule           = 6
+	typeModule2          = 7
+	typeHashZipmap       = 9
+	typeListZiplist      = 10
+	typeSetIntset        = 11
+	typeZSetZiplist      = 12
+	typeHashZiplist      = 13
+	typeListQuicklist    = 14
+	typeStreamListpacks  = 15
+	typeHashListpack     = 16
+	typeZSetListpack     = 17
+	typeListQuicklist2   = 18
+	typeStreamListpacks2 = 19
+	typeSetListpack      = 20
+	typeStreamListpacks3 = 21
+
+	// hashes with field expiration, Redis 7.4
+	typeHashMetadataPreGA   = 22
+	typeHashListpackExPreGA = 23
+	typeHashMetadata        = 24
+	typeHashListpackEx      = 25
+)
+
+// length encodings
+const (
+	len6Bit  = 0
+	len14Bit = 1
+	len32Bit = 0x80
+	len64Bit = 0x81
+	lenEnc   = 3
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+// module value opcodes
+const (
+	moduleEOF    = 0
+	moduleSInt   = 1
+	moduleUInt   = 2
+	moduleFloat  = 3
+	moduleDouble = 4
+	moduleString = 5
+)
+
+var errInvalidHeader = errors.New("rdb: invalid header")
+
+// ZMember is a member of a sorted set.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// Entry is a key decoded from an RDB file.
+type Entry struct {
+	// DB is the logical database of the key.
+	DB int
+	// Key is the name of the key.
+	Key string
+	// Type is one of "string", "list", "set", "zset", "hash" or "stream".
+	Type string
+	// Value holds the value for the Type:
+	//   string -> string
+	//   list   -> []string
+	//   set    -> []string
+	//   zset   -> []ZMember
+	//   hash   -> map[string]string
+	//   stream -> *Stream
+	Value interface{}
+	// ExpireAt is the expiration time of the key, zero when it does not
+	// expire.
+	ExpireAt time.Time
+	// FieldExpireAt is the expiration time of the fields of a hash that
+	// expire, for the hashes with field expiration of Redis 7.4.
+	FieldExpireAt map[string]time.Time
+}
+
+// Decoder reads keys from an RDB file.
+type Decoder struct {
+	rd      *bufio.Reader
+	version int
+	db      int
+	started bool
+	buf     [8]byte
+}
+
+// NewDecoder returns a decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{rd: bufio.NewReader(r)}
+}
+
+// Version returns the RDB version of the file. It is valid after the first
+// call to Next.
+func (d *Decoder) Version() int {
+	return d.version
+}
+
+// Next returns the next key in the file. It returns io.EOF after the last
+// key. Auxiliary fields, functions and module data are skipped.
+func (d *Decoder) Next() (*Entry, error) {
+	if !d.started {
+		if err := d.readHeader(); err != nil {
+			return nil, err
+		}
+		d.started = true
+	}
+	var expireAt time.Time
+	for {
+		op, err := d.rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opEOF:
+			return nil, io.EOF
+		case opSelectDB:
+			db, err := d.readLength()
+			if err != nil {
+				return nil, err
+			}
+			d.db = int(db)
+		case opResizeDB:
+			if _, err := d.readLength(); err != nil {
+				return nil, err
+			}
+			if _, err := d.readLength(); err != nil {
+				return nil, err
+			}
+		case opSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := d.readLength(); err != nil {
+					return nil, err
+				}
+			}
+		case opAux:
+			if _, err := d.readString(); err != nil {
+				return nil, err
+			}
+			if _, err := d.readString(); err != nil {
+				return nil, err
+			}
+		case opFunction, opFunction2:
+			if _, err := d.readString(); err != nil {
+				return nil, err
+			}
+		case opModuleAux:
+			if err := d.skipModuleAux(); err != nil {
+				return nil, err
+			}
+		case opIdle:
+			if _, err := d.readLength(); err != nil {
+				return nil, err
+			}
+		case opFreq:
+			if _, err := d.rd.ReadByte(); err != nil {
+				return nil, err
+			}
+		case opExpireTime:
+			b, err := d.readN(4)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+		case opExpireTimeMs:
+			ms, err := d.readMillis()
+			if err != nil {
+				return nil, err
+			}
+			expireAt = ms
+		default:
+			key, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			e := &Entry{DB: d.db, Key: key, ExpireAt: expireAt}
+			if op == typeModule2 || op == typeModule {
+				if err := d.skipModule(op); err != nil {
+					return nil, err
+				}
+				expireAt = time.Time{}
+				continue
+			}
+			if err := d.readObject(op, e); err != nil {
+				return nil, fmt.Errorf("rdb: key %q: %v", key, err)
+			}
+			return e, nil
+		}
+	}
+}
+
+func (d *Decoder) readHeader() error {
+	b, err := d.readN(9)
+	if err != nil {
+		return err
+	}
+	if string(b[:5]) != "REDIS" {
+		return errInvalidHeader
+	}
+	d.version, err = strconv.Atoi(string(b[5:]))
+	if err != nil {
+		return errInvalidHeader
+	}
+	return nil
+}
+
+func (d *Decoder) readObject(typ byte, e *Entry) error {
+	var err error
+	switch typ {
+	case typeString:
+		e.Type = "string"
+		e.Value, err = d.readString()
+	case typeList:
+		e.Type = "list"
+		e.Value, err = d.readStrings()
+	case typeSet:
+		e.Type = "set"
+		e.Value, err = d.readStrings()
+	case typeZSet, typeZSet2:
+		e.Type = "zset"
+		e.Value, err = d.readZSet(typ == typeZSet2)
+	case typeHash:
+		e.Type = "hash"
+		e.Value, err = d.readHash()
+	case typeHashZipmap:
+		e.Type = "hash"
+		e.Value, err = d.readEncoded(decodeZipmap)
+		if err == nil {
+			e.Value, err = pairsToHash(e.Value.([]string))
+		}
+	case typeListZiplist:
+		e.Type = "list"
+		e.Value, err = d.readEncoded(decodeZiplist)
+	case typeSetIntset:
+		e.Type = "set"
+		e.Value, err = d.readEncoded(decodeIntset)
+	case typeSetListpack:
+		e.Type = "set"
+		e.Value, err = d.readEncoded(decodeListpack)
+	case typeZSetZiplist:
+		e.Type = "zset"
+		e.Value, err = d.readEncoded(decodeZiplist)
+		if err == nil {
+			e.Value, err = pairsToZSet(e.Value.([]string))
+		}
+	case typeZSetListpack:
+		e.Type = "zset"
+		e.Value, err = d.readEncoded(decodeListpack)
+		if err == nil {
+			e.Value, err = pairsToZSet(e.Value.([]string))
+		}
+	case typeHashZiplist:
+		e.Type = "hash"
+		e.Value, err = d.readEncoded(decodeZiplist)
+		if err == nil {
+			e.Value, err = pairsToHash(e.Value.([]string))
+		}
+	case typeHashListpack:
+		e.Type = "hash"
+		e.Value, err = d.readEncoded(decodeListpack)
+		if err == nil {
+			e.Value, err = pairsToHash(e.Value.([]string))
+		}
+	case typeHashMetadata, typeHashMetadataPreGA:
+		e.Type = "hash"
+		e.Value, e.FieldExpireAt, err = d.readHashExpire(typ == typeHashMetadata)
+	case typeHashListpackEx, typeHashListpackExPreGA:
+		e.Type = "hash"
+		e.Value, e.FieldExpireAt, err = d.readHashListpackExpire(typ == typeHashListpackEx)
+	case typeListQuicklist, typeListQuicklist2:
+		e.Type = "list"
+		e.Value, err = d.readQuicklist(typ == typeListQuicklist2)
+	case typeStreamListpacks, typeStreamListpacks2, typeStreamListpacks3:
+		e.Type = "stream"
+		e.Value, err = d.readStream(typ)
+	default:
+		err = fmt.Errorf("unsupported object type %d", typ)
+	}
+	return err
+}
+
+// maxPrealloc is the most the decoder allocates up front for a length read
+// from the file. Longer data is read in chunks, so a corrupt length fails at
+// the end of the input rather than allocating that much memory.
+const maxPrealloc = 1 << 20
+
+// prealloc returns the capacity to allocate for n elements read from the
+// file.
+func prealloc(n uint64) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(n)
+}
+
+// readFull reads n bytes, n being a length read from the file.
+func (d *Decoder) readFull(n uint64) ([]byte, error) {
+	if n <= maxPrealloc {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(d.rd, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	if n > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var buf bytes.Buffer
+	buf.Grow(maxPrealloc)
+	if _, err := io.CopyN(&buf, d.rd, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *Decoder) readN(n int) ([]byte, error) {
+	var b []byte
+	if n <= len(d.buf) {
+		b = d.buf[:n]
+	} else {
+		b = make([]byte, n)
+	}
+	if _, err := io.ReadFull(d.rd, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (d *Decoder) readMillis() (time.Time, error) {
+	b, err := d.readN(8)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return unixMillis(binary.LittleEndian.Uint64(b)), nil
+}
+
+// unixMillis returns the time of a unix time in milliseconds.
+func unixMillis(ms uint64) time.Time {
+	return time.Unix(int64(ms/1000), int64(ms%1000)*int64(time.Millisecond))
+}
+
+// readLengthEnc reads a length. encoded is true when the length is the
+// special string encoding held in the returned value.
+func (d *Decoder) readLengthEnc() (length uint64, encoded bool, err error) {
+	b, err := d.rd.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case len6Bit:
+		return uint64(b & 0x3f), false, nil
+	case len14Bit:
+		b2, err := d.rd.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(b2), false, nil
+	case lenEnc:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case len32Bit:
+		p, err := d.readN(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case len64Bit:
+		p, err := d.readN(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, fmt.Errorf("invalid length encoding 0x%x", b)
+}
+
+func (d *Decoder) readLength() (uint64, error) {
+	length, encoded, err := d.readLengthEnc()
+	if err == nil && encoded {
+		err = errors.New("unexpected encoded length")
+	}
+	return length, err
+}
+
+func (d *Decoder) readBytes() ([]byte, error) {
+	length, encoded, err := d.readLengthEnc()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return d.readFull(length)
+	}
+	switch length {
+	case encInt8:
+		b, err := d.rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(b)), 10), nil
+	case encInt16:
+		b, err := d.readN(2)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(b))), 10), nil
+	case encInt32:
+		b, err := d.readN(4)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(b))), 10), nil
+	case encLZF:
+		clen, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		in, err := d.readFull(clen)
+		if err != nil {
+			return nil, err
+		}
+		if ulen > math.MaxInt32 {
+			return nil, errCorruptLZF
+		}
+		return lzfDecompress(in, int(ulen))
+	}
+	return nil, fmt.Errorf("invalid string encoding %d", length)
+}
+
+func (d *Decoder) readString() (string, error) {
+	b, err := d.readBytes()
+	return string(b), err
+}
+
+func (d *Decoder) readStrings() ([]string, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]string, 0, prealloc(n))
+	for i := uint64(0); i < n; i++ {
+		val, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+	}
+	return vals, nil
+}
+
+func (d *Decoder) readHash() (map[string]string, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	hash := make(map[string]string, prealloc(n))
+	for i := uint64(0); i < n; i++ {
+		field, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if hash[field], err = d.readString(); err != nil {
+			return nil, err
+		}
+	}
+	return hash, nil
+}
+
+// readHashExpire reads a hash with field expiration in the hash table
+// encoding. Each field is preceded by its expiration time in milliseconds,
+// 0 when it does not expire. The GA format starts with the lowest
+// expiration time of the fields, and the times are relative to it.
+func (d *Decoder) readHashExpire(ga bool) (map[string]string, map[string]time.Time, error) {
+	var min uint64
+	if ga {
+		b, err := d.readN(8)
+		if err != nil {
+			return nil, nil, err
+		}
+		min = binary.LittleEndian.Uint64(b)
+	}
+	n, err := d.readLength()
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := make(map[string]string, prealloc(n))
+	var expire map[string]time.Time
+	for i := uint64(0); i < n; i++ {
+		ms, err := d.readLength()
+		if err != nil {
+			return nil, nil, err
+		}
+		field, err := d.readString()
+		if err != nil {
+			return nil, nil, err
+		}
+		if hash[field], err = d.readString(); err != nil {
+			return nil, nil, err
+		}
+		if ms == 0 {
+			continue
+		}
+		if ga {
+			ms += min - 1
+		}
+		if expire == nil {
+			expire = make(map[string]time.Time)
+		}
+		expire[field] = unixMillis(ms)
+	}
+	return hash, expire, nil
+}
+
+// readHashListpackExpire reads a hash with field expiration in the listpack
+// encoding, which holds the field, the value and the expiration time in
+// milliseconds of each field, 0 when it does not expire. The GA format
+// starts with the lowest expiration time of the fields.
+func (d *Decoder) readHashListpackExpire(ga bool) (map[string]string, map[string]time.Time, error) {
+	if ga {
+		if _, err := d.readN(8); err != nil {
+			return nil, nil, err
+		}
+	}
+	vals, err := d.readEncoded(decodeListpack)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(vals)%3 != 0 {
+		return nil, nil, errors.New("hash listpack elements are not triplets")
+	}
+	hash := make(map[string]string, len(vals)/3)
+	var expire map[string]time.Time
+	for i := 0; i < len(vals); i += 3 {
+		hash[vals[i]] = vals[i+1]
+		ms, err := strconv.ParseUint(vals[i+2], 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ms == 0 {
+			continue
+		}
+		if expire == nil {
+			expire = make(map[string]time.Time)
+		}
+		expire[vals[i]] = unixMillis(ms)
+	}
+	return hash, expire, nil
+}
+
+func (d *Decoder) readZSet(binaryScores bool) ([]ZMember, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	zset := make([]ZMember, 0, prealloc(n))
+	for i := uint64(0); i < n; i++ {
+		var m ZMember
+		if m.Member, err = d.readString(); err != nil {
+			return nil, err
+		}
+		if binaryScores {
+			b, err := d.readN(8)
+			if err != nil {
+				return nil, err
+			}
+			m.Score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		} else if m.Score, err = d.readFloat(); err != nil {
+			return nil, err
+		}
+		zset = append(zset, m)
+	}
+	return zset, nil
+}
+
+// readFloat reads a score in the string format of the first RDB versions.
+func (d *Decoder) readFloat() (float64, error) {
+	n, err := d.rd.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := d.readN(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+// readEncoded reads a string holding an encoded collection and decodes it.
+func (d *Decoder) readEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	b, err := d.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	return decode(b)
+}
+
+func (d *Decoder) readQuicklist(v2 bool) ([]string, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for i := uint64(0); i < n; i++ {
+		container := uint64(quicklistPacked)
+		if v2 {
+			if container, err = d.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		b, err := d.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if container == quicklistPlain {
+			list = append(list, string(b))
+			continue
+		}
+		var vals []string
+		if v2 {
+			vals, err = decodeListpack(b)
+		} else {
+			vals, err = decodeZiplist(b)
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, vals...)
+	}
+	return list, nil
+}
+
+// quicklist node containers
+const (
+	quicklistPlain  = 1
+	quicklistPacked = 2
+)
+
+// skipModule skips a module value. Only values stored with the self
+// describing module format can be skipped.
+func (d *Decoder) skipModule(typ byte) error {
+	id, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	if typ == typeModule {
+		return fmt.Errorf("cannot skip module %s value of rdb version %d",
+			moduleName(id), d.version)
+	}
+	return d.skipModuleValue()
+}
+
+func (d *Decoder) skipModuleAux() error {
+	// module id, when opcode and when
+	for i := 0; i < 3; i++ {
+		if _, err := d.readLength(); err != nil {
+			return err
+		}
+	}
+	return d.skipModuleValue()
+}
+
+func (d *Decoder) skipModuleValue() error {
+	for {
+		op, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case moduleEOF:
+			return nil
+		case moduleSInt, moduleUInt:
+			_, err = d.readLength()
+		case moduleFloat:
+			_, err = d.readN(4)
+		case moduleDouble:
+			_, err = d.readN(8)
+		case moduleString:
+			_, err = d.readBytes()
+		default:
+			err = fmt.Errorf("invalid module opcode %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// moduleName returns the 9 character name of a module from its 64 bit id.
+func moduleName(id uint64) string {
+	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	name := make([]byte, 9)
+	id >>= 10
+	for i := 8; i >= 0; i-- {
+		name[i] = charset[id&63]
+		id >>= 6
+	}
+	return string(name)
+}
+
+func pairsToHash(vals []string) (map[string]string, error) {
+	if len(vals)%2 != 0 {
+		return nil, errors.New("odd number of hash elements")
+	}
+	hash := make(map[string]string, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		hash[vals[i]] = vals[i+1]
+	}
+	return hash, nil
+}
+
+func pairsToZSet(vals []string) ([]ZMember, error) {
+	if len(vals)%2 != 0 {
+		return nil, errors.New("odd number of zset elements")
+	}
+	zset := make([]ZMember, len(vals)/2)
+	for i := range zset {
+		score, err := strconv.ParseFloat(vals[i*2+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		zset[i] = ZMember{Member: vals[i*2], Score: score}
+	}
+	return zset, nil
+}
@@ -0,0 +1,330 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func appendLength(b []byte, n int) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, byte(n>>8)|0x40, byte(n))
+	}
+	b = append(b, len32Bit)
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendLength(b, len(s)), s...)
+}
+
+// appendListpack encodes vals as a listpack using 7 bit integers and 6 bit
+// strings only.
+func appendListpack(b []byte, vals ...string) []byte {
+	lp := make([]byte, 6)
+	for _, v := range vals {
+		var entry []byte
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < 128 {
+			entry = []byte{byte(n)}
+		} else {
+			entry = append([]byte{0x80 | byte(len(v))}, v...)
+		}
+		lp = append(lp, entry...)
+		lp = append(lp, byte(len(entry)))
+	}
+	lp = append(lp, 0xFF)
+	binary.LittleEndian.PutUint32(lp[0:], uint32(len(lp)))
+	binary.LittleEndian.PutUint16(lp[4:], uint16(len(vals)))
+	return appendString(b, string(lp))
+}
+
+// appendZiplist encodes vals as a ziplist using 6 bit strings and 16 bit
+// integers only.
+func appendZiplist(b []byte, vals ...string) []byte {
+	zl := make([]byte, 10)
+	prev := 0
+	for _, v := range vals {
+		entry := []byte{byte(prev)}
+		if n, err := strconv.Atoi(v); err == nil {
+			entry = append(entry, 0xC0, byte(n), byte(n>>8))
+		} else {
+			entry = append(entry, byte(len(v)))
+			entry = append(entry, v...)
+		}
+		zl = append(zl, entry...)
+		prev = len(entry)
+	}
+	zl = append(zl, 0xFF)
+	binary.LittleEndian.PutUint32(zl[0:], uint32(len(zl)))
+	binary.LittleEndian.PutUint16(zl[8:], uint16(len(vals)))
+	return appendString(b, string(zl))
+}
+
+func testFile() []byte {
+	b := []byte("REDIS0011")
+	b = append(b, opAux)
+	b = appendString(b, "redis-ver")
+	b = appendString(b, "7.2.0")
+	b = append(b, opSelectDB, 0, opResizeDB, 8, 1)
+
+	// string with expire
+	b = append(b, opExpireTimeMs)
+	b = append(b, 0xE8, 0x03, 0, 0, 0, 0, 0, 0) // 1000 ms
+	b = append(b, typeString)
+	b = appendString(b, "str")
+	b = appendString(b, "hello")
+
+	// int encoded string
+	b = append(b, typeString)
+	b = appendString(b, "int")
+	b = append(b, 0xC1, 0x39, 0x30) // 12345
+
+	// lzf compressed string: "abc" literal then back reference of 6 bytes
+	b = append(b, typeString)
+	b = appendString(b, "lzf")
+	b = append(b, 0xC3, 6, 9, 2, 'a', 'b', 'c', 0x80, 2)
+
+	// quicklist 2 with a packed and a plain node
+	b = append(b, typeListQuicklist2)
+	b = appendString(b, "list")
+	b = append(b, 2, quicklistPacked)
+	b = appendListpack(b, "a", "1")
+	b = append(b, quicklistPlain)
+	b = appendString(b, "big")
+
+	// intset
+	b = append(b, typeSetIntset)
+	b = appendString(b, "set")
+	b = appendString(b, string([]byte{2, 0, 0, 0, 2, 0, 0, 0, 0xFF, 0xFF, 7, 0}))
+
+	// zipmap hash
+	b = append(b, typeHashZipmap)
+	b = appendString(b, "zipmap")
+	b = appendString(b, string([]byte{1, 1, 'f', 2, 0, 'v', '1', 0xFF}))
+
+	// ziplist hash
+	b = append(b, typeHashZiplist)
+	b = appendString(b, "hash")
+	b = appendZiplist(b, "f", "300")
+
+	// zset with binary scores
+	b = append(b, typeZSet2)
+	b = appendString(b, "zset")
+	b = append(b, 1)
+	b = appendString(b, "m")
+	var score [8]byte
+	binary.LittleEndian.PutUint64(score[:], math.Float64bits(1.5))
+	b = append(b, score[:]...)
+
+	// listpack zset
+	b = append(b, typeZSetListpack)
+	b = appendString(b, "zlp")
+	b = appendListpack(b, "m", "2")
+
+	// module aux
+	b = append(b, opModuleAux, 0x81, 0, 0, 0, 0, 0, 0, 0, 1, 2, 2)
+	b = append(b, moduleUInt, 5, moduleString)
+	b = appendString(b, "aux")
+	b = append(b, moduleEOF)
+
+	// stream with one group
+	b = append(b, typeStreamListpacks3)
+	b = appendString(b, "stream")
+	b = append(b, 1)
+	master := make([]byte, 16)
+	binary.BigEndian.PutUint64(master[:8], 10)
+	b = appendString(b, string(master))
+	b = appendListpack(b,
+		"2", "1", "1", "f", "0", // master entry
+		"2", "0", "0", "a", "4", // same fields entry 10-0
+		"0", "0", "1", "1", "g", "b", "6", // entry 10-1
+		"3", "1", "0", "c", "4", // deleted entry 11-0
+	)
+	b = append(b, 2, 11, 0)        // length and last id
+	b = append(b, 10, 0, 11, 0, 3) // first id, max deleted id, added
+	b = append(b, 1)
+	b = appendString(b, "group")
+	b = append(b, 10, 1, 2) // last id and entries read
+	b = append(b, 0, 0)     // pending entries and consumers
+
+	b = append(b, opSelectDB, 1, typeString)
+	b = appendString(b, "db1")
+	b = appendString(b, "x")
+	b = append(b, opEOF)
+	return append(b, make([]byte, 8)...)
+}
+
+func TestDecoder(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(testFile()))
+	var entries []*Entry
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if d.Version() != 11 {
+		t.Fatalf("expected version 11, got %d", d.Version())
+	}
+	expect := []Entry{
+		{Key: "str", Type: "string", Value: "hello", ExpireAt: time.Unix(1, 0)},
+		{Key: "int", Type: "string", Value: "12345"},
+		{Key: "lzf", Type: "string", Value: "abcabcabc"},
+		{Key: "list", Type: "list", Value: []string{"a", "1", "big"}},
+		{Key: "set", Type: "set", Value: []string{"-1", "7"}},
+		{Key: "zipmap", Type: "hash", Value: map[string]string{"f": "v1"}},
+		{Key: "hash", Type: "hash", Value: map[string]string{"f": "300"}},
+		{Key: "zset", Type: "zset", Value: []ZMember{{"m", 1.5}}},
+		{Key: "zlp", Type: "zset", Value: []ZMember{{"m", 2}}},
+		{Key: "stream", Type: "stream", Value: &Stream{
+			Entries: []StreamEntry{
+				{ID: StreamID{10, 0}, Fields: []string{"f", "a"}},
+				{ID: StreamID{10, 1}, Fields: []string{"g", "b"}},
+			},
+			LastID: StreamID{11, 0},
+			Groups: []StreamGroup{{Name: "group", LastID: StreamID{10, 1}}},
+		}},
+		{DB: 1, Key: "db1", Type: "string", Value: "x"},
+	}
+	if len(entries) != len(expect) {
+		t.Fatalf("expected %d entries, got %d", len(expect), len(entries))
+	}
+	for i, e := range entries {
+		if !reflect.DeepEqual(*e, expect[i]) {
+			t.Fatalf("entry %d: expected %+v, got %+v", i, expect[i], *e)
+		}
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	_, err := NewDecoder(bytes.NewReader([]byte("RESP00011"))).Next()
+	if err != errInvalidHeader {
+		t.Fatalf("expected %v, got %v", errInvalidHeader, err)
+	}
+}
+
+func TestListpackIntegers(t *testing.T) {
+	lp := []byte{0, 0, 0, 0, 3, 0,
+		0xDF, 0xFF, 2, // 13 bit -1
+		0xF1, 0x00, 0x80, 3, // 16 bit -32768
+		0xF2, 0x01, 0x00, 0x01, 4, // 24 bit 65537
+		0xFF,
+	}
+	vals, err := decodeListpack(lp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, []string{"-1", "-32768", "65537"}) {
+		t.Fatalf("unexpected values %v", vals)
+	}
+}
+
+func TestBacklenSize(t *testing.T) {
+	tests := []struct {
+		n, size int
+	}{
+		{0, 1},
+		{127, 1},
+		{128, 2},
+		{16382, 2},
+		{16383, 3},
+		{2097150, 3},
+		{2097151, 4},
+		{268435454, 4},
+		{268435455, 5},
+	}
+	for _, tt := range tests {
+		if size := backlenSize(tt.n); size != tt.size {
+			t.Errorf("%d: expected %d, got %d", tt.n, tt.size, size)
+		}
+	}
+}
+
+func TestReadBytesTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"short", []byte{10, 'a', 'b', 'c'}},
+		{"64 bit", []byte{len64Bit, 0, 0, 1, 0, 0, 0, 0, 0, 'a', 'b', 'c'}},
+		{"max 64 bit", []byte{len64Bit, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'a'}},
+		{"lzf", []byte{0xc0 | encLZF, len32Bit, 0x7f, 0xff, 0xff, 0xff, 3, 'a', 'b', 'c'}},
+	}
+	for _, tt := range tests {
+		_, err := NewDecoder(bytes.NewReader(tt.in)).readBytes()
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: expected %v, got %v", tt.name, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+func TestHashFieldExpire(t *testing.T) {
+	var min [8]byte
+	binary.LittleEndian.PutUint64(min[:], 1700000000000)
+	at := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		typ  byte
+		body []byte
+	}{
+		{"metadata", typeHashMetadata, func() []byte {
+			b := append(min[:0:0], min[:]...)
+			b = append(b, 2, 1) // the expiration time of f is min + 1 - 1
+			b = appendString(appendString(b, "f"), "1")
+			return appendString(appendString(append(b, 0), "g"), "2")
+		}()},
+		{"metadata pre GA", typeHashMetadataPreGA, func() []byte {
+			b := []byte{2, len64Bit}
+			b = append(b, 0, 0, 0x01, 0x8b, 0xcf, 0xe5, 0x68, 0x00) // 1700000000000 big endian
+			b = appendString(appendString(b, "f"), "1")
+			return appendString(appendString(append(b, 0), "g"), "2")
+		}()},
+		{"listpack", typeHashListpackEx, appendListpack(append(min[:0:0], min[:]...),
+			"f", "1", "1700000000000", "g", "2", "0")},
+		{"listpack pre GA", typeHashListpackExPreGA, appendListpack(nil,
+			"f", "1", "1700000000000", "g", "2", "0")},
+	}
+	for _, tt := range tests {
+		b := append([]byte("REDIS0012"), tt.typ)
+		b = appendString(b, "h")
+		b = append(b, tt.body...)
+		b = append(b, opEOF)
+		e, err := NewDecoder(bytes.NewReader(b)).Next()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		exp := Entry{Key: "h", Type: "hash",
+			Value:         map[string]string{"f": "1", "g": "2"},
+			FieldExpireAt: map[string]time.Time{"f": at},
+		}
+		if !reflect.DeepEqual(*e, exp) {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, exp, *e)
+		}
+	}
+}
+
+func TestStreamEntriesCorrupt(t *testing.T) {
+	tests := [][]string{
+		{"1", "0", "-1", "f", "0"},
+		{"1", "0", "1", "f", "0", "0", "0", "0", "-1", "g", "1", "5"},
+		{"1", "0", "1", "f", "0", "0", "0", "0", "2", "g", "1", "5"},
+		{"-1", "0", "0", "0"},
+	}
+	for _, vals := range tests {
+		if _, err := streamEntries(StreamID{}, vals); err == nil {
+			t.Errorf("%v: expected an error", vals)
+		}
+	}
+}
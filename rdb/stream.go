@@ -0,0 +1,270 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var errCorruptStream = errors.New("corrupt stream")
+
+// stream entry flags
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+// StreamID is the id of a stream entry.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// String returns the id in the "<ms>-<seq>" form.
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// StreamEntry is an entry of a stream.
+type StreamEntry struct {
+	ID StreamID
+	// Fields holds the field/value pairs of the entry in order.
+	Fields []string
+}
+
+// StreamGroup is a consumer group of a stream. Pending entries and
+// consumers are not decoded.
+type StreamGroup struct {
+	Name   string
+	LastID StreamID
+}
+
+// Stream is a decoded stream.
+type Stream struct {
+	Entries []StreamEntry
+	LastID  StreamID
+	Groups  []StreamGroup
+}
+
+func (d *Decoder) readStreamID() (StreamID, error) {
+	ms, err := d.readLength()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := d.readLength()
+	return StreamID{Ms: ms, Seq: seq}, err
+}
+
+func (d *Decoder) readStream(typ byte) (*Stream, error) {
+	s := &Stream{}
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		master, err := d.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(master) != 16 {
+			return nil, errCorruptStream
+		}
+		lp, err := d.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		vals, err := decodeListpack(lp)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := streamEntries(StreamID{
+			Ms:  binary.BigEndian.Uint64(master[:8]),
+			Seq: binary.BigEndian.Uint64(master[8:]),
+		}, vals)
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = append(s.Entries, entries...)
+	}
+	// length
+	if _, err := d.readLength(); err != nil {
+		return nil, err
+	}
+	if s.LastID, err = d.readStreamID(); err != nil {
+		return nil, err
+	}
+	if typ >= typeStreamListpacks2 {
+		// first id, max deleted id and entries added
+		if _, err := d.readStreamID(); err != nil {
+			return nil, err
+		}
+		if _, err := d.readStreamID(); err != nil {
+			return nil, err
+		}
+		if _, err := d.readLength(); err != nil {
+			return nil, err
+		}
+	}
+	groups, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		g, err := d.readStreamGroup(typ)
+		if err != nil {
+			return nil, err
+		}
+		s.Groups = append(s.Groups, g)
+	}
+	return s, nil
+}
+
+func (d *Decoder) readStreamGroup(typ byte) (StreamGroup, error) {
+	var g StreamGroup
+	var err error
+	if g.Name, err = d.readString(); err != nil {
+		return g, err
+	}
+	if g.LastID, err = d.readStreamID(); err != nil {
+		return g, err
+	}
+	if typ >= typeStreamListpacks2 {
+		// entries read
+		if _, err := d.readLength(); err != nil {
+			return g, err
+		}
+	}
+	// global pending entries list: id, delivery time and count
+	pending, err := d.readLength()
+	if err != nil {
+		return g, err
+	}
+	for i := uint64(0); i < pending; i++ {
+		if _, err := d.readN(16 + 8); err != nil {
+			return g, err
+		}
+		if _, err := d.readLength(); err != nil {
+			return g, err
+		}
+	}
+	consumers, err := d.readLength()
+	if err != nil {
+		return g, err
+	}
+	for i := uint64(0); i < consumers; i++ {
+		if _, err := d.readBytes(); err != nil {
+			return g, err
+		}
+		// seen time and, since version 3, active time
+		if _, err := d.readN(8); err != nil {
+			return g, err
+		}
+		if typ >= typeStreamListpacks3 {
+			if _, err := d.readN(8); err != nil {
+				return g, err
+			}
+		}
+		// consumer pending entries ids
+		pending, err := d.readLength()
+		if err != nil {
+			return g, err
+		}
+		for j := uint64(0); j < pending; j++ {
+			if _, err := d.readN(16); err != nil {
+				return g, err
+			}
+		}
+	}
+	return g, nil
+}
+
+// streamEntries decodes the entries of a stream listpack. The listpack
+// starts with a master entry holding the fields shared by the entries:
+//
+//	count, deleted, master field count, master fields..., 0
+//
+// followed by the entries:
+//
+//	flags, ms diff, seq diff, values... or field count and pairs, lp count
+func streamEntries(master StreamID, vals []string) ([]StreamEntry, error) {
+	next := func() (int64, error) {
+		if len(vals) == 0 {
+			return 0, errCorruptStream
+		}
+		v, err := strconv.ParseInt(vals[0], 10, 64)
+		vals = vals[1:]
+		return v, err
+	}
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := next()
+	if err != nil {
+		return nil, err
+	}
+	nfields, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if nfields < 0 || int64(len(vals)) < nfields+1 {
+		return nil, errCorruptStream
+	}
+	fields := vals[:nfields]
+	vals = vals[nfields+1:]
+
+	// an entry takes at least four values
+	if count < 0 || deleted < 0 || count > int64(len(vals)) {
+		return nil, errCorruptStream
+	}
+	entries := make([]StreamEntry, 0, count)
+	for i := int64(0); i < count+deleted; i++ {
+		flags, err := next()
+		if err != nil {
+			return nil, err
+		}
+		ms, err := next()
+		if err != nil {
+			return nil, err
+		}
+		seq, err := next()
+		if err != nil {
+			return nil, err
+		}
+		e := StreamEntry{ID: StreamID{
+			Ms:  master.Ms + uint64(ms),
+			Seq: master.Seq + uint64(seq),
+		}}
+		if flags&streamItemSameFields != 0 {
+			if len(vals) < len(fields) {
+				return nil, errCorruptStream
+			}
+			for j, f := range fields {
+				e.Fields = append(e.Fields, f, vals[j])
+			}
+			vals = vals[len(fields):]
+		} else {
+			n, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || int64(len(vals)) < n*2 {
+				return nil, errCorruptStream
+			}
+			e.Fields = append(e.Fields, vals[:n*2]...)
+			vals = vals[n*2:]
+		}
+		// lp count of the entry
+		if _, err := next(); err != nil {
+			return nil, err
+		}
+		if flags&streamItemDeleted == 0 {
+			entries = append(entries, e)
+		}
+	}
+	if len(vals) != 0 {
+		return nil, fmt.Errorf("%v: %d trailing elements", errCorruptStream, len(vals))
+	}
+	return entries, nil
+}
@@ -2,6 +2,7 @@ package redcon
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"sort"
 	"strconv"
@@ -316,6 +317,75 @@ func AppendNull(b []byte) []byte {
 	return append(b, '$', '-', '1', '\r', '\n')
 }
 
+// AppendNullRESP3 appends a RESP3 null to the input bytes.
+func AppendNullRESP3(b []byte) []byte {
+	return append(b, '_', '\r', '\n')
+}
+
+// AppendMap appends a RESP3 map header of n key/value pairs to the input
+// bytes.
+func AppendMap(b []byte, n int) []byte {
+	return appendPrefix(b, '%', int64(n))
+}
+
+// AppendSet appends a RESP3 set header to the input bytes.
+func AppendSet(b []byte, n int) []byte {
+	return appendPrefix(b, '~', int64(n))
+}
+
+// AppendPush appends a RESP3 push header to the input bytes.
+func AppendPush(b []byte, n int) []byte {
+	return appendPrefix(b, '>', int64(n))
+}
+
+// AppendAttribute appends a RESP3 attribute header of n key/value pairs to
+// the input bytes.
+func AppendAttribute(b []byte, n int) []byte {
+	return appendPrefix(b, '|', int64(n))
+}
+
+// AppendDouble appends a RESP3 double to the input bytes.
+func AppendDouble(b []byte, f float64) []byte {
+	b = append(b, ',')
+	switch {
+	case math.IsInf(f, 1):
+		b = append(b, "inf"...)
+	case math.IsInf(f, -1):
+		b = append(b, "-inf"...)
+	case math.IsNaN(f):
+		b = append(b, "nan"...)
+	default:
+		b = strconv.AppendFloat(b, f, 'f', -1, 64)
+	}
+	return append(b, '\r', '\n')
+}
+
+// AppendBool appends a RESP3 boolean to the input bytes.
+func AppendBool(b []byte, t bool) []byte {
+	if t {
+		return append(b, '#', 't', '\r', '\n')
+	}
+	return append(b, '#', 'f', '\r', '\n')
+}
+
+// AppendBigNumber appends a RESP3 big number to the input bytes. num is
+// the decimal representation of the number.
+func AppendBigNumber(b []byte, num string) []byte {
+	b = append(b, '(')
+	b = append(b, num...)
+	return append(b, '\r', '\n')
+}
+
+// AppendVerbatim appends a RESP3 verbatim string to the input bytes. format
+// is the three characters format of text, like "txt" or "mkd".
+func AppendVerbatim(b []byte, format, text string) []byte {
+	b = appendPrefix(b, '=', int64(len(format)+1+len(text)))
+	b = append(b, format...)
+	b = append(b, ':')
+	b = append(b, text...)
+	return append(b, '\r', '\n')
+}
+
 // AppendBulkFloat appends a float64, as bulk bytes.
 func AppendBulkFloat(dst []byte, f float64) []byte {
 	return AppendBulk(dst, strconv.AppendFloat(nil, f, 'f', -1, 64))
@@ -368,13 +438,31 @@ type SimpleInt int
 //   SimpleInt       -> integer
 //   everything-else -> bulk-string representation using fmt.Sprint()
 func AppendAny(b []byte, v interface{}) []byte {
+	return appendAny(b, v, false)
+}
+
+// AppendAnyRESP3 appends any type to valid RESP3 type. It is AppendAny with
+// the RESP3 types where they exist.
+//   nil             -> null
+//   bool            -> boolean
+//   float32/float64 -> double
+//   map             -> map
+func AppendAnyRESP3(b []byte, v interface{}) []byte {
+	return appendAny(b, v, true)
+}
+
+func appendAny(b []byte, v interface{}, resp3 bool) []byte {
 	switch v := v.(type) {
 	case SimpleString:
 		b = AppendString(b, string(v))
 	case SimpleInt:
 		b = AppendInt(b, int64(v))
 	case nil:
-		b = AppendNull(b)
+		if resp3 {
+			b = AppendNullRESP3(b)
+		} else {
+			b = AppendNull(b)
+		}
 	case error:
 		b = AppendError(b, prefixERRIfNeeded(v.Error()))
 
@@ -383,7 +471,9 @@ func AppendAny(b []byte, v interface{}) []byte {
 	case []byte:
 		b = AppendBulk(b, v)
 	case bool:
-		if v {
+		if resp3 {
+			b = AppendBool(b, v)
+		} else if v {
 			b = AppendBulkString(b, "1")
 		} else {
 			b = AppendBulkString(b, "0")
@@ -409,9 +499,17 @@ func AppendAny(b []byte, v interface{}) []byte {
 	case uint64:
 		b = AppendBulkUint(b, uint64(v))
 	case float32:
-		b = AppendBulkFloat(b, float64(v))
+		if resp3 {
+			b = AppendDouble(b, float64(v))
+		} else {
+			b = AppendBulkFloat(b, float64(v))
+		}
 	case float64:
-		b = AppendBulkFloat(b, float64(v))
+		if resp3 {
+			b = AppendDouble(b, v)
+		} else {
+			b = AppendBulkFloat(b, v)
+		}
 	default:
 		vv := reflect.ValueOf(v)
 		switch vv.Kind() {
@@ -419,11 +517,15 @@ func AppendAny(b []byte, v interface{}) []byte {
 			n := vv.Len()
 			b = AppendArray(b, n)
 			for i := 0; i < n; i++ {
-				b = AppendAny(b, vv.Index(i).Interface())
+				b = appendAny(b, vv.Index(i).Interface(), resp3)
 			}
 		case reflect.Map:
 			n := vv.Len()
-			b = AppendArray(b, n*2)
+			if resp3 {
+				b = AppendMap(b, n)
+			} else {
+				b = AppendArray(b, n*2)
+			}
 			var i int
 			var strKey bool
 			var strsKeyItems []strKeyItem
@@ -442,8 +544,8 @@ func AppendAny(b []byte, v interface{}) []byte {
 						key.(string), iter.Value().Interface(),
 					}
 				} else {
-					b = AppendAny(b, key)
-					b = AppendAny(b, iter.Value().Interface())
+					b = appendAny(b, key, resp3)
+					b = appendAny(b, iter.Value().Interface(), resp3)
 				}
 				i++
 			}
@@ -453,7 +555,7 @@ func AppendAny(b []byte, v interface{}) []byte {
 				})
 				for _, item := range strsKeyItems {
 					b = AppendBulkString(b, item.key)
-					b = AppendAny(b, item.value)
+					b = appendAny(b, item.value, resp3)
 				}
 			}
 		default:
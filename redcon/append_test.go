@@ -2,6 +2,7 @@ package redcon
 
 import (
 	"bytes"
+	"math"
 	"math/rand"
 	"testing"
 	"time"
@@ -125,3 +126,60 @@ func TestAppendBulkUint(t *testing.T) {
 		t.Fatalf("expected '%s', got '%s'", exp, b)
 	}
 }
+
+func TestAppendRESP3(t *testing.T) {
+	var b []byte
+	b = AppendMap(b, 1)
+	b = AppendBulkString(b, "pi")
+	b = AppendDouble(b, 3.14)
+	b = AppendSet(b, 2)
+	b = AppendBool(b, true)
+	b = AppendBool(b, false)
+	b = AppendPush(b, 1)
+	b = AppendBigNumber(b, "-1234567890123456789012345678901234567890")
+	b = AppendAttribute(b, 0)
+	b = AppendVerbatim(b, "txt", "Some string")
+	b = AppendNullRESP3(b)
+	exp := "%1\r\n$2\r\npi\r\n,3.14\r\n~2\r\n#t\r\n#f\r\n" +
+		">1\r\n(-1234567890123456789012345678901234567890\r\n" +
+		"|0\r\n=15\r\ntxt:Some string\r\n_\r\n"
+	if string(b) != exp {
+		t.Fatalf("expected '%s', got '%s'", exp, b)
+	}
+}
+
+func TestAppendDouble(t *testing.T) {
+	for _, tc := range []struct {
+		f   float64
+		exp string
+	}{
+		{1.5, ",1.5\r\n"},
+		{-10, ",-10\r\n"},
+		{math.Inf(1), ",inf\r\n"},
+		{math.Inf(-1), ",-inf\r\n"},
+		{math.NaN(), ",nan\r\n"},
+	} {
+		if b := AppendDouble(nil, tc.f); string(b) != tc.exp {
+			t.Fatalf("expected '%s', got '%s'", tc.exp, b)
+		}
+	}
+}
+
+func TestAppendAnyRESP3(t *testing.T) {
+	v := map[string]interface{}{
+		"b": true,
+		"a": 1.5,
+		"c": nil,
+		"d": []interface{}{"x", false},
+	}
+	exp := "%4\r\n$1\r\na\r\n,1.5\r\n$1\r\nb\r\n#t\r\n$1\r\nc\r\n_\r\n" +
+		"$1\r\nd\r\n*2\r\n$1\r\nx\r\n#f\r\n"
+	if b := AppendAnyRESP3(nil, v); string(b) != exp {
+		t.Fatalf("expected '%s', got '%s'", exp, b)
+	}
+	exp = "*8\r\n$1\r\na\r\n$3\r\n1.5\r\n$1\r\nb\r\n$1\r\n1\r\n$1\r\nc\r\n$-1\r\n" +
+		"$1\r\nd\r\n*2\r\n$1\r\nx\r\n$1\r\n0\r\n"
+	if b := AppendAny(nil, v); string(b) != exp {
+		t.Fatalf("expected '%s', got '%s'", exp, b)
+	}
+}
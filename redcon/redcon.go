@@ -3,21 +3,29 @@ package redcon
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// ErrDetached is the error passed to the closed callback of the server for
+// a connection detached from it. The connection is not closed.
+var ErrDetached = errors.New("detached")
+
 var (
 	errUnbalancedQuotes       = &errProtocol{"unbalanced quotes in request"}
 	errInvalidBulkLength      = &errProtocol{"invalid bulk length"}
 	errInvalidMultiBulkLength = &errProtocol{"invalid multibulk length"}
-	errDetached               = errors.New("detached")
 	errIncompleteCommand      = errors.New("incomplete command")
 	errTooMuchData            = errors.New("too much data")
+	errQueryBufferLimit       = errors.New("max query buffer length reached")
+	errShutdown               = errors.New("server shutdown")
 )
 
 type errProtocol struct {
@@ -73,6 +81,33 @@ type Conn interface {
 	//   SimpleInt       -> integer
 	//   everything-else -> bulk-string representation using fmt.Sprint()
 	WriteAny(any interface{})
+	// WriteMap writes a map header of count key/value pairs. You must then
+	// write the keys and values. A RESP2 client gets an array.
+	WriteMap(count int)
+	// WriteSet writes a set header. A RESP2 client gets an array.
+	WriteSet(count int)
+	// WritePush writes a push header, for out of band data like pub/sub
+	// messages. A RESP2 client gets an array.
+	WritePush(count int)
+	// WriteAttribute writes an attribute header of count key/value pairs,
+	// which comes before a reply. Attributes only exist in RESP3, so check
+	// Protocol first: a RESP2 client gets an array.
+	WriteAttribute(count int)
+	// WriteDouble writes a double. A RESP2 client gets a bulk-string.
+	WriteDouble(num float64)
+	// WriteBool writes a boolean. A RESP2 client gets an integer 1 or 0.
+	WriteBool(t bool)
+	// WriteBigNumber writes a big number from its decimal representation.
+	// A RESP2 client gets a bulk-string.
+	WriteBigNumber(num string)
+	// WriteVerbatim writes a verbatim string of a three characters format,
+	// like "txt". A RESP2 client gets a bulk-string.
+	WriteVerbatim(format, text string)
+	// Protocol returns the RESP version of the client, 2 or 3.
+	Protocol() int
+	// SetProtocol sets the RESP version of the client, 2 or 3. Hello sets
+	// it when the client sends HELLO.
+	SetProtocol(proto int)
 	// Context returns a user-defined context
 	Context() interface{}
 	// SetContext sets a user-defined context
@@ -139,12 +174,13 @@ func NewServerNetwork(
 		panic("handler is nil")
 	}
 	s := &Server{
-		net:     net,
-		laddr:   laddr,
-		handler: handler,
-		accept:  accept,
-		closed:  closed,
-		conns:   make(map[*conn]bool),
+		net:      net,
+		laddr:    laddr,
+		handler:  handler,
+		accept:   accept,
+		closed:   closed,
+		conns:    make(map[*conn]bool),
+		detached: make(map[*conn]bool),
 	}
 	return s
 }
@@ -162,12 +198,13 @@ func NewServerNetworkTLS(
 		panic("handler is nil")
 	}
 	s := Server{
-		net:     net,
-		laddr:   laddr,
-		handler: handler,
-		accept:  accept,
-		closed:  closed,
-		conns:   make(map[*conn]bool),
+		net:      net,
+		laddr:    laddr,
+		handler:  handler,
+		accept:   accept,
+		closed:   closed,
+		conns:    make(map[*conn]bool),
+		detached: make(map[*conn]bool),
 	}
 
 	tls := &TLSServer{
@@ -189,6 +226,56 @@ func (s *Server) Close() error {
 	return s.ln.Close()
 }
 
+// Shutdown stops listening and closes the connections once they are done
+// with the commands they have read: a connection running a pipeline is
+// closed once its replies are flushed, an idle connection right away. The
+// clients are sent ShutdownError first, when set. Shutdown waits for the
+// connections to close until ctx is done, then closes the connections left
+// and returns the error of ctx. Detached connections are left to their
+// owner until then, and closed with the others.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.ln == nil {
+		s.mu.Unlock()
+		return errors.New("not serving")
+	}
+	s.done = true
+	s.shutdown = true
+	err := s.ln.Close()
+	for c := range s.conns {
+		// wake the connections waiting for commands, the others see the
+		// shutdown after their pipeline
+		c.rd.wake()
+	}
+	s.mu.Unlock()
+	closed := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.conns {
+			c.conn.Close()
+		}
+		for c := range s.detached {
+			c.conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// shuttingDown reports whether Shutdown was called.
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
 // ListenAndServe serves incoming connections.
 func (s *Server) ListenAndServe() error {
 	return s.ListenServeAndSignal(nil)
@@ -223,13 +310,14 @@ func Serve(ln net.Listener,
 	closed func(conn Conn, err error),
 ) error {
 	s := &Server{
-		net:     ln.Addr().Network(),
-		laddr:   ln.Addr().String(),
-		ln:      ln,
-		handler: handler,
-		accept:  accept,
-		closed:  closed,
-		conns:   make(map[*conn]bool),
+		net:      ln.Addr().Network(),
+		laddr:    ln.Addr().String(),
+		ln:       ln,
+		handler:  handler,
+		accept:   accept,
+		closed:   closed,
+		conns:    make(map[*conn]bool),
+		detached: make(map[*conn]bool),
 	}
 
 	return serve(s)
@@ -325,6 +413,10 @@ func serve(s *Server) error {
 		func() {
 			s.mu.Lock()
 			defer s.mu.Unlock()
+			if s.shutdown {
+				// Shutdown closes the connections
+				return
+			}
 			for c := range s.conns {
 				c.Close()
 			}
@@ -345,13 +437,25 @@ func serve(s *Server) error {
 			}
 			continue
 		}
-		c := &conn{
-			conn: lnconn,
-			addr: lnconn.RemoteAddr().String(),
-			wr:   NewWriter(lnconn),
-			rd:   NewReader(lnconn),
-		}
 		s.mu.Lock()
+		if s.done {
+			// accepted while closing
+			s.mu.Unlock()
+			lnconn.Close()
+			continue
+		}
+		if s.MaxClients > 0 && s.clients >= s.MaxClients {
+			s.mu.Unlock()
+			if s.WriteTimeout > 0 {
+				lnconn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+			}
+			lnconn.Write([]byte("-ERR max number of clients reached\r\n"))
+			lnconn.Close()
+			continue
+		}
+		c := newConn(s, lnconn)
+		s.clients++
+		s.wg.Add(1)
 		s.conns[c] = true
 		s.mu.Unlock()
 		if s.accept != nil && !s.accept(c) {
@@ -359,6 +463,7 @@ func serve(s *Server) error {
 			delete(s.conns, c)
 			s.mu.Unlock()
 			c.Close()
+			c.release()
 			continue
 		}
 		go handle(s, c)
@@ -369,15 +474,19 @@ func serve(s *Server) error {
 func handle(s *Server, c *conn) {
 	var err error
 	defer func() {
-		if err != errDetached {
+		if err != ErrDetached {
 			// do not close the connection when a detach is detected.
 			c.conn.Close()
+			c.release()
 		}
 		func() {
 			// remove the conn from the server
 			s.mu.Lock()
 			defer s.mu.Unlock()
 			delete(s.conns, c)
+			if err == ErrDetached && s.detached != nil {
+				s.detached[c] = true
+			}
 			if s.closed != nil {
 				if err == io.EOF {
 					err = nil
@@ -390,18 +499,24 @@ func handle(s *Server, c *conn) {
 	err = func() error {
 		// read commands and feed back to the client
 		for {
-			// read pipeline commands
-			cmds, err := c.rd.readCommands(nil)
-			if err != nil {
-				if err, ok := err.(*errProtocol); ok {
-					// All protocol errors should attempt a response to
-					// the client. Ignore write errors.
-					c.wr.WriteError("ERR " + err.Error())
-					c.wr.Flush()
+			// read pipeline commands, unless a reattached connection
+			// brought some back
+			if len(c.cmds) == 0 {
+				cmds, err := c.rd.readCommands(nil)
+				if err != nil {
+					if s.shuttingDown() {
+						return c.shutdown()
+					}
+					if err, ok := err.(*errProtocol); ok {
+						// All protocol errors should attempt a response to
+						// the client. Ignore write errors.
+						c.wr.WriteError("ERR " + err.Error())
+						c.flush()
+					}
+					return err
 				}
-				return err
+				c.cmds = cmds
 			}
-			c.cmds = cmds
 			for len(c.cmds) > 0 {
 				cmd := c.cmds[0]
 				if len(c.cmds) == 1 {
@@ -409,18 +524,25 @@ func handle(s *Server, c *conn) {
 				} else {
 					c.cmds = c.cmds[1:]
 				}
+				if s.HelloMode != "" && isHello(cmd) {
+					Hello(c, cmd, s.HelloMode)
+					continue
+				}
 				s.handler(c, cmd)
 			}
 			if c.detached {
 				// client has been detached
-				return errDetached
+				return ErrDetached
 			}
 			if c.closed {
 				return nil
 			}
-			if err := c.wr.Flush(); err != nil {
+			if err := c.flush(); err != nil {
 				return err
 			}
+			if s.shuttingDown() {
+				return c.shutdown()
+			}
 		}
 	}()
 }
@@ -435,11 +557,70 @@ type conn struct {
 	detached bool
 	closed   bool
 	cmds     []Command
+
+	server       *Server
+	writeTimeout time.Duration
+	once         sync.Once
+}
+
+// newConn returns a client connection of the server, with the limits of
+// the server.
+func newConn(s *Server, lnconn net.Conn) *conn {
+	c := &conn{
+		conn:         lnconn,
+		addr:         lnconn.RemoteAddr().String(),
+		wr:           NewWriter(lnconn),
+		rd:           NewReader(lnconn),
+		server:       s,
+		writeTimeout: s.WriteTimeout,
+	}
+	c.rd.conn = lnconn
+	c.rd.maxBulkLen = s.MaxBulkLen
+	c.rd.maxMultiBulkLen = s.MaxMultiBulkLen
+	c.rd.maxQueryBuffer = s.MaxQueryBuffer
+	c.rd.idleTimeout = s.IdleTimeout
+	c.rd.readTimeout = s.ReadTimeout
+	return c
+}
+
+// release removes the closed connection from the clients of the server.
+func (c *conn) release() {
+	if c.server == nil {
+		return
+	}
+	c.once.Do(func() {
+		c.server.mu.Lock()
+		c.server.clients--
+		delete(c.server.detached, c)
+		c.server.mu.Unlock()
+		c.server.wg.Done()
+	})
+}
+
+// flush writes the pending replies to the client, within the write timeout.
+func (c *conn) flush() error {
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.wr.Flush()
+}
+
+// shutdown sends the shutdown error of the server to the client, if any.
+func (c *conn) shutdown() error {
+	if msg := c.server.ShutdownError; msg != "" {
+		c.wr.WriteError(msg)
+		c.flush()
+	}
+	return errShutdown
 }
 
 func (c *conn) Close() error {
-	c.wr.Flush()
+	c.flush()
 	c.closed = true
+	if c.detached {
+		// the server no longer manages the connection
+		defer c.release()
+	}
 	return c.conn.Close()
 }
 func (c *conn) Context() interface{}        { return c.ctx }
@@ -456,7 +637,19 @@ func (c *conn) WriteArray(count int)        { c.wr.WriteArray(count) }
 func (c *conn) WriteNull()                  { c.wr.WriteNull() }
 func (c *conn) WriteRaw(data []byte)        { c.wr.WriteRaw(data) }
 func (c *conn) WriteAny(v interface{})      { c.wr.WriteAny(v) }
+func (c *conn) WriteMap(count int)          { c.wr.WriteMap(count) }
+func (c *conn) WriteSet(count int)          { c.wr.WriteSet(count) }
+func (c *conn) WritePush(count int)         { c.wr.WritePush(count) }
+func (c *conn) WriteAttribute(count int)    { c.wr.WriteAttribute(count) }
+func (c *conn) WriteDouble(num float64)     { c.wr.WriteDouble(num) }
+func (c *conn) WriteBool(t bool)            { c.wr.WriteBool(t) }
+func (c *conn) WriteBigNumber(num string)   { c.wr.WriteBigNumber(num) }
+func (c *conn) Protocol() int               { return c.wr.Protocol() }
+func (c *conn) SetProtocol(proto int)       { c.wr.SetProtocol(proto) }
 func (c *conn) RemoteAddr() string          { return c.addr }
+func (c *conn) WriteVerbatim(format, text string) {
+	c.wr.WriteVerbatim(format, text)
+}
 func (c *conn) ReadPipeline() []Command {
 	cmds := c.cmds
 	c.cmds = nil
@@ -485,6 +678,16 @@ type DetachedConn interface {
 	ReadCommand() (Command, error)
 	// Flush flushes any writes to the network.
 	Flush() error
+	// Interrupt makes a ReadCommand waiting on the client, or the next one,
+	// return an error, so the connection can be reattached. The data
+	// received from the client is kept.
+	Interrupt()
+	// Reattach hands the connection back to the server, which serves cmds,
+	// commands read from the client and not run yet, then the rest of the
+	// commands of the client. ReadCommand must not be running. The
+	// connection must not be used after, unless the server is closed:
+	// Reattach then returns an error and the connection is to be closed.
+	Reattach(cmds []Command) error
 }
 
 // Detach removes the current connection from the server loop and returns
@@ -492,8 +695,11 @@ type DetachedConn interface {
 // The detached connection must be closed by calling Close() when done.
 // All writes such as WriteString() will not be written to the client
 // until Flush() is called.
+// A detached connection is not closed by the idle timeout of the server, it
+// may be waiting on a subscription or a blocking operation.
 func (c *conn) Detach() DetachedConn {
 	c.detached = true
+	c.rd.idleTimeout = 0
 	cmds := c.cmds
 	c.cmds = nil
 	return &detachedConn{conn: c, cmds: cmds}
@@ -506,7 +712,37 @@ type detachedConn struct {
 
 // Flush writes and Write* calls to the client.
 func (dc *detachedConn) Flush() error {
-	return dc.conn.wr.Flush()
+	return dc.conn.flush()
+}
+
+// Interrupt makes the pending and next reads fail.
+func (dc *detachedConn) Interrupt() {
+	dc.rd.wake()
+}
+
+// Reattach serves the connection with the server again.
+func (dc *detachedConn) Reattach(cmds []Command) error {
+	c, s := dc.conn, dc.server
+	if s == nil {
+		return errors.New("not a server connection")
+	}
+	c.rd.unwake()
+	// the commands read by the caller come before those it did not read
+	cmds = append(append(cmds, dc.cmds...), c.rd.cmds...)
+	dc.cmds, c.rd.cmds = nil, nil
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return errors.New("server closed")
+	}
+	s.conns[c] = true
+	delete(s.detached, c)
+	s.mu.Unlock()
+	c.detached = false
+	c.rd.idleTimeout = s.IdleTimeout
+	c.cmds = cmds
+	go handle(s, c)
+	return nil
 }
 
 // ReadCommand read the next command from the client.
@@ -537,18 +773,52 @@ type Command struct {
 
 // Server defines a server for clients for managing client connections.
 type Server struct {
-	mu      sync.Mutex
-	net     string
-	laddr   string
-	handler func(conn Conn, cmd Command)
-	accept  func(conn Conn) bool
-	closed  func(conn Conn, err error)
-	conns   map[*conn]bool
-	ln      net.Listener
-	done    bool
+	mu       sync.Mutex
+	net      string
+	laddr    string
+	handler  func(conn Conn, cmd Command)
+	accept   func(conn Conn) bool
+	closed   func(conn Conn, err error)
+	conns    map[*conn]bool
+	detached map[*conn]bool
+	clients  int // the connections, with the detached ones
+	// wg waits for the connections, with the detached ones, to close
+	wg       sync.WaitGroup
+	ln       net.Listener
+	done     bool
+	shutdown bool
 
 	// AcceptError is an optional function used to handle Accept errors.
 	AcceptError func(err error)
+
+	// The limits below are set before serving, zero means no limit.
+
+	// MaxClients is the maximum number of connected clients, detached ones
+	// included. Other clients are sent an error and closed.
+	MaxClients int
+	// MaxBulkLen is the maximum length of a bulk string of a command.
+	MaxBulkLen int
+	// MaxMultiBulkLen is the maximum number of arguments of a command.
+	MaxMultiBulkLen int
+	// MaxQueryBuffer is the maximum number of bytes buffered for an
+	// incomplete command. A client going over it is closed.
+	MaxQueryBuffer int
+	// IdleTimeout closes the clients that send no command for that long.
+	IdleTimeout time.Duration
+	// ReadTimeout closes the clients that take longer to send the rest of a
+	// command once they started it.
+	ReadTimeout time.Duration
+	// WriteTimeout closes the clients that take longer to receive replies.
+	WriteTimeout time.Duration
+
+	// ShutdownError is the error sent to the clients closed by Shutdown,
+	// like "ERR server shutting down". Nothing is sent when it is empty.
+	ShutdownError string
+
+	// HelloMode makes the server answer HELLO itself with Hello, reporting
+	// the mode, "standalone" or "cluster". When it is empty the handler
+	// receives HELLO like any other command.
+	HelloMode string
 }
 
 // TLSServer defines a server for clients for managing client connections.
@@ -557,10 +827,13 @@ type TLSServer struct {
 	config *tls.Config
 }
 
-// Writer allows for writing RESP messages.
+// Writer allows for writing RESP messages. It writes RESP2 until the
+// protocol is set to 3, the RESP3 types are then written as such instead
+// of their RESP2 counterparts.
 type Writer struct {
-	w io.Writer
-	b []byte
+	w     io.Writer
+	b     []byte
+	resp3 bool
 }
 
 // NewWriter creates a new RESP writer.
@@ -570,8 +843,25 @@ func NewWriter(wr io.Writer) *Writer {
 	}
 }
 
+// Protocol returns the RESP version written, 2 or 3.
+func (w *Writer) Protocol() int {
+	if w.resp3 {
+		return 3
+	}
+	return 2
+}
+
+// SetProtocol sets the RESP version written, 2 or 3.
+func (w *Writer) SetProtocol(proto int) {
+	w.resp3 = proto == 3
+}
+
 // WriteNull writes a null to the client
 func (w *Writer) WriteNull() {
+	if w.resp3 {
+		w.b = AppendNullRESP3(w.b)
+		return
+	}
 	w.b = AppendNull(w.b)
 }
 
@@ -660,9 +950,91 @@ func (w *Writer) WriteRaw(data []byte) {
 //   SimpleInt       -> integer
 //   everything-else -> bulk-string representation using fmt.Sprint()
 func (w *Writer) WriteAny(v interface{}) {
+	if w.resp3 {
+		w.b = AppendAnyRESP3(w.b, v)
+		return
+	}
 	w.b = AppendAny(w.b, v)
 }
 
+// WriteMap writes a map header of count key/value pairs, or an array of
+// the keys and values in RESP2.
+func (w *Writer) WriteMap(count int) {
+	if w.resp3 {
+		w.b = AppendMap(w.b, count)
+		return
+	}
+	w.b = AppendArray(w.b, count*2)
+}
+
+// WriteSet writes a set header, or an array header in RESP2.
+func (w *Writer) WriteSet(count int) {
+	if w.resp3 {
+		w.b = AppendSet(w.b, count)
+		return
+	}
+	w.b = AppendArray(w.b, count)
+}
+
+// WritePush writes a push header, or an array header in RESP2.
+func (w *Writer) WritePush(count int) {
+	if w.resp3 {
+		w.b = AppendPush(w.b, count)
+		return
+	}
+	w.b = AppendArray(w.b, count)
+}
+
+// WriteAttribute writes an attribute header of count key/value pairs, or
+// an array of the keys and values in RESP2.
+func (w *Writer) WriteAttribute(count int) {
+	if w.resp3 {
+		w.b = AppendAttribute(w.b, count)
+		return
+	}
+	w.b = AppendArray(w.b, count*2)
+}
+
+// WriteDouble writes a double, or a bulk-string in RESP2.
+func (w *Writer) WriteDouble(num float64) {
+	if w.resp3 {
+		w.b = AppendDouble(w.b, num)
+		return
+	}
+	w.b = AppendBulkFloat(w.b, num)
+}
+
+// WriteBool writes a boolean, or an integer 1 or 0 in RESP2.
+func (w *Writer) WriteBool(t bool) {
+	switch {
+	case w.resp3:
+		w.b = AppendBool(w.b, t)
+	case t:
+		w.b = AppendInt(w.b, 1)
+	default:
+		w.b = AppendInt(w.b, 0)
+	}
+}
+
+// WriteBigNumber writes a big number, or a bulk-string in RESP2.
+func (w *Writer) WriteBigNumber(num string) {
+	if w.resp3 {
+		w.b = AppendBigNumber(w.b, num)
+		return
+	}
+	w.b = AppendBulkString(w.b, num)
+}
+
+// WriteVerbatim writes a verbatim string, or a bulk-string of text in
+// RESP2.
+func (w *Writer) WriteVerbatim(format, text string) {
+	if w.resp3 {
+		w.b = AppendVerbatim(w.b, format, text)
+		return
+	}
+	w.b = AppendBulkString(w.b, text)
+}
+
 // Reader represent a reader for RESP or telnet commands.
 type Reader struct {
 	rd    *bufio.Reader
@@ -670,6 +1042,18 @@ type Reader struct {
 	start int
 	end   int
 	cmds  []Command
+
+	// the limits of a server connection
+	conn            net.Conn
+	maxBulkLen      int
+	maxMultiBulkLen int
+	maxQueryBuffer  int
+	idleTimeout     time.Duration
+	readTimeout     time.Duration
+
+	// woken makes the reads fail, until unwake
+	mu    sync.Mutex
+	woken bool
 }
 
 // NewReader returns a command reader which will read RESP or telnet commands.
@@ -816,7 +1200,8 @@ func (rd *Reader) readCommands(leftover *int) ([]Command, error) {
 						return nil, errInvalidMultiBulkLength
 					}
 					count, ok := parseInt(b[1 : i-1])
-					if !ok || count <= 0 {
+					if !ok || count <= 0 ||
+						(rd.maxMultiBulkLen > 0 && count > rd.maxMultiBulkLen) {
 						return nil, errInvalidMultiBulkLength
 					}
 					marks = marks[:0]
@@ -835,7 +1220,8 @@ func (rd *Reader) readCommands(leftover *int) ([]Command, error) {
 										return nil, errInvalidBulkLength
 									}
 									size, ok := parseInt(b[si+1 : i-1])
-									if !ok || size < 0 {
+									if !ok || size < 0 ||
+										(rd.maxBulkLen > 0 && size > rd.maxBulkLen) {
 										return nil, errInvalidBulkLength
 									}
 									if i+size+2 >= len(b) {
@@ -893,11 +1279,20 @@ func (rd *Reader) readCommands(leftover *int) ([]Command, error) {
 	if rd.rd == nil {
 		return nil, errIncompleteCommand
 	}
+	if rd.maxQueryBuffer > 0 && rd.end-rd.start >= rd.maxQueryBuffer {
+		// too much for an incomplete command
+		return nil, errQueryBufferLimit
+	}
 	if rd.end == len(rd.buf) {
 		// at the end of the buffer.
 		if rd.start == rd.end {
 			// rewind the to the beginning
 			rd.start, rd.end = 0, 0
+		} else if rd.start > 0 {
+			// move the incomplete command to the beginning, the commands
+			// returned are copies
+			rd.end = copy(rd.buf, rd.buf[rd.start:rd.end])
+			rd.start = 0
 		} else {
 			// must grow the buffer
 			newbuf := make([]byte, len(rd.buf)*2)
@@ -905,6 +1300,7 @@ func (rd *Reader) readCommands(leftover *int) ([]Command, error) {
 			rd.buf = newbuf
 		}
 	}
+	rd.setDeadline()
 	n, err := rd.rd.Read(rd.buf[rd.end:])
 	if err != nil {
 		return nil, err
@@ -913,6 +1309,49 @@ func (rd *Reader) readCommands(leftover *int) ([]Command, error) {
 	return rd.readCommands(leftover)
 }
 
+// setDeadline sets the deadline of the next read of a server connection:
+// the idle timeout between commands, the read timeout within a command.
+func (rd *Reader) setDeadline() {
+	if rd.conn == nil {
+		return
+	}
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.woken {
+		rd.conn.SetReadDeadline(time.Unix(1, 0))
+		return
+	}
+	if rd.idleTimeout == 0 && rd.readTimeout == 0 {
+		return
+	}
+	timeout := rd.idleTimeout
+	if rd.end > rd.start {
+		timeout = rd.readTimeout
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	rd.conn.SetReadDeadline(deadline)
+}
+
+// wake makes the pending read of a server connection, and the next ones,
+// fail with a timeout. It is safe to call while the connection is read.
+func (rd *Reader) wake() {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.woken = true
+	rd.conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// unwake lets the connection be read again after wake.
+func (rd *Reader) unwake() {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.woken = false
+	rd.conn.SetReadDeadline(time.Time{})
+}
+
 // ReadCommand reads the next command.
 func (rd *Reader) ReadCommand() (Command, error) {
 	if len(rd.cmds) > 0 {
@@ -943,6 +1382,63 @@ func Parse(raw []byte) (Command, error) {
 
 }
 
+// isHello reports whether cmd is a HELLO command.
+func isHello(cmd Command) bool {
+	return len(cmd.Args) > 0 && strings.EqualFold(string(cmd.Args[0]), "hello")
+}
+
+// Hello answers a HELLO command, switching the connection to the requested
+// protocol version. The reply reports mode, "standalone" or "cluster".
+func Hello(conn Conn, cmd Command, mode string) {
+	args := cmd.Args[1:]
+	proto := conn.Protocol()
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			conn.WriteError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != 2 && v != 3 {
+			conn.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+		args = args[1:]
+	}
+	for len(args) > 0 {
+		switch strings.ToLower(string(args[0])) {
+		case "auth":
+			if len(args) < 3 {
+				conn.WriteError("ERR Syntax error in HELLO option 'auth'")
+				return
+			}
+			conn.WriteError("ERR AUTH is not supported by this server")
+			return
+		case "setname":
+			if len(args) < 2 {
+				conn.WriteError("ERR Syntax error in HELLO option 'setname'")
+				return
+			}
+			args = args[2:]
+		default:
+			conn.WriteError("ERR Syntax error in HELLO option '" + string(args[0]) + "'")
+			return
+		}
+	}
+	conn.SetProtocol(proto)
+	conn.WriteMap(5)
+	conn.WriteBulkString("server")
+	conn.WriteBulkString("redcon")
+	conn.WriteBulkString("proto")
+	conn.WriteInt(proto)
+	conn.WriteBulkString("mode")
+	conn.WriteBulkString(mode)
+	conn.WriteBulkString("role")
+	conn.WriteBulkString("master")
+	conn.WriteBulkString("modules")
+	conn.WriteArray(0)
+}
+
 // A Handler responds to an RESP request.
 type Handler interface {
 	ServeRESP(conn Conn, cmd Command)
@@ -959,9 +1455,55 @@ func (f HandlerFunc) ServeRESP(conn Conn, cmd Command) {
 	f(conn, cmd)
 }
 
+// Middleware wraps a handler, to run code before and after it, or instead
+// of it. A middleware that does not call next writes the reply itself.
+type Middleware func(next Handler) Handler
+
+// Hook returns a middleware calling before ahead of the handler and after
+// once the handler returns. The command is not run when before returns
+// false, before then writes the reply, like an error. after is given the
+// reply written, which is nil when it was flushed to the client already or
+// when the connection is not one of a Server. Either function can be nil.
+func Hook(before func(conn Conn, cmd Command) bool,
+	after func(conn Conn, cmd Command, reply []byte),
+) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(conn Conn, cmd Command) {
+			mark := replyMark(conn)
+			if before == nil || before(conn, cmd) {
+				next.ServeRESP(conn, cmd)
+			}
+			if after != nil {
+				after(conn, cmd, repliedSince(conn, mark))
+			}
+		})
+	}
+}
+
+// replyMark returns the length of the replies pending for conn, or -1 when
+// conn is not a connection of a Server.
+func replyMark(c Conn) int {
+	if c, ok := c.(*conn); ok && !c.detached && !c.closed {
+		return len(c.wr.b)
+	}
+	return -1
+}
+
+// repliedSince returns the replies written to conn since mark. It returns
+// nil when they were flushed, on Close or Detach.
+func repliedSince(c Conn, mark int) []byte {
+	sc, ok := c.(*conn)
+	if !ok || mark < 0 || sc.detached || sc.closed || len(sc.wr.b) < mark {
+		return nil
+	}
+	return sc.wr.b[mark:]
+}
+
 // ServeMux is an RESP command multiplexer.
 type ServeMux struct {
-	handlers map[string]Handler
+	handlers    map[string]Handler
+	middlewares []Middleware
+	handler     Handler // the dispatch wrapped by the middlewares
 }
 
 // NewServeMux allocates and returns a new ServeMux.
@@ -971,17 +1513,37 @@ func NewServeMux() *ServeMux {
 	}
 }
 
-// HandleFunc registers the handler function for the given command.
-func (m *ServeMux) HandleFunc(command string, handler func(conn Conn, cmd Command)) {
+// Use adds middlewares that wrap every command, the unknown ones included,
+// around the middlewares of the command. The first middleware added runs
+// first.
+func (m *ServeMux) Use(middlewares ...Middleware) {
+	m.middlewares = append(m.middlewares, middlewares...)
+	m.handler = chain(HandlerFunc(m.dispatch), m.middlewares)
+}
+
+// chain wraps handler by the middlewares, the first one outermost.
+func chain(handler Handler, middlewares []Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// HandleFunc registers the handler function for the given command,
+// wrapped by the middlewares.
+func (m *ServeMux) HandleFunc(command string, handler func(conn Conn, cmd Command),
+	middlewares ...Middleware,
+) {
 	if handler == nil {
 		panic("redcon: nil handler")
 	}
-	m.Handle(command, HandlerFunc(handler))
+	m.Handle(command, HandlerFunc(handler), middlewares...)
 }
 
-// Handle registers the handler for the given command.
+// Handle registers the handler for the given command, wrapped by the
+// middlewares. The first middleware runs first.
 // If a handler already exists for command, Handle panics.
-func (m *ServeMux) Handle(command string, handler Handler) {
+func (m *ServeMux) Handle(command string, handler Handler, middlewares ...Middleware) {
 	if command == "" {
 		panic("redcon: invalid command")
 	}
@@ -992,11 +1554,20 @@ func (m *ServeMux) Handle(command string, handler Handler) {
 		panic("redcon: multiple registrations for " + command)
 	}
 
-	m.handlers[command] = handler
+	m.handlers[command] = chain(handler, middlewares)
 }
 
-// ServeRESP dispatches the command to the handler.
+// ServeRESP dispatches the command to the handler, through the middlewares.
 func (m *ServeMux) ServeRESP(conn Conn, cmd Command) {
+	if m.handler != nil {
+		m.handler.ServeRESP(conn, cmd)
+		return
+	}
+	m.dispatch(conn, cmd)
+}
+
+// dispatch runs the handler of the command.
+func (m *ServeMux) dispatch(conn Conn, cmd Command) {
 	command := strings.ToLower(string(cmd.Args[0]))
 
 	if handler, ok := m.handlers[command]; ok {
@@ -2,6 +2,7 @@ package redcon
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -554,3 +556,514 @@ func TestParse(t *testing.T) {
 		t.Fatalf("expected '%v', got '%v'", "A", string(cmd.Args[0]))
 	}
 }
+
+func TestWriterRESP3(t *testing.T) {
+	buf := &bytes.Buffer{}
+	wr := NewWriter(buf)
+	write := func() {
+		wr.WriteMap(1)
+		wr.WriteBulkString("k")
+		wr.WriteSet(1)
+		wr.WriteDouble(1.5)
+		wr.WritePush(3)
+		wr.WriteBool(true)
+		wr.WriteBigNumber("12345678901234567890")
+		wr.WriteVerbatim("txt", "hi")
+		wr.WriteNull()
+		wr.Flush()
+	}
+	write()
+	exp := "*2\r\n$1\r\nk\r\n*1\r\n$3\r\n1.5\r\n*3\r\n:1\r\n" +
+		"$20\r\n12345678901234567890\r\n$2\r\nhi\r\n$-1\r\n"
+	if buf.String() != exp {
+		t.Fatalf("expected '%s', got '%s'", exp, buf.String())
+	}
+	buf.Reset()
+	wr.SetProtocol(3)
+	if wr.Protocol() != 3 {
+		t.Fatalf("expected protocol 3, got %d", wr.Protocol())
+	}
+	write()
+	exp = "%1\r\n$1\r\nk\r\n~1\r\n,1.5\r\n>3\r\n#t\r\n" +
+		"(12345678901234567890\r\n=6\r\ntxt:hi\r\n_\r\n"
+	if buf.String() != exp {
+		t.Fatalf("expected '%s', got '%s'", exp, buf.String())
+	}
+}
+
+func TestHello(t *testing.T) {
+	s := NewServer(":12346",
+		func(conn Conn, cmd Command) {
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "map":
+				conn.WriteAny(map[string]interface{}{"ok": true})
+			default:
+				conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+			}
+		}, nil, nil)
+	s.HelloMode = "cluster"
+	signal := make(chan error)
+	go s.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := net.Dial("tcp", ":12346")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	do := func(cmd string) string {
+		io.WriteString(c, cmd)
+		buf := make([]byte, 1024)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	if res := do("MAP\r\n"); res != "*2\r\n$2\r\nok\r\n$1\r\n1\r\n" {
+		t.Fatalf("expecting array, got '%v'", res)
+	}
+	if res := do("HELLO 4\r\n"); !strings.HasPrefix(res, "-NOPROTO") {
+		t.Fatalf("expecting NOPROTO, got '%v'", res)
+	}
+	res := do("HELLO 3\r\n")
+	if !strings.HasPrefix(res, "%5\r\n") || !strings.Contains(res, "$5\r\nproto\r\n:3\r\n") ||
+		!strings.Contains(res, "$4\r\nmode\r\n$7\r\ncluster\r\n") {
+		t.Fatalf("expecting map, got '%v'", res)
+	}
+	if res := do("MAP\r\n"); res != "%1\r\n$2\r\nok\r\n#t\r\n" {
+		t.Fatalf("expecting map, got '%v'", res)
+	}
+	if res := do("HELLO 2\r\n"); !strings.HasPrefix(res, "*10\r\n") {
+		t.Fatalf("expecting array, got '%v'", res)
+	}
+}
+
+func TestHelloHandler(t *testing.T) {
+	s := NewServer(":12354",
+		func(conn Conn, cmd Command) {
+			conn.WriteString("handled " + strings.ToLower(string(cmd.Args[0])))
+		}, nil, nil)
+	signal := make(chan error)
+	go s.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := net.Dial("tcp", ":12354")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "HELLO 3\r\n")
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := string(buf[:n]); res != "+handled hello\r\n" {
+		t.Fatalf("expecting the handler reply, got '%v'", res)
+	}
+}
+
+// listenLimits starts a server on addr with the limits set by limit.
+func listenLimits(t *testing.T, addr string, limit func(s *Server)) *Server {
+	s := NewServer(addr,
+		func(conn Conn, cmd Command) {
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "detach":
+				dconn := conn.Detach()
+				go func() {
+					defer dconn.Close()
+					dconn.WriteString("OK")
+					dconn.Flush()
+					dconn.ReadCommand()
+				}()
+			default:
+				conn.WriteString("PONG")
+			}
+		}, nil, nil)
+	limit(s)
+	signal := make(chan error)
+	go s.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// readAll reads what the server sends until it closes the connection, or
+// resets it when it did not read all the client sent.
+func readAll(t *testing.T, c net.Conn) string {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(c)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	return string(b)
+}
+
+func TestServerLimits(t *testing.T) {
+	s := listenLimits(t, ":12347", func(s *Server) {
+		s.MaxBulkLen = 4096
+		s.MaxMultiBulkLen = 10
+		s.MaxQueryBuffer = 1024
+	})
+	defer s.Close()
+	for _, tc := range []struct{ send, recv string }{
+		{"*1\r\n$4097\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"*11\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"*1\r\n$2000\r\n" + strings.Repeat("x", 1500), ""},
+		{strings.Repeat("x", 5000), ""},
+	} {
+		c, err := net.Dial("tcp", ":12347")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(c, tc.send)
+		if res := readAll(t, c); res != tc.recv {
+			t.Fatalf("expected %q, got %q", tc.recv, res)
+		}
+		c.Close()
+	}
+}
+
+func TestServerMaxClients(t *testing.T) {
+	s := listenLimits(t, ":12348", func(s *Server) {
+		s.MaxClients = 2
+	})
+	defer s.Close()
+	do := func(c net.Conn, cmd, expect string) {
+		io.WriteString(c, cmd)
+		buf := make([]byte, 64)
+		n, err := c.Read(buf)
+		if err != nil || string(buf[:n]) != expect {
+			t.Fatalf("expected %q, got %q %v", expect, buf[:n], err)
+		}
+	}
+	c1, err := net.Dial("tcp", ":12348")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	do(c1, "DETACH\r\n", "+OK\r\n")
+	c2, err := net.Dial("tcp", ":12348")
+	if err != nil {
+		t.Fatal(err)
+	}
+	do(c2, "PING\r\n", "+PONG\r\n")
+	// the detached client counts
+	c3, err := net.Dial("tcp", ":12348")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := readAll(t, c3); res != "-ERR max number of clients reached\r\n" {
+		t.Fatalf("expected max clients error, got %q", res)
+	}
+	c3.Close()
+	c2.Close()
+	time.Sleep(100 * time.Millisecond)
+	c4, err := net.Dial("tcp", ":12348")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c4.Close()
+	do(c4, "PING\r\n", "+PONG\r\n")
+}
+
+func TestServerTimeouts(t *testing.T) {
+	s := listenLimits(t, ":12349", func(s *Server) {
+		s.IdleTimeout = 200 * time.Millisecond
+		s.ReadTimeout = 100 * time.Millisecond
+	})
+	defer s.Close()
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ":12349")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	// an idle client is closed
+	c := dial()
+	start := time.Now()
+	io.WriteString(c, "PING\r\n")
+	if res := readAll(t, c); res != "+PONG\r\n" {
+		t.Fatalf("expected PONG, got %q", res)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("closed after %v, before the idle timeout", d)
+	}
+	c.Close()
+	// a client slow to send its command is closed sooner
+	c = dial()
+	start = time.Now()
+	io.WriteString(c, "*1\r\n$4\r\nPI")
+	if res := readAll(t, c); res != "" {
+		t.Fatalf("expected nothing, got %q", res)
+	}
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Fatalf("closed after %v, after the idle timeout", d)
+	}
+	c.Close()
+	// a detached client is not idle
+	c = dial()
+	defer c.Close()
+	io.WriteString(c, "DETACH\r\n")
+	buf := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "+OK\r\n" {
+		t.Fatalf("expected OK, got %q %v", buf[:n], err)
+	}
+	if _, err := c.Read(buf); err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("expected the client to stay connected, got %v", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	s := NewServer(":12350",
+		func(conn Conn, cmd Command) {
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "slow":
+				started <- struct{}{}
+				time.Sleep(200 * time.Millisecond)
+				conn.WriteString("OK")
+			default:
+				conn.WriteString("PONG")
+			}
+		}, nil, nil)
+	s.ShutdownError = "ERR server shutting down"
+	signal := make(chan error)
+	go s.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	idle, err := net.Dial("tcp", ":12350")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	busy, err := net.Dial("tcp", ":12350")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	io.WriteString(busy, "SLOW\r\nPING\r\n")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the pipeline in flight is answered before the shutdown error
+	if res := readAll(t, busy); res != "+OK\r\n+PONG\r\n-ERR server shutting down\r\n" {
+		t.Fatalf("expected the pipeline replies, got %q", res)
+	}
+	if res := readAll(t, idle); res != "-ERR server shutting down\r\n" {
+		t.Fatalf("expected the shutdown error, got %q", res)
+	}
+	if _, err := net.Dial("tcp", ":12350"); err == nil {
+		t.Fatal("expected the server to stop listening")
+	}
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	started := make(chan struct{}, 1)
+	s := NewServer(":12351",
+		func(conn Conn, cmd Command) {
+			started <- struct{}{}
+			time.Sleep(time.Second)
+			conn.WriteString("OK")
+		}, nil, nil)
+	signal := make(chan error)
+	go s.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", ":12351")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "SLOW\r\n")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if res := readAll(t, c); res != "" {
+		t.Fatalf("expected the connection closed, got %q", res)
+	}
+}
+
+func TestServerShutdownDetached(t *testing.T) {
+	detached := make(chan DetachedConn, 1)
+	s := NewServer(":12355",
+		func(conn Conn, cmd Command) {
+			// the detached connection is never closed by its owner
+			detached <- conn.Detach()
+		}, nil, nil)
+	signal := make(chan error)
+	go s.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", ":12355")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "DETACH\r\n")
+	<-detached
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected the shutdown to stop at the deadline, took %v", d)
+	}
+	if res := readAll(t, c); res != "" {
+		t.Fatalf("expected the connection closed, got %q", res)
+	}
+}
+
+func TestServeMuxMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(format string, args ...interface{}) {
+		mu.Lock()
+		calls = append(calls, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(conn Conn, cmd Command) {
+				record("%s>", name)
+				next.ServeRESP(conn, cmd)
+				record("<%s", name)
+			})
+		}
+	}
+	mux := NewServeMux()
+	mux.HandleFunc("ping", func(conn Conn, cmd Command) {
+		record("ping")
+		conn.WriteString("PONG")
+	})
+	mux.HandleFunc("set", func(conn Conn, cmd Command) {
+		record("set")
+		conn.WriteString("OK")
+	}, trace("cmd"), Hook(func(conn Conn, cmd Command) bool {
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'set' command")
+			return false
+		}
+		return true
+	}, nil))
+	mux.Use(trace("global"), Hook(nil, func(conn Conn, cmd Command, reply []byte) {
+		record("%s %q", cmd.Args[0], reply)
+	}))
+	s := NewServer(":12352", mux.ServeRESP, nil, nil)
+	signal := make(chan error)
+	go s.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := net.Dial("tcp", ":12352")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PING\r\nSET a\r\nSET a b\r\nGET a\r\n")
+	expect := "+PONG\r\n-ERR wrong number of arguments for 'set' command\r\n" +
+		"+OK\r\n-ERR unknown command 'get'\r\n"
+	buf := make([]byte, len(expect))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != expect {
+		t.Fatalf("expected %q, got %q %v", expect, buf, err)
+	}
+	mu.Lock()
+	res := strings.Join(calls, ",")
+	mu.Unlock()
+	exp := `global>,ping,PING "+PONG\r\n",<global,` +
+		`global>,cmd>,<cmd,SET "-ERR wrong number of arguments for 'set' command\r\n",<global,` +
+		`global>,cmd>,set,<cmd,SET "+OK\r\n",<global,` +
+		`global>,GET "-ERR unknown command 'get'\r\n",<global`
+	if res != exp {
+		t.Fatalf("expected %s, got %s", exp, res)
+	}
+}
+
+func TestReattach(t *testing.T) {
+	s := NewServer(":12353",
+		func(conn Conn, cmd Command) {
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "block":
+				dconn := conn.Detach()
+				go func() {
+					// read ahead while blocked, like a proxy watching for
+					// the client to disconnect
+					var cmds []Command
+					read := make(chan struct{})
+					go func() {
+						defer close(read)
+						for {
+							cmd, err := dconn.ReadCommand()
+							if err != nil {
+								return
+							}
+							cmds = append(cmds, cmd)
+						}
+					}()
+					time.Sleep(100 * time.Millisecond)
+					dconn.WriteString("OK")
+					dconn.Flush()
+					dconn.Interrupt()
+					<-read
+					if err := dconn.Reattach(cmds); err != nil {
+						dconn.Close()
+					}
+				}()
+			default:
+				conn.WriteBulk(cmd.Args[len(cmd.Args)-1])
+			}
+		}, nil, nil)
+	signal := make(chan error)
+	go s.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := net.Dial("tcp", ":12353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "BLOCK\r\nECHO 1\r\n")
+	time.Sleep(50 * time.Millisecond)
+	io.WriteString(c, "ECHO 2\r\nECHO 3\r\n*2\r\n$4\r\nECHO\r\n$1\r")
+	time.Sleep(100 * time.Millisecond)
+	io.WriteString(c, "\n4\r\n")
+	expect := "+OK\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n$1\r\n4\r\n"
+	buf := make([]byte, len(expect))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != expect {
+		t.Fatalf("expected %q, got %q %v", expect, buf, err)
+	}
+	// the connection is served by the server again, Shutdown closes it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if res := readAll(t, c); res != "" {
+		t.Fatalf("expected the connection closed, got %q", res)
+	}
+}
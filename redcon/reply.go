@@ -0,0 +1,183 @@
+package redcon
+
+import (
+	"bytes"
+	"io"
+)
+
+var errInvalidReply = &errProtocol{"invalid reply"}
+
+// ReplyReader reads the replies of a server, RESP2 or RESP3, from a
+// stream. The reply being read is parsed as its bytes arrive, and the parse
+// resumes where it stopped after each read.
+type ReplyReader struct {
+	rd    io.Reader
+	buf   []byte
+	start int
+	end   int
+
+	// pos is the length of the reply at start parsed so far, and open are
+	// the aggregates open at pos
+	pos  int
+	open []aggregate
+}
+
+// aggregate is an aggregate being parsed, with the number of elements left.
+// An attribute is not an element itself, it annotates the next one.
+type aggregate struct {
+	left int
+	attr bool
+}
+
+// NewReplyReader returns a reader of the replies in rd.
+func NewReplyReader(rd io.Reader) *ReplyReader {
+	return &ReplyReader{
+		rd:  rd,
+		buf: make([]byte, 4096),
+	}
+}
+
+// ReadReply reads the next complete reply, with all its nested elements.
+// The reply refers to the buffer of the reader, so its Raw bytes can be
+// passed on as is, and it is only valid until the next call.
+func (r *ReplyReader) ReadReply() (RESP, error) {
+	if r.start == r.end {
+		r.start, r.end = 0, 0
+	}
+	for {
+		done, err := r.scan()
+		if err != nil {
+			return RESP{}, err
+		}
+		if done {
+			resp := completeReply(r.buf[r.start : r.start+r.pos])
+			r.start += r.pos
+			r.pos = 0
+			return resp, nil
+		}
+		if r.end == len(r.buf) {
+			if r.start > 0 {
+				// make room at the end of the buffer
+				r.end = copy(r.buf, r.buf[r.start:r.end])
+				r.start = 0
+			} else {
+				buf := make([]byte, len(r.buf)*2)
+				copy(buf, r.buf[:r.end])
+				r.buf = buf
+			}
+		}
+		n, err := r.rd.Read(r.buf[r.end:])
+		if n > 0 {
+			r.end += n
+			continue
+		}
+		if err == nil {
+			err = io.ErrNoProgress
+		}
+		return RESP{}, err
+	}
+}
+
+// Buffered returns the number of bytes read ahead of the last reply.
+func (r *ReplyReader) Buffered() int {
+	return r.end - r.start
+}
+
+// scan parses the buffered bytes of the reply at start from pos, one
+// element at a time, and reports whether the reply is complete. An element
+// is only parsed once it is complete. An invalid reply is an error.
+func (r *ReplyReader) scan() (bool, error) {
+	b := r.buf[r.start:r.end]
+	for r.pos < len(b) {
+		n := bytes.IndexByte(b[r.pos+1:], '\n')
+		if n == -1 {
+			return false, nil
+		}
+		eol := r.pos + 1 + n
+		if eol-1 == r.pos || b[eol-1] != '\r' {
+			return false, errInvalidReply
+		}
+		typ, line, next := Type(b[r.pos]), b[r.pos+1:eol-1], eol+1
+		switch typ {
+		case Integer, String, Error, Null, Double, Boolean, BigNumber:
+			if !validLine(typ, line) {
+				return false, errInvalidReply
+			}
+		case Bulk, BlobError, Verbatim:
+			size, ok := parseInt(line)
+			if !ok || size < -1 {
+				return false, errInvalidReply
+			}
+			if size >= 0 {
+				if len(b) < next+size+2 {
+					return false, nil
+				}
+				if b[next+size] != '\r' || b[next+size+1] != '\n' {
+					return false, errInvalidReply
+				}
+				next += size + 2
+			}
+		case Array, Set, Push, Map, Attribute:
+			count, ok := parseInt(line)
+			if !ok || count < -1 {
+				return false, errInvalidReply
+			}
+			if typ == Map || typ == Attribute {
+				count *= 2
+			}
+			if count > 0 {
+				r.pos = next
+				r.open = append(r.open, aggregate{left: count, attr: typ == Attribute})
+				continue
+			}
+			if typ == Attribute {
+				r.pos = next
+				continue
+			}
+		default:
+			return false, errInvalidReply
+		}
+		r.pos = next
+		// the element is complete, and so are the aggregates it ends, up to
+		// an attribute whose element is still to come
+		var attr bool
+		for len(r.open) > 0 {
+			top := len(r.open) - 1
+			if r.open[top].left--; r.open[top].left > 0 {
+				break
+			}
+			attr = r.open[top].attr
+			r.open = r.open[:top]
+			if attr {
+				break
+			}
+		}
+		if len(r.open) == 0 && !attr {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// completeReply returns the complete and valid reply b. Only its first line
+// is parsed again, unless b starts with an attribute.
+func completeReply(b []byte) RESP {
+	if Type(b[0]) == Attribute {
+		_, resp := ReadNextRESP(b)
+		return resp
+	}
+	i := bytes.IndexByte(b, '\n') + 1
+	resp := RESP{Type: Type(b[0]), Raw: b, Data: b[1 : i-2]}
+	switch resp.Type {
+	case Bulk, BlobError, Verbatim:
+		if size, _ := parseInt(resp.Data); size < 0 {
+			resp.Data = nil
+		} else {
+			resp.Data = b[i : i+size]
+		}
+	case Array, Set, Push, Map, Attribute:
+		resp.Count, _ = parseInt(resp.Data)
+		resp.Data = b[i:]
+	}
+	return resp
+}
@@ -0,0 +1,130 @@
+package redcon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReplyReader(t *testing.T) {
+	replies := []string{
+		"+OK\r\n",
+		"$5\r\nhello\r\n",
+		"$-1\r\n",
+		"*-1\r\n",
+		":-42\r\n",
+		"*3\r\n$3\r\nfoo\r\n*2\r\n:1\r\n*0\r\n_\r\n",
+		"%2\r\n+a\r\n~1\r\n#t\r\n+b\r\n>2\r\n,1.5\r\n(123\r\n",
+		"|1\r\n+ttl\r\n:10\r\n$3\r\nbar\r\n",
+		"|0\r\n|1\r\n+a\r\n*1\r\n:1\r\n+OK\r\n",
+		"*2\r\n|1\r\n+a\r\n:1\r\n:5\r\n:6\r\n",
+		"=8\r\ntxt:a\r\nb\r\n",
+		"!3\r\nERR\r\n",
+		"-ERR error\r\n",
+		"$" + "10000" + "\r\n" + strings.Repeat("x", 10000) + "\r\n",
+	}
+	stream := strings.Join(replies, "")
+	for _, rd := range []io.Reader{
+		strings.NewReader(stream),
+		iotest.OneByteReader(strings.NewReader(stream)),
+		iotest.HalfReader(strings.NewReader(stream)),
+	} {
+		r := NewReplyReader(rd)
+		for _, exp := range replies {
+			resp, err := r.ReadReply()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.Raw) != exp {
+				t.Fatalf("expected %q, got %q", exp, resp.Raw)
+			}
+		}
+		if r.Buffered() != 0 {
+			t.Fatalf("expected nothing buffered, got %d", r.Buffered())
+		}
+		if _, err := r.ReadReply(); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+	}
+}
+
+func TestReplyReaderAttribute(t *testing.T) {
+	r := NewReplyReader(strings.NewReader("|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.19\r\n*2\r\n:1\r\n:2\r\n+OK\r\n"))
+	resp, err := r.ReadReply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Type != Array || resp.Count != 2 || string(resp.Data) != ":1\r\n:2\r\n" {
+		t.Fatalf("expected the array after the attribute, got %c %d %q", resp.Type, resp.Count, resp.Data)
+	}
+	if !strings.HasPrefix(string(resp.Raw), "|1\r\n") || !strings.HasSuffix(string(resp.Raw), ":2\r\n") {
+		t.Fatalf("expected the attribute and the array, got %q", resp.Raw)
+	}
+	if resp, err = r.ReadReply(); err != nil || string(resp.Raw) != "+OK\r\n" {
+		t.Fatalf("expected +OK, got %q %v", resp.Raw, err)
+	}
+}
+
+func TestReplyReaderBuffered(t *testing.T) {
+	r := NewReplyReader(bytes.NewReader([]byte("+OK\r\n:1\r\n$3\r\nfo")))
+	resp, err := r.ReadReply()
+	if err != nil || string(resp.Raw) != "+OK\r\n" {
+		t.Fatalf("expected +OK, got %q %v", resp.Raw, err)
+	}
+	if r.Buffered() != 10 {
+		t.Fatalf("expected 10 bytes buffered, got %d", r.Buffered())
+	}
+	if resp, err = r.ReadReply(); err != nil || resp.Type != Integer {
+		t.Fatalf("expected integer, got %q %v", resp.Raw, err)
+	}
+	if _, err = r.ReadReply(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestReplyReaderInvalid(t *testing.T) {
+	for _, s := range []string{
+		"^what\r\n",
+		"+OK\n",
+		"$abc\r\n",
+		"$3\r\nfooo\r\n",
+		"*x\r\n",
+		"*1\r\n?\r\n",
+		",abc\r\n",
+	} {
+		r := NewReplyReader(strings.NewReader(s))
+		if _, err := r.ReadReply(); err == nil || err == io.EOF {
+			t.Fatalf("expected an error for %q, got %v", s, err)
+		}
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestReplyReaderResume(t *testing.T) {
+	chunks := []string{"*3\r\n:1\r\n$3\r\nfo", "o\r\n*1\r\n", "+x\r\n"}
+	var r *ReplyReader
+	var positions []int
+	r = NewReplyReader(readerFunc(func(p []byte) (int, error) {
+		if len(chunks) == 0 {
+			return 0, io.EOF
+		}
+		positions = append(positions, r.pos)
+		n := copy(p, chunks[0])
+		chunks = chunks[1:]
+		return n, nil
+	}))
+	resp, err := r.ReadReply()
+	if err != nil || string(resp.Raw) != "*3\r\n:1\r\n$3\r\nfoo\r\n*1\r\n+x\r\n" || resp.Count != 3 {
+		t.Fatalf("expected the array, got %q %d %v", resp.Raw, resp.Count, err)
+	}
+	// the parse resumes after the elements complete before each read
+	if exp := []int{0, 8, 21}; fmt.Sprint(positions) != fmt.Sprint(exp) {
+		t.Fatalf("expected the parse at %v before the reads, got %v", exp, positions)
+	}
+}
@@ -2,6 +2,7 @@ package redcon
 
 import (
 	"strconv"
+	"strings"
 )
 
 // Type of RESP
@@ -14,6 +15,18 @@ const (
 	Bulk    = '$'
 	Array   = '*'
 	Error   = '-'
+
+	// RESP3
+	Null      = '_'
+	Double    = ','
+	Boolean   = '#'
+	BigNumber = '('
+	BlobError = '!'
+	Verbatim  = '='
+	Map       = '%'
+	Set       = '~'
+	Attribute = '|'
+	Push      = '>'
 )
 
 // RESP ...
@@ -24,10 +37,11 @@ type RESP struct {
 	Count int
 }
 
-// ForEach iterates over each Array element
+// ForEach iterates over each Array, Set or Push element. The elements of a
+// Map or Attribute are its keys and values in turn.
 func (r *RESP) ForEach(iter func(resp RESP) bool) {
 	data := r.Data
-	for i := 0; i < r.Count; i++ {
+	for i := 0; i < r.elements(); i++ {
 		n, resp := ReadNextRESP(data)
 		if !iter(resp) {
 			return
@@ -36,15 +50,27 @@ func (r *RESP) ForEach(iter func(resp RESP) bool) {
 	}
 }
 
+// elements returns the number of elements of an aggregate, which is twice
+// the number of pairs of a Map or Attribute.
+func (r *RESP) elements() int {
+	if r.Type == Map || r.Type == Attribute {
+		return r.Count * 2
+	}
+	return r.Count
+}
+
 // ReadNextRESP returns the next resp in b and returns the number of bytes the
-// took up the result.
+// took up the result. A RESP3 attribute is read with the reply it annotates,
+// which gives the Type, Data and Count of the result, and Raw holds both.
 func ReadNextRESP(b []byte) (n int, resp RESP) {
 	if len(b) == 0 {
 		return 0, RESP{} // no data to read
 	}
 	resp.Type = Type(b[0])
 	switch resp.Type {
-	case Integer, String, Bulk, Array, Error:
+	case Integer, String, Bulk, Array, Error,
+		Null, Double, Boolean, BigNumber, BlobError, Verbatim,
+		Map, Set, Attribute, Push:
 	default:
 		return 0, RESP{} // invalid kind
 	}
@@ -64,33 +90,17 @@ func ReadNextRESP(b []byte) (n int, resp RESP) {
 	}
 	resp.Raw = b[0:i]
 	resp.Data = b[1 : i-2]
-	if resp.Type == Integer {
-		// Integer
-		if len(resp.Data) == 0 {
-			return 0, RESP{} //, invalid integer
-		}
-		var j int
-		if resp.Data[0] == '-' {
-			if len(resp.Data) == 1 {
-				return 0, RESP{} //, invalid integer
-			}
-			j++
-		}
-		for ; j < len(resp.Data); j++ {
-			if resp.Data[j] < '0' || resp.Data[j] > '9' {
-				return 0, RESP{} // invalid integer
-			}
+	switch resp.Type {
+	case Integer, String, Error, Null, Boolean, Double, BigNumber:
+		if !validLine(resp.Type, resp.Data) {
+			return 0, RESP{}
 		}
 		return len(resp.Raw), resp
 	}
-	if resp.Type == String || resp.Type == Error {
-		// String, Error
-		return len(resp.Raw), resp
-	}
 	var err error
 	resp.Count, err = strconv.Atoi(string(resp.Data))
-	if resp.Type == Bulk {
-		// Bulk
+	if resp.Type == Bulk || resp.Type == BlobError || resp.Type == Verbatim {
+		// Bulk, BlobError, Verbatim (with its "txt:" format prefix)
 		if err != nil {
 			return 0, RESP{} // invalid number of bytes
 		}
@@ -110,13 +120,13 @@ func ReadNextRESP(b []byte) (n int, resp RESP) {
 		resp.Count = 0
 		return len(resp.Raw), resp
 	}
-	// Array
+	// Array, Map, Set, Attribute, Push
 	if err != nil {
 		return 0, RESP{} // invalid number of elements
 	}
 	var tn int
 	sdata := b[i:]
-	for j := 0; j < resp.Count; j++ {
+	for j := 0; j < resp.elements(); j++ {
 		rn, rresp := ReadNextRESP(sdata)
 		if rresp.Type == 0 {
 			return 0, RESP{}
@@ -126,5 +136,60 @@ func ReadNextRESP(b []byte) (n int, resp RESP) {
 	}
 	resp.Data = b[i : i+tn]
 	resp.Raw = b[0 : i+tn]
+	if resp.Type == Attribute {
+		// the attribute annotates the reply that follows it
+		rn, rresp := ReadNextRESP(b[len(resp.Raw):])
+		if rresp.Type == 0 {
+			return 0, RESP{}
+		}
+		rresp.Raw = b[0 : len(resp.Raw)+rn]
+		return len(rresp.Raw), rresp
+	}
 	return len(resp.Raw), resp
 }
+
+// validLine reports whether data is a valid line of a reply of type t,
+// which has no bulk data nor elements.
+func validLine(t Type, data []byte) bool {
+	switch t {
+	case Integer:
+		var j int
+		if len(data) > 0 && data[0] == '-' {
+			j++
+		}
+		if j == len(data) {
+			return false
+		}
+		for ; j < len(data); j++ {
+			if data[j] < '0' || data[j] > '9' {
+				return false
+			}
+		}
+	case Null:
+		return len(data) == 0
+	case Boolean:
+		return len(data) == 1 && (data[0] == 't' || data[0] == 'f')
+	case Double:
+		switch strings.ToLower(string(data)) {
+		case "inf", "-inf", "nan":
+		default:
+			if _, err := strconv.ParseFloat(string(data), 64); err != nil {
+				return false
+			}
+		}
+	case BigNumber:
+		j := 0
+		if len(data) > 0 && (data[0] == '-' || data[0] == '+') {
+			j++
+		}
+		if j == len(data) {
+			return false
+		}
+		for ; j < len(data); j++ {
+			if data[j] < '0' || data[j] > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -3,6 +3,7 @@ package redcon
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -128,3 +129,46 @@ func TestRESP(t *testing.T) {
 		t.Fatalf("expected %v, got %v", 3, xx)
 	}
 }
+
+func TestRESP3(t *testing.T) {
+	expectGood(t, "_\r\n", RESP{Type: Null, Data: []byte("")})
+	expectBad(t, "_x\r\n")
+	expectGood(t, "#t\r\n", RESP{Type: Boolean, Data: []byte("t")})
+	expectGood(t, "#f\r\n", RESP{Type: Boolean, Data: []byte("f")})
+	expectBad(t, "#x\r\n")
+	expectGood(t, ",1.23\r\n", RESP{Type: Double, Data: []byte("1.23")})
+	expectGood(t, ",-inf\r\n", RESP{Type: Double, Data: []byte("-inf")})
+	expectGood(t, ",1e10\r\n", RESP{Type: Double, Data: []byte("1e10")})
+	expectBad(t, ",abc\r\n")
+	expectGood(t, "(3492890328409238509324850943850943825024385\r\n",
+		RESP{Type: BigNumber, Data: []byte("3492890328409238509324850943850943825024385")})
+	expectBad(t, "(-\r\n")
+	expectBad(t, "(12a\r\n")
+	expectGood(t, "!21\r\nSYNTAX invalid syntax\r\n",
+		RESP{Type: BlobError, Data: []byte("SYNTAX invalid syntax")})
+	expectGood(t, "=15\r\ntxt:Some string\r\n",
+		RESP{Type: Verbatim, Data: []byte("txt:Some string")})
+	expectBad(t, "%2\r\n+first\r\n:1\r\n+second\r\n")
+	expectGood(t, "%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n",
+		RESP{Type: Map, Count: 2, Data: []byte("+first\r\n:1\r\n+second\r\n:2\r\n")})
+	expectGood(t, "~2\r\n#t\r\n_\r\n",
+		RESP{Type: Set, Count: 2, Data: []byte("#t\r\n_\r\n")})
+	expectGood(t, ">2\r\n$7\r\nmessage\r\n,1.5\r\n",
+		RESP{Type: Push, Count: 2, Data: []byte("$7\r\nmessage\r\n,1.5\r\n")})
+	// an attribute is read with the reply it annotates
+	expectBad(t, "|1\r\n+ttl\r\n:3600\r\n")
+	expectGood(t, "|1\r\n+ttl\r\n:3600\r\n*1\r\n:42\r\n",
+		RESP{Type: Array, Count: 1, Data: []byte(":42\r\n")})
+	expectGood(t, "*2\r\n|1\r\n+a\r\n:1\r\n:5\r\n:6\r\n",
+		RESP{Type: Array, Count: 2, Data: []byte("|1\r\n+a\r\n:1\r\n:5\r\n:6\r\n")})
+
+	var keys []string
+	_, r := ReadNextRESP([]byte("%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n"))
+	r.ForEach(func(resp RESP) bool {
+		keys = append(keys, string(resp.Data))
+		return true
+	})
+	if strings.Join(keys, ",") != "a,1,b,2" {
+		t.Fatalf("expected %v, got %v", "a,1,b,2", keys)
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"net/http"
@@ -18,11 +22,35 @@ import (
 )
 
 var (
-	flagH       bool
-	proxyAddr   string
-	sourceAddr  string
-	targetAddr  string
-	limitMemory int
+	flagH         bool
+	proxyAddr     string
+	proxyAddrs    []string
+	announceAddr  string
+	sourceAddr    string
+	targetAddr    string
+	limitMemory   int
+	statePath     string
+	resume        bool
+	liveSync      bool
+	policy        = route{write: writeBoth}
+	maxLag        int64
+	nodeLimits    limits
+	allLimits     limits
+	adaptive      bool
+	maxOps        int64
+	maxLatency    time.Duration
+	copyBatchSize int
+	copyWorkers   int
+	buildRules    func() (*rules, error)
+	buildSource   func(addr string) (*topology, error)
+	buildTarget   func(addr string) (*topology, error)
+	maxClients    int
+	maxBulkLen    int
+	maxQueryBuf   int
+	idleTimeout   time.Duration
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	drainTimeout  time.Duration
 
 	err error
 )
@@ -30,188 +58,173 @@ var (
 func init() {
 	flag.BoolVar(&flagH, "h", false, "this help")
 	flag.StringVar(&proxyAddr, "p", "localhost:6380", "proxy addr")
-	flag.StringVar(&sourceAddr, "s", "localhost:6379", "source redis address")
-	flag.StringVar(&targetAddr, "t", "localhost:6379", "target redis address")
+	flag.Var((*commaFlag)(&proxyAddrs), "proxies", "proxy addresses presented as the cluster by CLUSTER SLOTS, comma separated, default -p")
+	flag.StringVar(&announceAddr, "announce", "", "address of this proxy among -proxies, default -p or the address the client connected to")
+	flag.StringVar(&sourceAddr, "s", "localhost:6379", "source redis addresses, comma separated")
+	flag.StringVar(&targetAddr, "t", "localhost:6379", "target redis addresses, comma separated")
+	buildSource = topologyFlags(flag.CommandLine, "source")
+	buildTarget = topologyFlags(flag.CommandLine, "target")
 	flag.IntVar(&limitMemory, "l", 0, "artificially limit the maximum memory")
+	flag.StringVar(&statePath, "state", "redisp.state", "migration checkpoint file")
+	flag.BoolVar(&resume, "resume", false, "resume the migration from the checkpoint file")
+	flag.BoolVar(&liveSync, "sync", false, "keep the target in sync with the replication stream of the source")
+	flag.Int64Var(&maxLag, "max-lag", 1024, "highest sync lag in bytes that allows a cutover")
+	flag.IntVar(&copyBatchSize, "batch", 100, "keys copied by each pipeline")
+	flag.IntVar(&copyWorkers, "workers", 4, "pipelines copying the keys of each node")
+	flag.Float64Var(&nodeLimits.keys, "node-keys", 0, "keys copied per second from each node, 0 is unlimited")
+	flag.Float64Var(&nodeLimits.bytes, "node-bytes", 0, "bytes copied per second from each node, 0 is unlimited")
+	flag.IntVar(&nodeLimits.inflight, "node-inflight", 0, "pipelines in flight on each node, 0 is unlimited")
+	flag.Float64Var(&allLimits.keys, "keys", 0, "keys copied per second from all nodes, 0 is unlimited")
+	flag.Float64Var(&allLimits.bytes, "bytes", 0, "bytes copied per second from all nodes, 0 is unlimited")
+	flag.IntVar(&allLimits.inflight, "inflight", 0, "pipelines in flight on all nodes, 0 is unlimited")
+	flag.BoolVar(&adaptive, "adaptive", false, "slow down the copy of a node while the node is overloaded")
+	flag.Int64Var(&maxOps, "max-ops", 50000, "source instantaneous_ops_per_sec above which -adaptive slows down")
+	flag.DurationVar(&maxLatency, "max-latency", 10*time.Millisecond, "source latency above which -adaptive slows down")
+	buildRules = ruleFlags(flag.CommandLine)
+	flag.Var(routeFlag("read"), "read", "serve reads from: source, target or target-fallback-source")
+	flag.Var(routeFlag("write"), "write", "send writes to: source, target or both")
+	flag.Var(routeFlag("primary"), "primary", "cluster whose reply is returned when writing to both: source or target")
+	flag.Var(routeFlag("secondary-errors"), "secondary-errors", "on a failed write to the secondary: ignore or fail")
+	flag.Var(routeFlag("scripts"), "scripts", "run the scripts with writes on: both or primary, when writing to both")
+	flag.IntVar(&maxClients, "maxclients", 10000, "maximum number of connected clients, 0 is unlimited")
+	flag.IntVar(&maxBulkLen, "proto-max-bulk-len", 512<<20, "maximum length of a command argument, 0 is unlimited")
+	flag.IntVar(&maxQueryBuf, "client-query-buffer-limit", 1<<30, "maximum size of an incomplete command, 0 is unlimited")
+	flag.DurationVar(&idleTimeout, "timeout", 0, "close the clients idle for that long, 0 is never")
+	flag.DurationVar(&readTimeout, "read-timeout", 0, "close the clients sending a command for that long, 0 is never")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "close the clients receiving a reply for that long, 0 is never")
+	flag.DurationVar(&drainTimeout, "shutdown-timeout", 10*time.Second, "time given to the clients and the copy to finish on SIGTERM")
 	flag.Usage = usage
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			importMain(os.Args[2:])
+			return
+		case "verify":
+			verifyMain(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
 
 	if flagH {
 		flag.Usage()
 		return
 	}
+	if copyBatchSize < 1 || copyWorkers < 1 {
+		log.Fatal("-batch and -workers must be at least 1")
+	}
+	if keyRules, err = buildRules(); err != nil {
+		log.Fatal(err)
+	}
+	if sourceTopo, err = buildSource(sourceAddr); err != nil {
+		log.Fatal("source: ", err)
+	}
+	if targetTopo, err = buildTarget(targetAddr); err != nil {
+		log.Fatal("target: ", err)
+	}
+	if targetTopo.mode == modeCluster && keyRules != nil {
+		for _, db := range keyRules.dbs {
+			if db != 0 {
+				log.Fatal("-db-map: the target cluster has only db 0")
+			}
+		}
+	}
 
 	go http.ListenAndServe(":8080", nil)
 	log.Println("start pprof server ...")
 
-	sourceClient := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs:    []string{sourceAddr},
-		Password: "", // no password set
-	})
-	targetClient := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs:    []string{targetAddr},
-		Password: "", // no password set
-	})
-
-	log.Printf("started server at %s \nsource: %s\ntarget: %s\n", proxyAddr, sourceAddr, targetAddr)
-
-	clusterMigrate(sourceClient, targetClient)
-
-	err = redcon.ListenAndServe(proxyAddr,
-		func(conn redcon.Conn, cmd redcon.Command) {
-			switch strings.ToLower(string(cmd.Args[0])) {
-			default:
-				cmdStr := ""
-				for _, b := range cmd.Args {
-					cmdStr += " " + string(b)
-				}
-				log.Println("cmd: ", cmdStr)
-				conn.WriteError("ERR unknown command '" + cmdStr + "'")
-			case "detach":
-				hconn := conn.Detach()
-				log.Printf("connection has been detached")
-				go func() {
-					defer hconn.Close()
-					hconn.WriteString("OK")
-					hconn.Flush()
-				}()
-				return
-			case "ping":
-				conn.WriteString("PONG")
-			case "info":
-				if len(cmd.Args) > 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				var (
-					val string
-					ok  error
-				)
-				if len(cmd.Args) == 2 {
-					section := string(cmd.Args[1])
-					val, ok = sourceClient.Info(section).Result()
+	sourceClient := sourceTopo.client(0)
+	targetClient := targetTopo.client(0)
+	if targetTopo.mode == modeCluster && sourceTopo.mode != modeCluster && (keyRules == nil || keyRules.dbs == nil) {
+		for _, db := range keyspaceDBs(sourceClient) {
+			if db != 0 {
+				log.Fatalf("the source has keys in db %d and the target cluster has only db 0, map the dbs with -db-map", db)
+			}
+		}
+	}
 
-				} else {
-					val, ok = sourceClient.Info().Result()
-				}
-				if ok != nil {
-					conn.WriteError(ok.Error())
-					return
-				}
-				conn.WriteString(string(val))
-			case "cluster":
-				if len(cmd.Args) != 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				slots, ok := sourceClient.ClusterSlots().Result()
-				if ok != nil {
-					conn.WriteError(ok.Error())
-					return
-				}
-				val := ""
-				for i, slot := range slots {
-					itemVal := ""
-					itemVal += fmt.Sprintf("%d) 1) (integer) %d\r\n", i+1, slot.Start)
-					itemVal += fmt.Sprintf("   2) (integer) %d\r\n", slot.End)
-					for j, node := range slot.Nodes {
-						addr := strings.Split(node.Addr, ":")
-						itemVal += fmt.Sprintf("   %d) 1) \"%s\"\r\n", j+3, addr[0])
-						itemVal += fmt.Sprintf("      2) (integer) %s\r\n", addr[1])
-						itemVal += fmt.Sprintf("      3) \"%s\"\r\n", node.Id)
-					}
-					val += itemVal
-				}
-				conn.WriteBulkString(val)
-			case "quit":
-				conn.WriteString("OK")
-				conn.Close()
-			case "set":
-				if len(cmd.Args) != 3 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				key, val, duration := string(cmd.Args[1]), cmd.Args[2], 0*time.Second
-				err = sourceClient.Set(key, val, duration).Err()
-				if err == nil {
-					err = targetClient.Set(key, val, duration).Err()
-				}
-				if err != nil {
-					conn.WriteNull()
-					return
-				}
-				conn.WriteString("OK")
-			case "get":
-				if len(cmd.Args) != 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				key := string(cmd.Args[1])
-				val, ok := targetClient.Get(key).Result()
-				if val == "" {
-					val, ok = sourceClient.Get(key).Result()
-					duration, _ := sourceClient.TTL(key).Result()
-					targetClient.Set(key, val, duration)
+	log.Printf("started server at %s \nsource: %s\ntarget: %s\n", proxyAddr, sourceTopo, targetTopo)
 
-				}
-				if ok != nil {
-					conn.WriteNull()
-					return
-				}
-				conn.WriteString(val)
-			case "del":
-				if len(cmd.Args) != 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				key := string(cmd.Args[1])
-				val, ok := sourceClient.Del(key).Result()
-				targetClient.Del(key).Result()
-				if ok != nil {
-					conn.WriteError(ok.Error())
-					return
-				}
-				conn.WriteInt(int(val))
-			case "expire":
-				if len(cmd.Args) != 3 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				key := string(cmd.Args[1])
-				durationInt, err := strconv.Atoi(string(cmd.Args[2]))
-				if err != nil {
-					conn.WriteError(err.Error())
-					return
-				}
-				duration := time.Duration(time.Duration(durationInt) * time.Second)
-				val, ok := sourceClient.Expire(key, duration).Result()
-				targetClient.Expire(key, duration).Result()
-				if ok != nil {
-					conn.WriteNull()
-					return
-				}
-				if !val {
-					conn.WriteInt(0)
-					return
-				}
-				conn.WriteInt(1)
-			case "exists":
-				if len(cmd.Args) != 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				key := string(cmd.Args[1])
-				val, ok := sourceClient.Exists(key).Result()
-				if ok != nil {
-					conn.WriteNull()
-					return
-				}
-				conn.WriteInt(int(val))
+	state := newState(statePath)
+	if resume {
+		state, err = loadState(statePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	stop := make(chan struct{})
+	migrating := new(sync.WaitGroup)
+	if liveSync {
+		// the snapshot of the full resync copies the keys, a copy running
+		// next to the replication stream would overwrite its writes
+		for _, addr := range sourceTopo.masters(sourceClient) {
+			if err := state.checkpoint(nodeState{Addr: addr}); err != nil {
+				log.Fatal(err)
 			}
-		},
+			go nodeSync(addr, targetClient, state)
+		}
+		if policy.write == writeBoth {
+			log.Println("-sync: the writes go to the source, the replication stream applies them to the target")
+		}
+	} else {
+		migrating = clusterMigrate(sourceClient, targetClient, state, stop)
+	}
+
+	p := newProxy(sourceClient, targetClient, policy)
+	p.synced = liveSync
+	p.migration = newMigration(p, state, maxLag)
+	go p.migration.run()
+	p.handler = func(conn redcon.Conn, cmd redcon.Command) {
+		if len(conn.PeekPipeline()) > 0 && p.pipeline(conn, cmd) {
+			return
+		}
+		if p.queue(conn, cmd) {
+			return
+		}
+		switch strings.ToLower(string(cmd.Args[0])) {
+		default:
+			p.forward(conn, cmd)
+		case "multi", "exec", "discard", "watch", "unwatch":
+			p.transaction(conn, cmd)
+		case "subscribe", "psubscribe", "ssubscribe":
+			p.subscribe(conn, cmd)
+		case "unsubscribe", "punsubscribe", "sunsubscribe":
+			unsubscribed(conn, cmd)
+		case "detach":
+			hconn := conn.Detach()
+			log.Printf("connection has been detached")
+			go func() {
+				defer hconn.Close()
+				hconn.WriteString("OK")
+				hconn.Flush()
+			}()
+			return
+		case "hello":
+			// the commands of a RESP3 client are sent on backend
+			// connections speaking RESP3, and their replies passed on
+			redcon.Hello(conn, cmd, "cluster")
+		case "ping":
+			conn.WriteString("PONG")
+		case "reset":
+			resetSession(conn)
+		case "info":
+			// the reply of a source node, passed on as is
+			p.reply(conn, p.source, &backendCmd{raw: cmd.Raw, slot: -1, proto: conn.Protocol()})
+		case "cluster":
+			p.cluster(conn, cmd)
+		case "script", "function":
+			p.scriptCommand(conn, cmd)
+		case "quit":
+			conn.WriteString("OK")
+			conn.Close()
+		case "proxy":
+			p.admin(conn, cmd)
+		}
+	}
+	s := redcon.NewServer(proxyAddr, p.handler,
 		func(conn redcon.Conn) bool {
 			// use this function to accept or deny the connection.
 			go log.Printf("accept: %s", conn.RemoteAddr())
@@ -219,65 +232,179 @@ func main() {
 		},
 		func(conn redcon.Conn, err error) {
 			// this is called when the connection has been closed
+			closeSession(conn, err)
 			go log.Printf("closed: %s, err: %v", conn.RemoteAddr(), err)
 		},
 	)
-	if err != nil {
+	s.MaxClients = maxClients
+	s.MaxBulkLen = maxBulkLen
+	s.MaxQueryBuffer = maxQueryBuf
+	s.IdleTimeout = idleTimeout
+	s.ReadTimeout = readTimeout
+	s.WriteTimeout = writeTimeout
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		// stop the copy at a checkpoint and let the clients finish
+		defer close(done)
+		log.Println("received", <-sigs, "shutting down ...")
+		close(stop)
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Println("shutdown:", err)
+		}
+		stopped := make(chan struct{})
+		go func() {
+			migrating.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			log.Println("migration checkpoint saved to", statePath)
+		case <-ctx.Done():
+			log.Println("migration still copying, resume from the last checkpoint in", statePath)
+		}
+	}()
+	if err = s.ListenAndServe(); err != nil {
 		log.Fatal(err)
 	}
+	<-done
+}
+
+// commaFlag is a flag holding a comma separated list.
+type commaFlag []string
+
+func (f *commaFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *commaFlag) Set(value string) error {
+	*f = strings.Split(value, ",")
+	return nil
+}
+
+// routeFlag is a flag that sets an option of the routing policy.
+type routeFlag string
+
+func (f routeFlag) String() string {
+	opts := policy.options()
+	for i := 0; i < len(opts); i += 2 {
+		if opts[i] == string(f) {
+			return opts[i+1]
+		}
+	}
+	return ""
+}
+
+func (f routeFlag) Set(value string) error {
+	return policy.set(string(f), value)
 }
 
 func usage() {
 	fmt.Fprintf(os.Stderr,
 		`redisp version: redisp/0.1.0
-Usage: redisp  [-s source] [-t target]
+Usage: redisp  [-s source] [-t target] [-source-mode mode] [-target-mode mode] [-resume] [-sync]
+       redisp import [-rdb dump.rdb] [-t target] [-target-mode mode]
+       redisp verify [-s source] [-t target] [-source-mode mode] [-target-mode mode]
 
 Options:
 `)
 	flag.PrintDefaults()
 }
 
-func clusterMigrate(sourceClient, targetClient *redis.ClusterClient) {
-	nodes, _ := sourceClient.ClusterNodes().Result()
+// clusterMasters returns the addresses of the masters of a cluster.
+func clusterMasters(client *redis.ClusterClient) []string {
+	nodes, _ := client.ClusterNodes().Result()
 	addrRegexp, _ := regexp.Compile(`((2(5[0-5]|[0-4]\d))|[0-1]?\d{1,2})(\.((2(5[0-5]|[0-4]\d))|[0-1]?\d{1,2})){3}:\d{4,5}`)
-	addrs := addrRegexp.FindAllString(nodes, -1)
-	for i, addr := range addrs {
-		sourceNodeClient := redis.NewClient(&redis.Options{
-			Addr:     addr,
-			Password: "", // no password set
-			DB:       0,  // use default DB
-		})
-		log.Println("node", i, "addr:", addr)
-		go nodeMigrate(sourceNodeClient, targetClient)
+	var addrs []string
+	for _, line := range strings.Split(nodes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.Contains(fields[2], "master") {
+			continue
+		}
+		if addr := addrRegexp.FindString(fields[1]); addr != "" {
+			addrs = append(addrs, addr)
+		}
 	}
+	return addrs
 }
 
-func nodeMigrate(sourceClient *redis.Client, targetClient *redis.ClusterClient) {
-	var (
-		page   []string
-		cursor uint64
-		err    error
-	)
-	cursor = 0
-	for {
-		page, cursor, err = sourceClient.Scan(cursor, "*", 1000).Result()
-		if err != nil {
-			log.Println(err.Error())
+// clusterMigrate copies the keys of every master of the source. Each db of
+// a standalone or sentinel source is copied like a separate node. Every
+// node is registered in state before any copy starts, so the state is not
+// done until all of them finished. The copy stops at the next checkpoint
+// of each node once stop is closed, and the returned WaitGroup is done
+// when every node stopped or finished.
+func clusterMigrate(sourceClient, targetClient redis.UniversalClient, state *migrateState, stop <-chan struct{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	global := newThrottle(allLimits, nil)
+	type job struct {
+		name   string
+		source *redis.Client
+		target redis.UniversalClient
+	}
+	var jobs []job
+	for i, addr := range sourceTopo.masters(sourceClient) {
+		dbs := []int{0}
+		if sourceTopo.mode != modeCluster {
+			dbs = keyspaceDBs(sourceClient)
+		}
+		for _, db := range dbs {
+			dst, ok := keyRules.targetDB(db)
+			if !ok {
+				log.Println("node", i, "addr:", addr, "db", db, "is not in -db-map")
+				continue
+			}
+			target, err := targetTopo.selectDB(targetClient, dst)
+			if err != nil {
+				log.Println("node", i, "addr:", addr, err)
+				continue
+			}
+			name := addr
+			if db != 0 {
+				name += "/" + strconv.Itoa(db)
+			}
+			if node := state.node(name); node.Done {
+				log.Println("node", i, "addr:", name, "already migrated, keys:", node.Keys)
+				continue
+			}
+			if err := state.register(name); err != nil {
+				log.Println("checkpoint:", err)
+			}
+			sourceNodeClient := redis.NewClient(&redis.Options{
+				Addr:     addr,
+				Password: "", // no password set
+				DB:       db,
+			})
+			log.Println("node", i, "addr:", name)
+			jobs = append(jobs, job{name, sourceNodeClient, target})
 		}
-		log.Println("cursor:", cursor)
-		for _, key := range page {
-			val, _ := sourceClient.Get(key).Result()
-			duration, _ := sourceClient.TTL(key).Result()
-			targetClient.Set(key, val, duration)
+	}
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			nodeMigrate(j.name, j.source, j.target, state, newThrottle(nodeLimits, global), stop)
+		}(j)
+	}
+	return &wg
+}
 
+// keyspaceDBs returns the dbs holding keys, from INFO keyspace.
+func keyspaceDBs(client redis.UniversalClient) []int {
+	info, err := client.Info("keyspace").Result()
+	if err != nil {
+		log.Println("keyspace:", err)
+		return []int{0}
+	}
+	var dbs []int
+	for _, line := range strings.Split(info, "\n") {
+		if !strings.HasPrefix(line, "db") {
+			continue
 		}
-		val, _ := targetClient.Info("Memory").Result()
-		r, _ := regexp.Compile(".*used_memory:(.*).*")
-		used, _ := strconv.Atoi(strings.TrimSpace(strings.Split(r.FindString(val), ":")[1]))
-		log.Println("info Memory:", used)
-		if cursor <= 0 || (limitMemory > 0 && used > limitMemory) {
-			log.Println("congratulation, migrate done ...")
-			break
+		if db, err := strconv.Atoi(line[2:strings.IndexByte(line+":", ':')]); err == nil {
+			dbs = append(dbs, db)
 		}
 	}
+	return dbs
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// readFrom is where reads are served from.
+type readFrom int
+
+const (
+	readSource readFrom = iota
+	readTarget
+	// readTargetFallbackSource serves reads from the target and falls back
+	// to the source when the target has no value, copying the key to the
+	// target on the way.
+	readTargetFallbackSource
+)
+
+var readFromNames = []string{"source", "target", "target-fallback-source"}
+
+func (r readFrom) String() string { return readFromNames[r] }
+
+// writeTo is where writes are sent to.
+type writeTo int
+
+const (
+	writeSource writeTo = iota
+	writeTarget
+	writeBoth
+)
+
+var writeToNames = []string{"source", "target", "both"}
+
+func (w writeTo) String() string { return writeToNames[w] }
+
+// route is the routing policy of the proxy. When writes go to both
+// clusters the primary is written first and its reply is returned to the
+// client. The secondary is only written when the primary succeeded; a
+// failure on the secondary is logged, or also returned to the client when
+// strict is set. Scripts with writes only run on the primary when
+// scriptsPrimary is set, for scripts that must not run twice.
+type route struct {
+	read           readFrom
+	write          writeTo
+	targetPrimary  bool
+	strict         bool
+	scriptsPrimary bool
+}
+
+var errInvalidRoute = errors.New("invalid route")
+
+func parseName(names []string, s string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(name, s) {
+			return i, nil
+		}
+	}
+	return 0, errInvalidRoute
+}
+
+// set changes a single option of the route. The options are "read",
+// "write", "primary", "secondary-errors" and "scripts".
+func (r *route) set(option, value string) error {
+	var n int
+	var err error
+	switch strings.ToLower(option) {
+	case "read":
+		n, err = parseName(readFromNames, value)
+		r.read = readFrom(n)
+	case "write":
+		n, err = parseName(writeToNames, value)
+		r.write = writeTo(n)
+	case "primary":
+		n, err = parseName([]string{"source", "target"}, value)
+		r.targetPrimary = n == 1
+	case "secondary-errors":
+		n, err = parseName([]string{"ignore", "fail"}, value)
+		r.strict = n == 1
+	case "scripts":
+		n, err = parseName([]string{"both", "primary"}, value)
+		r.scriptsPrimary = n == 1
+	default:
+		err = errInvalidRoute
+	}
+	return err
+}
+
+// options returns the route as option/value pairs.
+func (r route) options() []string {
+	primary, errs, scripts := "source", "ignore", "both"
+	if r.targetPrimary {
+		primary = "target"
+	}
+	if r.strict {
+		errs = "fail"
+	}
+	if r.scriptsPrimary {
+		scripts = "primary"
+	}
+	return []string{
+		"read", r.read.String(),
+		"write", r.write.String(),
+		"primary", primary,
+		"secondary-errors", errs,
+		"scripts", scripts,
+	}
+}
+
+// parseRoute returns the route of option/value pairs, as returned by
+// options, set over r.
+func parseRoute(r route, opts []string) (route, error) {
+	if len(opts)%2 != 0 {
+		return r, errInvalidRoute
+	}
+	for i := 0; i < len(opts); i += 2 {
+		if err := r.set(opts[i], opts[i+1]); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// route returns the current routing policy.
+func (p *proxy) route() route {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.policy
+}
+
+// setRoute replaces the routing policy, and moves the subscriptions when
+// the primary of the write route changes.
+func (p *proxy) setRoute(r route) {
+	p.mu.Lock()
+	p.policy = r
+	p.mu.Unlock()
+	p.moveSubscribers()
+}
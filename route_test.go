@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestRouteSet(t *testing.T) {
+	tests := []struct {
+		option string
+		value  string
+		exp    route
+		err    error
+	}{
+		{"read", "source", route{read: readSource}, nil},
+		{"read", "TARGET", route{read: readTarget}, nil},
+		{"READ", "target-fallback-source", route{read: readTargetFallbackSource}, nil},
+		{"write", "both", route{write: writeBoth}, nil},
+		{"write", "target", route{write: writeTarget}, nil},
+		{"primary", "target", route{targetPrimary: true}, nil},
+		{"primary", "source", route{}, nil},
+		{"secondary-errors", "fail", route{strict: true}, nil},
+		{"secondary-errors", "ignore", route{}, nil},
+		{"scripts", "primary", route{scriptsPrimary: true}, nil},
+		{"scripts", "both", route{}, nil},
+		{"read", "replica", route{}, errInvalidRoute},
+		{"write", "", route{}, errInvalidRoute},
+		{"primary", "both", route{}, errInvalidRoute},
+		{"mode", "target", route{}, errInvalidRoute},
+	}
+	for _, tt := range tests {
+		var r route
+		err := r.set(tt.option, tt.value)
+		if err != tt.err || (err == nil && r != tt.exp) {
+			t.Errorf("%s %s: expected %+v %v, got %+v %v", tt.option, tt.value, tt.exp, tt.err, r, err)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	base := route{read: readTarget, write: writeBoth}
+	tests := []struct {
+		opts []string
+		exp  route
+		err  error
+	}{
+		{nil, base, nil},
+		{[]string{"write", "target"}, route{read: readTarget, write: writeTarget}, nil},
+		{[]string{"primary", "target", "secondary-errors", "fail"},
+			route{read: readTarget, write: writeBoth, targetPrimary: true, strict: true}, nil},
+		{[]string{"read", "source", "read", "target-fallback-source"},
+			route{read: readTargetFallbackSource, write: writeBoth}, nil},
+		{[]string{"write"}, base, errInvalidRoute},
+		{[]string{"write", "nowhere"}, base, errInvalidRoute},
+	}
+	for _, tt := range tests {
+		r, err := parseRoute(base, tt.opts)
+		if err != tt.err || (err == nil && r != tt.exp) {
+			t.Errorf("%v: expected %+v %v, got %+v %v", tt.opts, tt.exp, tt.err, r, err)
+		}
+	}
+}
+
+func TestRouteOptions(t *testing.T) {
+	routes := []route{
+		{},
+		{read: readTargetFallbackSource, write: writeBoth, targetPrimary: true, strict: true, scriptsPrimary: true},
+		{read: readTarget, write: writeTarget},
+	}
+	for _, r := range routes {
+		parsed, err := parseRoute(route{}, r.options())
+		if err != nil || parsed != r {
+			t.Errorf("%v: expected %+v, got %+v %v", r.options(), r, parsed, err)
+		}
+	}
+	exp := []string{"read", "source", "write", "both", "primary", "source", "secondary-errors", "ignore", "scripts", "both"}
+	if opts := (route{write: writeBoth}).options(); !reflect.DeepEqual(opts, exp) {
+		t.Errorf("expected %v, got %v", exp, opts)
+	}
+}
+
+func TestRouteFlag(t *testing.T) {
+	saved := policy
+	defer func() { policy = saved }()
+	tests := []struct {
+		args []string
+		exp  route
+		fail bool
+	}{
+		{nil, route{write: writeBoth}, false},
+		{[]string{"-read", "target", "-write", "target"}, route{read: readTarget, write: writeTarget}, false},
+		{[]string{"-primary", "target", "-scripts", "primary"}, route{write: writeBoth, targetPrimary: true, scriptsPrimary: true}, false},
+		{[]string{"-secondary-errors", "fail"}, route{write: writeBoth, strict: true}, false},
+		{[]string{"-read", "nowhere"}, route{}, true},
+	}
+	for _, tt := range tests {
+		policy = route{write: writeBoth}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		for _, option := range []string{"read", "write", "primary", "secondary-errors", "scripts"} {
+			fs.Var(routeFlag(option), option, "")
+		}
+		err := fs.Parse(tt.args)
+		if (err != nil) != tt.fail || (err == nil && policy != tt.exp) {
+			t.Errorf("%v: expected %+v, got %+v %v", tt.args, tt.exp, policy, err)
+		}
+		if err == nil && fs.Lookup("read").Value.String() != tt.exp.read.String() {
+			t.Errorf("%v: expected read %s, got %s", tt.args, tt.exp.read, fs.Lookup("read").Value)
+		}
+	}
+}
+
+func TestWriters(t *testing.T) {
+	p := &proxy{source: &upstream{name: "source"}, target: &upstream{name: "target"}}
+	tests := []struct {
+		r         route
+		synced    bool
+		excluded  bool
+		primary   *upstream
+		secondary *upstream
+		err       error
+	}{
+		{route{write: writeSource}, false, false, p.source, nil, nil},
+		{route{write: writeTarget}, false, false, p.target, nil, nil},
+		{route{write: writeBoth}, false, false, p.source, p.target, nil},
+		{route{write: writeBoth, targetPrimary: true}, false, false, p.target, p.source, nil},
+		{route{write: writeBoth}, true, false, p.source, nil, nil},
+		{route{write: writeBoth, targetPrimary: true}, true, false, p.source, nil, nil},
+		{route{write: writeTarget}, true, false, p.target, nil, nil},
+		{route{write: writeBoth}, false, true, p.source, nil, nil},
+		{route{write: writeTarget}, false, true, nil, nil, errExcluded},
+	}
+	for _, tt := range tests {
+		p.synced = tt.synced
+		primary, secondary, err := p.writers(tt.r, tt.excluded)
+		if primary != tt.primary || secondary != tt.secondary || err != tt.err {
+			t.Errorf("%+v synced %v excluded %v: expected %v %v %v, got %v %v %v", tt.r, tt.synced, tt.excluded,
+				tt.primary, tt.secondary, tt.err, primary, secondary, err)
+		}
+	}
+}
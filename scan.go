@@ -1,3 +1,9 @@
+//go:build ignore
+// +build ignore
+
+// scan.go is a standalone migrator without the proxy:
+//
+//	go run scan.go migrate.go -s source -t target
 package main
 
 import (
@@ -89,12 +95,9 @@ func clusterMigrate(sourceClient, targetClient *redis.ClusterClient) {
 				}
 				log.Println("addr", addr, "cursor:", cursor)
 				for _, key := range page {
-					val, ok := sourceNodeClient.Get(key).Result()
-					if ok != nil {
-						continue
+					if err := migrateKey(sourceNodeClient, targetClient, key); err != nil {
+						log.Println("migrate key:", key, err)
 					}
-					duration, _ := sourceNodeClient.TTL(key).Result()
-					targetClient.Set(key, val, duration)
 				}
 
 				if cursor <= 0 {
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"sync"
+
+	"redisp/redcon"
+)
+
+// scriptCache holds the scripts and function libraries the clients loaded
+// through the proxy, so they can be loaded again on a backend node that
+// does not know them, like the target of a migration or a node that
+// restarted.
+type scriptCache struct {
+	mu      sync.RWMutex
+	scripts map[string]string // sha1 -> script
+	libs    map[string]string // library name -> code
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{
+		scripts: make(map[string]string),
+		libs:    make(map[string]string),
+	}
+}
+
+// add caches a script and returns its sha1.
+func (c *scriptCache) add(script string) string {
+	sum := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(sum[:])
+	c.mu.Lock()
+	c.scripts[sha] = script
+	c.mu.Unlock()
+	return sha
+}
+
+func (c *scriptCache) exists(sha string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.scripts[strings.ToLower(sha)]
+	return ok
+}
+
+// commands returns the commands that load every cached script and library.
+func (c *scriptCache) commands() [][]byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var cmds [][]byte
+	for _, script := range c.scripts {
+		cmds = append(cmds, appendCommand(nil, "SCRIPT", "LOAD", script))
+	}
+	for _, code := range c.libs {
+		cmds = append(cmds, appendCommand(nil, "FUNCTION", "LOAD", "REPLACE", code))
+	}
+	return cmds
+}
+
+// appendCommand appends a command of bulk strings to b.
+func appendCommand(b []byte, args ...string) []byte {
+	b = redcon.AppendArray(b, len(args))
+	for _, arg := range args {
+		b = redcon.AppendBulkString(b, arg)
+	}
+	return b
+}
+
+// isMissingScript reports whether reply is the error of a script or
+// function the node does not know.
+func isMissingScript(reply []byte) bool {
+	return bytes.HasPrefix(reply, []byte("-NOSCRIPT")) ||
+		bytes.HasPrefix(reply, []byte("-ERR Function not found"))
+}
+
+// do sends bc to u like upstream.do. When a script is missing on the node,
+// the cached scripts and libraries are loaded on it and bc is sent again.
+func (p *proxy) do(u *upstream, bc *backendCmd, fn func(reply []byte)) error {
+	if !bc.script {
+		return u.do(bc.slot, bc.proto, bc.raw, fn)
+	}
+	missing := false
+	err := u.do(bc.slot, bc.proto, bc.raw, func(reply []byte) {
+		if missing = isMissingScript(reply); !missing {
+			fn(reply)
+		}
+	})
+	if err != nil || !missing {
+		return err
+	}
+	for _, cmd := range p.scripts.commands() {
+		if err := u.do(bc.slot, bc.proto, cmd, func([]byte) {}); err != nil {
+			return err
+		}
+	}
+	return u.do(bc.slot, bc.proto, bc.raw, fn)
+}
+
+// cacheScript caches the script of EVAL and EVAL_RO.
+func (p *proxy) cacheScript(cmd redcon.Command) {
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "eval", "eval_ro":
+		p.scripts.add(string(cmd.Args[1]))
+	}
+}
+
+var libName = regexp.MustCompile(`^#!\w+.*\sname=(\S+)`)
+
+// scriptCommand runs SCRIPT and FUNCTION. Loading and deleting are sent to
+// every master of both clusters, the other subcommands are served by a
+// master of the write primary.
+func (p *proxy) scriptCommand(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	name := strings.ToLower(string(cmd.Args[0]))
+	sub := strings.ToLower(string(cmd.Args[1]))
+	switch name + " " + sub {
+	case "script load":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'script|load' command")
+			return
+		}
+		if p.broadcast(conn, cmd.Raw) {
+			p.scripts.add(string(cmd.Args[2]))
+		}
+	case "script exists":
+		conn.WriteArray(len(cmd.Args) - 2)
+		for _, sha := range cmd.Args[2:] {
+			if p.scripts.exists(string(sha)) {
+				conn.WriteInt(1)
+			} else {
+				conn.WriteInt(0)
+			}
+		}
+	case "script flush":
+		p.scripts.mu.Lock()
+		p.scripts.scripts = make(map[string]string)
+		p.scripts.mu.Unlock()
+		p.broadcast(conn, cmd.Raw)
+	case "function load":
+		code := string(cmd.Args[len(cmd.Args)-1])
+		m := libName.FindStringSubmatch(code)
+		if len(cmd.Args) < 3 || m == nil {
+			conn.WriteError("ERR Library metadata is missing or invalid")
+			return
+		}
+		if p.broadcast(conn, cmd.Raw) {
+			p.scripts.mu.Lock()
+			p.scripts.libs[m[1]] = code
+			p.scripts.mu.Unlock()
+		}
+	case "function delete":
+		if p.broadcast(conn, cmd.Raw) && len(cmd.Args) == 3 {
+			p.scripts.mu.Lock()
+			delete(p.scripts.libs, string(cmd.Args[2]))
+			p.scripts.mu.Unlock()
+		}
+	case "function flush":
+		if p.broadcast(conn, cmd.Raw) {
+			p.scripts.mu.Lock()
+			p.scripts.libs = make(map[string]string)
+			p.scripts.mu.Unlock()
+		}
+	default:
+		primary, _, err := p.writers(p.route(), false)
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		p.reply(conn, primary, &backendCmd{raw: cmd.Raw, slot: -1, proto: conn.Protocol()})
+	}
+}
+
+// broadcast sends raw to every master of both clusters and writes the
+// reply of the write primary, or the first error. It reports whether all
+// the masters succeeded.
+func (p *proxy) broadcast(conn redcon.Conn, raw []byte) bool {
+	primary, _, err := p.writers(p.route(), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return false
+	}
+	var reply, errReply []byte
+	for _, u := range []*upstream{p.source, p.target} {
+		for _, addr := range u.masters() {
+			err := u.poolAddr(addr).do(conn.Protocol(), raw, func(b []byte) {
+				switch {
+				case b[0] == '-':
+					if errReply == nil {
+						errReply = append([]byte(nil), b...)
+					}
+				case u == primary && reply == nil:
+					reply = append([]byte(nil), b...)
+				}
+			})
+			if err != nil && errReply == nil {
+				errReply = redcon.AppendError(nil, "ERR "+u.name+" "+addr+": "+err.Error())
+			}
+		}
+	}
+	switch {
+	case errReply != nil:
+		conn.WriteRaw(errReply)
+	case reply != nil:
+		conn.WriteRaw(reply)
+	default:
+		conn.WriteError("ERR " + errNoNodes.Error())
+	}
+	return errReply == nil && reply != nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	"redisp/redcon"
+)
+
+func TestScriptLoad(t *testing.T) {
+	const script = "return(1)"
+	sum := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(sum[:])
+	node := func(fail *bool) string {
+		return fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+			if *fail {
+				conn.WriteError("ERR Error compiling script")
+				return
+			}
+			conn.WriteBulkString(sha)
+		})
+	}
+	var sourceFails, targetFails bool
+	source := &topology{mode: modeStandalone, addrs: []string{node(&sourceFails)}}
+	target := &topology{mode: modeStandalone, addrs: []string{node(&targetFails)}}
+	p := &proxy{
+		source:  newUpstream("source", source, nil, 0),
+		target:  newUpstream("target", target, nil, 0),
+		policy:  route{write: writeBoth},
+		scripts: newScriptCache(),
+	}
+
+	targetFails = true
+	conn := newTestConn("127.0.0.1:6379")
+	p.scriptCommand(conn, parseCommand("script load "+script))
+	if reply := conn.reply(); reply != "ERR Error compiling script" {
+		t.Fatalf("expected the error of the target, got %v", reply)
+	}
+	if p.scripts.exists(sha) {
+		t.Fatal("expected a script that failed to load not to be cached")
+	}
+
+	targetFails = false
+	p.scriptCommand(conn, parseCommand("script load "+script))
+	if reply := conn.reply(); reply != sha {
+		t.Fatalf("expected %s, got %v", sha, reply)
+	}
+	if !p.scripts.exists(sha) {
+		t.Fatal("expected the script to be cached")
+	}
+}
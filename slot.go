@@ -0,0 +1,49 @@
+package main
+
+// slotCount is the number of hash slots of a redis cluster.
+const slotCount = 16384
+
+// crc16tab is the CRC16 (XMODEM) table used by redis cluster.
+var crc16tab = func() [256]uint16 {
+	var tab [256]uint16
+	for i := range tab {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		tab[i] = crc
+	}
+	return tab
+}()
+
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc = crc<<8 ^ crc16tab[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+// keySlot returns the hash slot of key. When the key holds a non empty hash
+// tag like "{user1000}.following" only the tag is hashed.
+func keySlot(key []byte) int {
+	for i, c := range key {
+		if c != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j > i+1 {
+					key = key[i+1 : j]
+				}
+				return int(crc16(key)) % slotCount
+			}
+		}
+		break
+	}
+	return int(crc16(key)) % slotCount
+}
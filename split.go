@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"redisp/redcon"
+)
+
+// splitPart is the part of a split command with the keys of one slot.
+type splitPart struct {
+	slot       int
+	targetSlot int   // -2 when the keys are not migrated
+	keys       []int // the indexes of the keys of the part among all keys
+	args       [][]byte
+	reply      []byte
+}
+
+// split runs a multi-key command whose keys hash to different slots as one
+// command per slot, sent in parallel, and merges the replies in the order
+// of the keys. It reports false when the keys hash to a single slot, on
+// both clusters, and the command is to be forwarded as is.
+func (p *proxy) split(conn redcon.Conn, cmd redcon.Command, info *commandInfo) bool {
+	pos := keyPositions(info, cmd.Args)
+	index := make(map[[2]int]*splitPart)
+	var parts []*splitPart
+	for n, i := range pos {
+		key := cmd.Args[i]
+		k := [2]int{keySlot(key), -1}
+		if keyRules != nil {
+			if name := string(key); !keyRules.matchName(name) {
+				k[1] = -2
+			} else {
+				k[1] = keySlot([]byte(keyRules.rename(name)))
+			}
+		}
+		part := index[k]
+		if part == nil {
+			part = &splitPart{slot: k[0], targetSlot: k[1], args: [][]byte{cmd.Args[0]}}
+			index[k] = part
+			parts = append(parts, part)
+		}
+		part.keys = append(part.keys, n)
+		end := i + info.step
+		if end > len(cmd.Args) {
+			end = len(cmd.Args)
+		}
+		part.args = append(part.args, cmd.Args[i:end]...)
+	}
+	if len(parts) < 2 {
+		return false
+	}
+	var wg sync.WaitGroup
+	for _, part := range parts {
+		wg.Add(1)
+		go func(part *splitPart) {
+			defer wg.Done()
+			pc := newPartConn(conn)
+			p.forward(pc, redcon.Command{Raw: appendArgs(nil, part.args...), Args: part.args})
+			part.reply = pc.wr.Buffer()
+		}(part)
+	}
+	wg.Wait()
+	mergeReplies(conn, info, parts, len(pos))
+	return true
+}
+
+// splitArgs splits the arguments of a multi-key command into one command
+// per slot of its keys, in the order of the first key of each slot. It
+// returns nil when the keys hash to a single slot.
+func splitArgs(info *commandInfo, args [][]byte) [][][]byte {
+	index := make(map[int]int)
+	var parts [][][]byte
+	for _, i := range keyPositions(info, args) {
+		slot := keySlot(args[i])
+		n, ok := index[slot]
+		if !ok {
+			n = len(parts)
+			index[slot] = n
+			parts = append(parts, [][]byte{args[0]})
+		}
+		end := i + info.step
+		if end > len(args) {
+			end = len(args)
+		}
+		parts[n] = append(parts[n], args[i:end]...)
+	}
+	if len(parts) < 2 {
+		return nil
+	}
+	return parts
+}
+
+// mergeReplies writes the reply of a split command, or the first error of
+// its parts.
+func mergeReplies(conn redcon.Conn, info *commandInfo, parts []*splitPart, nkeys int) {
+	for _, part := range parts {
+		if len(part.reply) == 0 {
+			conn.WriteError("ERR no reply from backend")
+			return
+		}
+		if part.reply[0] == '-' {
+			conn.WriteRaw(part.reply)
+			return
+		}
+	}
+	switch info.merge {
+	case mergeArray:
+		items := make([][]byte, nkeys)
+		for _, part := range parts {
+			_, resp := redcon.ReadNextRESP(part.reply)
+			elems := respItems(resp)
+			if len(elems) != len(part.keys) {
+				conn.WriteError("ERR unexpected reply from backend")
+				return
+			}
+			for j, n := range part.keys {
+				items[n] = elems[j].Raw
+			}
+		}
+		conn.WriteArray(nkeys)
+		for _, item := range items {
+			conn.WriteRaw(item)
+		}
+	case mergeSum:
+		sum := 0
+		for _, part := range parts {
+			_, resp := redcon.ReadNextRESP(part.reply)
+			n, err := strconv.Atoi(string(resp.Data))
+			if resp.Type != redcon.Integer || err != nil {
+				conn.WriteError("ERR unexpected reply from backend")
+				return
+			}
+			sum += n
+		}
+		conn.WriteInt(sum)
+	case mergeOK:
+		conn.WriteString("OK")
+	}
+}
+
+// partConn collects the reply of a part of a split command. The parts run
+// in parallel, so they have no session: the context of the client is not
+// shared with them.
+type partConn struct {
+	redcon.Conn
+	wr *redcon.Writer
+}
+
+func newPartConn(conn redcon.Conn) *partConn {
+	wr := redcon.NewWriter(nil)
+	wr.SetProtocol(conn.Protocol())
+	return &partConn{Conn: conn, wr: wr}
+}
+
+func (c *partConn) Context() interface{}        { return nil }
+func (c *partConn) SetContext(v interface{})    {}
+func (c *partConn) WriteError(msg string)       { c.wr.WriteError(msg) }
+func (c *partConn) WriteString(str string)      { c.wr.WriteString(str) }
+func (c *partConn) WriteBulk(bulk []byte)       { c.wr.WriteBulk(bulk) }
+func (c *partConn) WriteBulkString(bulk string) { c.wr.WriteBulkString(bulk) }
+func (c *partConn) WriteInt(num int)            { c.wr.WriteInt(num) }
+func (c *partConn) WriteInt64(num int64)        { c.wr.WriteInt64(num) }
+func (c *partConn) WriteUint64(num uint64)      { c.wr.WriteUint64(num) }
+func (c *partConn) WriteArray(count int)        { c.wr.WriteArray(count) }
+func (c *partConn) WriteNull()                  { c.wr.WriteNull() }
+func (c *partConn) WriteRaw(data []byte)        { c.wr.WriteRaw(data) }
+func (c *partConn) WriteAny(v interface{})      { c.wr.WriteAny(v) }
+func (c *partConn) WriteMap(count int)          { c.wr.WriteMap(count) }
+func (c *partConn) WriteSet(count int)          { c.wr.WriteSet(count) }
+func (c *partConn) WritePush(count int)         { c.wr.WritePush(count) }
+func (c *partConn) WriteAttribute(count int)    { c.wr.WriteAttribute(count) }
+func (c *partConn) WriteDouble(num float64)     { c.wr.WriteDouble(num) }
+func (c *partConn) WriteBool(t bool)            { c.wr.WriteBool(t) }
+func (c *partConn) WriteBigNumber(num string)   { c.wr.WriteBigNumber(num) }
+func (c *partConn) WriteVerbatim(format, text string) {
+	c.wr.WriteVerbatim(format, text)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"redisp/redcon"
+)
+
+func TestSplit(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	node := fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		mu.Lock()
+		sent = append(sent, string(bytes.Join(cmd.Args, []byte(" "))))
+		mu.Unlock()
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "mget":
+			conn.WriteArray(len(cmd.Args) - 1)
+			for _, key := range cmd.Args[1:] {
+				conn.WriteBulkString("v" + string(key))
+			}
+		case "del":
+			conn.WriteInt(len(cmd.Args) - 1)
+		case "mset":
+			conn.WriteString("OK")
+		}
+	})
+	p := &proxy{
+		source: newUpstream("source", &topology{mode: modeStandalone, addrs: []string{node}}, nil, 0),
+		policy: route{read: readSource, write: writeSource},
+	}
+	tests := []struct {
+		cmd   string
+		reply interface{}
+		sent  []string
+	}{
+		{"mget a b {a}c", []interface{}{"va", "vb", "v{a}c"}, []string{"mget a {a}c", "mget b"}},
+		{"mget {a}1 {a}2", []interface{}{"v{a}1", "v{a}2"}, []string{"mget {a}1 {a}2"}},
+		{"del a b {b}c", 3, []string{"del a", "del b {b}c"}},
+		{"mset a 1 b 2", "OK", []string{"mset a 1", "mset b 2"}},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		sent = nil
+		mu.Unlock()
+		conn := newTestConn("127.0.0.1:6380")
+		p.forward(conn, parseCommand(tt.cmd))
+		if reply := conn.reply(); !reflect.DeepEqual(reply, tt.reply) {
+			t.Errorf("%q: expected %v, got %v", tt.cmd, tt.reply, reply)
+		}
+		// the parts are sent in parallel
+		mu.Lock()
+		sort.Strings(sent)
+		if !reflect.DeepEqual(sent, tt.sent) {
+			t.Errorf("%q: expected %q sent, got %q", tt.cmd, tt.sent, sent)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		parts []string
+	}{
+		{"mget a", nil},
+		{"mget {x}a {x}b", nil},
+		{"mget a b", []string{"mget a", "mget b"}},
+		{"mget a b {a}c", []string{"mget a {a}c", "mget b"}},
+		{"del {b}x a b", []string{"del {b}x b", "del a"}},
+		{"mset a 1 b 2 {a}c 3", []string{"mset a 1 {a}c 3", "mset b 2"}},
+		{"mset a 1 b", []string{"mset a 1", "mset b"}},
+	}
+	for _, tt := range tests {
+		args := parseArgs(tt.cmd)
+		var parts [][][]byte
+		for _, part := range tt.parts {
+			parts = append(parts, parseArgs(part))
+		}
+		if got := splitArgs(commands[string(args[0])], args); !reflect.DeepEqual(got, parts) {
+			t.Errorf("%q: expected %q, got %q", tt.cmd, parts, got)
+		}
+	}
+}
+
+func TestMergeReplies(t *testing.T) {
+	tests := []struct {
+		merge   int
+		keys    [][]int
+		replies []string
+		exp     string
+	}{
+		{mergeArray, [][]int{{0, 2}, {1}},
+			[]string{"*2\r\n$1\r\na\r\n$1\r\nc\r\n", "*1\r\n$-1\r\n"},
+			"*3\r\n$1\r\na\r\n$-1\r\n$1\r\nc\r\n"},
+		{mergeArray, [][]int{{0, 2}, {1}},
+			[]string{"*1\r\n$1\r\na\r\n", "*1\r\n$1\r\nb\r\n"},
+			"-ERR unexpected reply from backend\r\n"},
+		{mergeSum, [][]int{{0}, {1, 2}}, []string{":1\r\n", ":2\r\n"}, ":3\r\n"},
+		{mergeSum, [][]int{{0}, {1}}, []string{":1\r\n", "+OK\r\n"}, "-ERR unexpected reply from backend\r\n"},
+		{mergeOK, [][]int{{0}, {1}}, []string{"+OK\r\n", "+OK\r\n"}, "+OK\r\n"},
+		{mergeOK, [][]int{{0}, {1}}, []string{"+OK\r\n", "-MOVED 1 127.0.0.1:7000\r\n"}, "-MOVED 1 127.0.0.1:7000\r\n"},
+		{mergeSum, [][]int{{0}, {1}}, []string{":1\r\n", ""}, "-ERR no reply from backend\r\n"},
+	}
+	for _, tt := range tests {
+		var parts []*splitPart
+		nkeys := 0
+		for i, reply := range tt.replies {
+			parts = append(parts, &splitPart{keys: tt.keys[i], reply: []byte(reply)})
+			nkeys += len(tt.keys[i])
+		}
+		conn := &partConn{wr: redcon.NewWriter(nil)}
+		mergeReplies(conn, &commandInfo{merge: tt.merge}, parts, nkeys)
+		if reply := string(conn.wr.Buffer()); reply != tt.exp {
+			t.Errorf("%q: expected %q, got %q", tt.replies, tt.exp, reply)
+		}
+	}
+}
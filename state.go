@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// nodeState is the migration progress of a single source node. The dbs
+// other than 0 of a standalone source are nodes named addr/db.
+type nodeState struct {
+	Addr    string `json:"addr"`
+	Cursor  uint64 `json:"cursor"`
+	Keys    int64  `json:"keys"`
+	Errors  int64  `json:"errors"`
+	Skipped int64  `json:"skipped"`
+	Done    bool   `json:"done"`
+}
+
+// migrateState is the migration progress of every source node. It is
+// checkpointed to a local file after each scanned page, so an interrupted
+// migration can resume from the last cursor of each node. The phase of the
+// migration and the routing policy to restore on rollback are saved with
+// it, as the route options.
+type migrateState struct {
+	mu     sync.Mutex
+	path   string
+	Nodes  map[string]*nodeState `json:"nodes"`
+	Phase  string                `json:"phase,omitempty"`
+	Before []string              `json:"before,omitempty"`
+}
+
+// newState returns an empty state that is saved to path.
+func newState(path string) *migrateState {
+	return &migrateState{
+		path:  path,
+		Nodes: make(map[string]*nodeState),
+	}
+}
+
+// loadState reads the state saved at path. A missing file is an empty state.
+func loadState(path string) (*migrateState, error) {
+	s := newState(path)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Nodes == nil {
+		s.Nodes = make(map[string]*nodeState)
+	}
+	return s, nil
+}
+
+// node returns a copy of the progress of the node at addr.
+func (s *migrateState) node(addr string) nodeState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := s.Nodes[addr]; ok {
+		return *n
+	}
+	return nodeState{Addr: addr}
+}
+
+// checkpoint records the progress of a node and saves the state.
+func (s *migrateState) checkpoint(n nodeState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Nodes[n.Addr] = &n
+	return s.save()
+}
+
+// register adds a node that is not known yet, so done waits for it before
+// its first checkpoint.
+func (s *migrateState) register(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Nodes[addr]; ok {
+		return nil
+	}
+	s.Nodes[addr] = &nodeState{Addr: addr}
+	return s.save()
+}
+
+// setPhase records the phase of the migration and the routing policy to
+// restore on rollback, and saves the state.
+func (s *migrateState) setPhase(phase string, before []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Phase, s.Before = phase, before
+	return s.save()
+}
+
+// phase returns the recorded phase and routing policy.
+func (s *migrateState) phase() (string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Phase, s.Before
+}
+
+// done reports whether every known node has finished.
+func (s *migrateState) done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.Nodes {
+		if !n.Done {
+			return false
+		}
+	}
+	return len(s.Nodes) > 0
+}
+
+// save writes the state to a temporary file and renames it over the
+// state file, so a crash never leaves a truncated checkpoint behind.
+// The caller must hold s.mu.
+func (s *migrateState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tempState returns the path of a state file removed when the test ends.
+func tempState(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "redisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "redisp.state")
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	path := tempState(t)
+	s := newState(path)
+	nodes := []nodeState{
+		{Addr: "127.0.0.1:7000", Cursor: 42, Keys: 100, Errors: 1},
+		{Addr: "127.0.0.1:7001", Keys: 250, Done: true},
+		{Addr: "127.0.0.1:6379/3", Cursor: 7, Keys: 3},
+	}
+	for _, n := range nodes {
+		if err := s.checkpoint(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.setPhase("syncing", []string{"read", "source"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected no temporary file, got %v", err)
+	}
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		if got := loaded.node(n.Addr); got != n {
+			t.Errorf("expected %+v, got %+v", n, got)
+		}
+	}
+	if phase, before := loaded.phase(); phase != "syncing" || !reflect.DeepEqual(before, []string{"read", "source"}) {
+		t.Errorf("expected syncing [read source], got %s %v", phase, before)
+	}
+}
+
+func TestStateResume(t *testing.T) {
+	path := tempState(t)
+	s := newState(path)
+	s.checkpoint(nodeState{Addr: "a", Cursor: 10, Keys: 5})
+	s.checkpoint(nodeState{Addr: "a", Cursor: 20, Keys: 9})
+
+	// a node is resumed from its last checkpoint, an unknown node starts
+	// from the first cursor
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := loaded.node("a"); n.Cursor != 20 || n.Keys != 9 {
+		t.Fatalf("expected cursor 20 and 9 keys, got %+v", n)
+	}
+	if n := loaded.node("b"); n != (nodeState{Addr: "b"}) {
+		t.Fatalf("expected an empty node, got %+v", n)
+	}
+	// the copy of a node is not changed by a later checkpoint
+	n := loaded.node("a")
+	n.Cursor = 30
+	if loaded.node("a").Cursor != 20 {
+		t.Fatal("node returned the state of the node instead of a copy")
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	tests := []struct {
+		data  string
+		nodes int
+		fail  bool
+	}{
+		{"", 0, true},
+		{"{", 0, true},
+		{"{}", 0, false},
+		{`{"nodes":null}`, 0, false},
+		{`{"nodes":{"a":{"addr":"a","cursor":3}}}`, 1, false},
+	}
+	for _, tt := range tests {
+		path := tempState(t)
+		if err := ioutil.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := loadState(path)
+		if (err != nil) != tt.fail {
+			t.Errorf("%q: expected failure %v, got %v", tt.data, tt.fail, err)
+			continue
+		}
+		if err == nil && len(s.Nodes) != tt.nodes {
+			t.Errorf("%q: expected %d nodes, got %d", tt.data, tt.nodes, len(s.Nodes))
+		}
+	}
+	s, err := loadState(tempState(t))
+	if err != nil || s.Nodes == nil || len(s.Nodes) != 0 {
+		t.Fatalf("expected an empty state for a missing file, got %+v %v", s, err)
+	}
+}
+
+func TestStateDone(t *testing.T) {
+	tests := []struct {
+		nodes []nodeState
+		done  bool
+	}{
+		{nil, false},
+		{[]nodeState{{Addr: "a"}}, false},
+		{[]nodeState{{Addr: "a", Done: true}}, true},
+		{[]nodeState{{Addr: "a", Done: true}, {Addr: "b", Cursor: 5}}, false},
+		{[]nodeState{{Addr: "a", Done: true}, {Addr: "b", Done: true}}, true},
+	}
+	for _, tt := range tests {
+		s := newState(tempState(t))
+		for _, n := range tt.nodes {
+			s.checkpoint(n)
+		}
+		if done := s.done(); done != tt.done {
+			t.Errorf("%+v: expected %v, got %v", tt.nodes, tt.done, done)
+		}
+	}
+}
+
+func TestStateRegister(t *testing.T) {
+	s := newState(tempState(t))
+	s.checkpoint(nodeState{Addr: "a", Keys: 3, Done: true})
+	s.register("a")
+	s.register("b")
+	if n := s.node("a"); !n.Done || n.Keys != 3 {
+		t.Fatalf("expected the checkpoint of a to be kept, got %+v", n)
+	}
+	if s.done() {
+		t.Fatal("expected the registered node b to hold back done")
+	}
+	s.checkpoint(nodeState{Addr: "b", Done: true})
+	if !s.done() {
+		t.Fatal("expected done once b finished")
+	}
+}
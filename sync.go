@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redisp/redcon"
+
+	"github.com/go-redis/redis"
+)
+
+// syncNode is the replication progress of a single source node.
+type syncNode struct {
+	addr   string
+	replID string
+	// offset is the replication offset applied to the target, accessed
+	// atomically.
+	offset int64
+	// applied is the unix time in nanoseconds of the last command applied
+	// to the target, accessed atomically.
+	applied int64
+
+	mu   sync.Mutex // guards writes to conn
+	conn net.Conn
+
+	// client queries the replication offset of the source, and dbs are
+	// clients of its other dbs
+	client *redis.Client
+	dbs    map[int]*redis.Client
+
+	// state marks the node done once a snapshot is loaded
+	state *migrateState
+}
+
+// syncCmd is a replicated command and the db it was run on.
+type syncCmd struct {
+	db   int
+	args [][]byte
+}
+
+// Offset returns the replication offset applied to the target.
+func (n *syncNode) Offset() int64 {
+	return atomic.LoadInt64(&n.offset)
+}
+
+var (
+	syncMu    sync.Mutex
+	syncNodes = make(map[string]*syncNode)
+)
+
+// lag returns the number of bytes of the replication stream of the source
+// that are not applied to the target yet.
+func (n *syncNode) lag() (int64, error) {
+	info, err := n.client.Info("replication").Result()
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.ParseInt(infoField(info, "master_repl_offset"), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if lag := offset - n.Offset(); lag > 0 {
+		return lag, nil
+	}
+	return 0, nil
+}
+
+// syncLag returns the total lag of the synced nodes. It is 0 when the live
+// sync is not enabled.
+func syncLag() (int64, error) {
+	syncMu.Lock()
+	nodes := make([]*syncNode, 0, len(syncNodes))
+	for _, n := range syncNodes {
+		nodes = append(nodes, n)
+	}
+	syncMu.Unlock()
+	var total int64
+	for _, n := range nodes {
+		lag, err := n.lag()
+		if err != nil {
+			return 0, err
+		}
+		total += lag
+	}
+	return total, nil
+}
+
+// nodeSync acts as a replica of the source node at addr and applies its
+// replication stream to target until the process exits. A broken link is
+// resumed with PSYNC from the last applied offset. The snapshot of the full
+// resync takes the place of the copy of the node, which is marked done in
+// state once the snapshot is loaded.
+func nodeSync(addr string, target redis.UniversalClient, state *migrateState) {
+	n := &syncNode{
+		addr:   addr,
+		offset: -1,
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		dbs:    make(map[int]*redis.Client),
+		state:  state,
+	}
+	syncMu.Lock()
+	syncNodes[addr] = n
+	syncMu.Unlock()
+	for {
+		err := n.sync(target)
+		log.Println("sync", addr, "link lost:", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// sync runs a single replication link.
+func (n *syncNode) sync(target redis.UniversalClient) error {
+	conn, err := net.Dial("tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	n.mu.Lock()
+	n.conn = conn
+	n.mu.Unlock()
+
+	rd := bufio.NewReader(conn)
+	if err := n.send("REPLCONF", "capa", "psync2"); err != nil {
+		return err
+	}
+	if line, err := readLine(rd); err != nil {
+		return err
+	} else if line[0] == '-' {
+		return errors.New(line[1:])
+	}
+	replID, offset := "?", "-1"
+	if n.replID != "" {
+		replID = n.replID
+		offset = strconv.FormatInt(n.Offset()+1, 10)
+	}
+	if err := n.send("PSYNC", replID, offset); err != nil {
+		return err
+	}
+	line, err := readLine(rd)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case fields[0] == "+FULLRESYNC" && len(fields) == 3:
+		off, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		n.replID = fields[1]
+		atomic.StoreInt64(&n.offset, off)
+		log.Println("sync", n.addr, "full resync, replid:", n.replID, "offset:", off)
+		if err := n.readSnapshot(rd, target); err != nil {
+			return err
+		}
+	case fields[0] == "+CONTINUE":
+		if len(fields) == 2 {
+			n.replID = fields[1]
+		}
+		log.Println("sync", n.addr, "continue from offset:", n.Offset())
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", line)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go n.ack(done)
+	return n.stream(redcon.NewReader(rd), target)
+}
+
+// readSnapshot reads the RDB snapshot that follows FULLRESYNC and writes its
+// keys to target, so the command stream after it applies on top of the same
+// data set as on the source.
+func (n *syncNode) readSnapshot(rd *bufio.Reader, target redis.UniversalClient) error {
+	line, err := readLine(rd)
+	if err != nil {
+		return err
+	}
+	if line[0] != '$' {
+		return fmt.Errorf("unexpected snapshot header %q", line)
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil {
+		return err
+	}
+	log.Println("sync", n.addr, "load snapshot, bytes:", size)
+	snapshot := io.LimitReader(rd, size)
+	keys, err := importRDB(snapshot, target, -1)
+	if err != nil {
+		return err
+	}
+	log.Println("sync", n.addr, "snapshot loaded, keys:", keys)
+	if err := n.state.checkpoint(nodeState{Addr: n.addr, Keys: keys, Done: true}); err != nil {
+		log.Println("sync", n.addr, "checkpoint:", err)
+	}
+	// skip the checksum
+	_, err = io.Copy(ioutil.Discard, snapshot)
+	return err
+}
+
+// stream applies the replicated commands to target. The commands of a
+// MULTI/EXEC block are held until EXEC and applied together, and the offset
+// only moves past the block once it is applied.
+func (n *syncNode) stream(rd *redcon.Reader, target redis.UniversalClient) error {
+	db := 0
+	var tx []syncCmd
+	var multi bool
+	var pending int64
+	for {
+		cmd, err := rd.ReadCommand()
+		if err != nil {
+			return err
+		}
+		name := strings.ToLower(string(cmd.Args[0]))
+		switch name {
+		case "ping":
+			// keepalive
+		case "multi":
+			multi, tx = true, tx[:0]
+		case "exec":
+			n.apply(target, tx, true)
+			multi, tx = false, tx[:0]
+		case "select":
+			db, _ = strconv.Atoi(string(cmd.Args[1]))
+		case "replconf":
+			if len(cmd.Args) > 1 && strings.EqualFold(string(cmd.Args[1]), "getack") {
+				// the GETACK itself is not counted in the offset
+				if err := n.send("REPLCONF", "ACK", strconv.FormatInt(n.Offset(), 10)); err != nil {
+					return err
+				}
+			}
+		default:
+			if !multi {
+				n.apply(target, []syncCmd{{db: db, args: cmd.Args}}, false)
+				break
+			}
+			// the reader reuses its buffer
+			args := make([][]byte, len(cmd.Args))
+			for i, arg := range cmd.Args {
+				args[i] = append([]byte(nil), arg...)
+			}
+			tx = append(tx, syncCmd{db: db, args: args})
+		}
+		pending += int64(len(cmd.Raw))
+		if !multi {
+			atomic.AddInt64(&n.offset, pending)
+			pending = 0
+		}
+	}
+}
+
+// apply writes replicated commands to the target, in a transaction when tx
+// is set. The commands are renamed and mapped to their target db by the
+// rules. On a cluster target a command whose keys hash to different slots
+// is split by slot when the proxy splits it too, and a transaction is only
+// atomic on each slot. The other commands across slots cannot run there:
+// their keys are copied from the source instead, once the source ran them,
+// and the keys they deleted are deleted.
+func (n *syncNode) apply(target redis.UniversalClient, cmds []syncCmd, tx bool) {
+	type batch struct {
+		db     int
+		client redis.UniversalClient
+		cmds   []*redis.Cmd
+	}
+	var batches []*batch
+	var copies []syncCmd
+	for _, c := range cmds {
+		dst, ok := keyRules.targetDB(c.db)
+		if !ok {
+			continue
+		}
+		client, err := targetTopo.selectDB(target, dst)
+		if err != nil {
+			log.Println("sync", n.addr, "skip command on db", c.db, string(c.args[0]), "err:", err)
+			continue
+		}
+		parts := [][][]byte{c.args}
+		if info, _ := lookupCommand(redcon.Command{Args: c.args}); info != nil {
+			args, err := keyRules.rewriteArgs(info, c.args)
+			if err != nil {
+				// the keys are not migrated
+				continue
+			}
+			parts[0] = args
+			if targetTopo.mode == modeCluster {
+				if _, msg := commandSlot(info, redcon.Command{Args: args}); msg != "" {
+					if info.merge == mergeNone {
+						copies = append(copies, syncCmd{db: c.db, args: commandKeys(info, c.args)})
+						continue
+					}
+					parts = splitArgs(info, args)
+				}
+			}
+		}
+		if len(batches) == 0 || batches[len(batches)-1].db != dst {
+			batches = append(batches, &batch{db: dst, client: client})
+		}
+		b := batches[len(batches)-1]
+		for _, part := range parts {
+			args := make([]interface{}, len(part))
+			for i, arg := range part {
+				args[i] = string(arg)
+			}
+			b.cmds = append(b.cmds, redis.NewCmd(args...))
+		}
+	}
+	for _, b := range batches {
+		run := b.client.Pipelined
+		if tx {
+			run = b.client.TxPipelined
+		}
+		run(func(pipe redis.Pipeliner) error {
+			for _, cmd := range b.cmds {
+				pipe.Process(cmd)
+			}
+			return nil
+		})
+		for _, cmd := range b.cmds {
+			if err := cmd.Err(); err != nil && err != redis.Nil {
+				log.Println("sync", n.addr, "apply", cmd.Name(), "err:", err)
+			}
+		}
+	}
+	for _, c := range copies {
+		n.copyKeys(target, c.db, c.args)
+	}
+	atomic.StoreInt64(&n.applied, time.Now().UnixNano())
+}
+
+// copyKeys copies keys of db from the source to the target, and deletes
+// those missing on the source from the target.
+func (n *syncNode) copyKeys(target redis.UniversalClient, db int, keys [][]byte) {
+	source := n.client
+	if db != 0 {
+		if source = n.dbs[db]; source == nil {
+			source = redis.NewClient(&redis.Options{Addr: n.addr, DB: db})
+			n.dbs[db] = source
+		}
+	}
+	dst, _ := keyRules.targetDB(db)
+	client, err := targetTopo.selectDB(target, dst)
+	if err != nil {
+		log.Println("sync", n.addr, "skip keys on db", db, "err:", err)
+		return
+	}
+	exists := make([]*redis.IntCmd, len(keys))
+	source.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			exists[i] = pipe.Exists(string(key))
+		}
+		return nil
+	})
+	var copied []string
+	for i, key := range keys {
+		if count, err := exists[i].Result(); err == nil && count == 0 {
+			if err := client.Del(keyRules.rename(string(key))).Err(); err != nil {
+				log.Println("sync", n.addr, "delete key:", string(key), err)
+			}
+			continue
+		}
+		copied = append(copied, string(key))
+	}
+	copyKeys(source, client, copied, true)
+}
+
+// ack reports the applied offset to the source every second, which keeps
+// the replication link alive, until done is closed.
+func (n *syncNode) ack(done chan struct{}) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if err := n.send("REPLCONF", "ACK", strconv.FormatInt(n.Offset(), 10)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// send writes a command to the source.
+func (n *syncNode) send(args ...string) error {
+	b := redcon.AppendArray(nil, len(args))
+	for _, arg := range args {
+		b = redcon.AppendBulkString(b, arg)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err := n.conn.Write(b)
+	return err
+}
+
+// readLine reads a reply line, skipping the empty lines the source sends
+// as keepalive while it prepares the snapshot.
+func readLine(rd *bufio.Reader) (string, error) {
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			return line, nil
+		}
+	}
+}
+
+// infoField returns the value of a field of an INFO reply.
+func infoField(info, name string) string {
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, name+":") {
+			return strings.TrimSpace(line[len(name)+1:])
+		}
+	}
+	return ""
+}
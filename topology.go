@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// topology modes
+const (
+	modeStandalone = "standalone"
+	modeSentinel   = "sentinel"
+	modeCluster    = "cluster"
+)
+
+// topology is how one side of the migration is deployed.
+type topology struct {
+	mode string
+	// addrs are the seed nodes, or the sentinels in sentinel mode
+	addrs []string
+	// master is the name of the master in sentinel mode
+	master string
+}
+
+var (
+	sourceTopo *topology
+	targetTopo *topology
+)
+
+// topologyFlags defines the mode and master flags of side, "source" or
+// "target", on fs. The returned func builds the topology of the address
+// flag once fs is parsed.
+func topologyFlags(fs *flag.FlagSet, side string) func(addr string) (*topology, error) {
+	var mode, master string
+	fs.StringVar(&mode, side+"-mode", modeCluster, side+" topology: standalone, sentinel or cluster")
+	fs.StringVar(&master, side+"-master", "", side+" master name in sentinel mode")
+	return func(addr string) (*topology, error) {
+		return newTopology(addr, mode, master)
+	}
+}
+
+// newTopology returns the topology of the comma separated addresses.
+func newTopology(addr, mode, master string) (*topology, error) {
+	t := &topology{mode: strings.ToLower(mode), master: master}
+	for _, a := range strings.Split(addr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			t.addrs = append(t.addrs, a)
+		}
+	}
+	if len(t.addrs) == 0 {
+		return nil, errors.New("no address")
+	}
+	switch t.mode {
+	case modeStandalone, modeCluster:
+	case modeSentinel:
+		if master == "" {
+			return nil, errors.New("sentinel mode needs a master name")
+		}
+	default:
+		return nil, fmt.Errorf("invalid mode %q", mode)
+	}
+	return t, nil
+}
+
+func (t *topology) String() string {
+	s := t.mode + " " + strings.Join(t.addrs, ",")
+	if t.mode == modeSentinel {
+		s += " master " + t.master
+	}
+	return s
+}
+
+// client returns a client of db. A cluster only has db 0.
+func (t *topology) client(db int) redis.UniversalClient {
+	switch t.mode {
+	case modeStandalone:
+		return redis.NewClient(&redis.Options{
+			Addr:     t.addrs[0],
+			Password: "", // no password set
+			DB:       db,
+		})
+	case modeSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    t.master,
+			SentinelAddrs: t.addrs,
+			Password:      "", // no password set
+			DB:            db,
+		})
+	}
+	return redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:    t.addrs,
+		Password: "", // no password set
+	})
+}
+
+// masterAddr returns the address of the master of a standalone or sentinel
+// topology.
+func (t *topology) masterAddr() (string, error) {
+	if t.mode != modeSentinel {
+		return t.addrs[0], nil
+	}
+	err := errors.New("no sentinel available")
+	for _, addr := range t.addrs {
+		sentinel := redis.NewSentinelClient(&redis.Options{Addr: addr})
+		var master []string
+		master, err = sentinel.GetMasterAddrByName(t.master).Result()
+		sentinel.Close()
+		if err == nil && len(master) == 2 {
+			return net.JoinHostPort(master[0], master[1]), nil
+		}
+	}
+	return "", fmt.Errorf("sentinel master %s: %v", t.master, err)
+}
+
+// masters returns the addresses of the masters holding the keys, which are
+// all the masters of a cluster or the single master otherwise.
+func (t *topology) masters(client redis.UniversalClient) []string {
+	if c, ok := client.(*redis.ClusterClient); ok {
+		return clusterMasters(c)
+	}
+	addr, err := t.masterAddr()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return []string{addr}
+}
+
+// dbClient is a db of a topology.
+type dbClient struct {
+	topo *topology
+	db   int
+}
+
+var (
+	dbMu      sync.Mutex
+	dbClients = make(map[dbClient]redis.UniversalClient)
+)
+
+// selectDB returns a client writing to db of t, which is client itself for
+// db 0. Only a standalone or sentinel topology has dbs other than 0.
+func (t *topology) selectDB(client redis.UniversalClient, db int) (redis.UniversalClient, error) {
+	if db == 0 {
+		return client, nil
+	}
+	if t == nil || t.mode == modeCluster {
+		return nil, fmt.Errorf("db %d: the cluster has only db 0", db)
+	}
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	c, ok := dbClients[dbClient{t, db}]
+	if !ok {
+		c = t.client(db)
+		dbClients[dbClient{t, db}] = c
+	}
+	return c, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"redisp/redcon"
+
+	"github.com/go-redis/redis"
+)
+
+func TestNewTopology(t *testing.T) {
+	tests := []struct {
+		addr   string
+		mode   string
+		master string
+		exp    *topology
+		str    string
+	}{
+		{"127.0.0.1:6379", "standalone", "",
+			&topology{mode: modeStandalone, addrs: []string{"127.0.0.1:6379"}},
+			"standalone 127.0.0.1:6379"},
+		{"a:7000, b:7001,,", "Cluster", "",
+			&topology{mode: modeCluster, addrs: []string{"a:7000", "b:7001"}},
+			"cluster a:7000,b:7001"},
+		{"s1:26379,s2:26379", "sentinel", "mymaster",
+			&topology{mode: modeSentinel, addrs: []string{"s1:26379", "s2:26379"}, master: "mymaster"},
+			"sentinel s1:26379,s2:26379 master mymaster"},
+		{"", "cluster", "", nil, ""},
+		{" , ", "standalone", "", nil, ""},
+		{"s1:26379", "sentinel", "", nil, ""},
+		{"a:6379", "replica", "", nil, ""},
+	}
+	for _, tt := range tests {
+		topo, err := newTopology(tt.addr, tt.mode, tt.master)
+		if (err != nil) != (tt.exp == nil) || !reflect.DeepEqual(topo, tt.exp) {
+			t.Errorf("%q %s: expected %+v, got %+v %v", tt.addr, tt.mode, tt.exp, topo, err)
+			continue
+		}
+		if topo != nil && topo.String() != tt.str {
+			t.Errorf("%q %s: expected %q, got %q", tt.addr, tt.mode, tt.str, topo)
+		}
+	}
+}
+
+func TestTopologyFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	build := topologyFlags(fs, "source")
+	if err := fs.Parse([]string{"-source-mode", "sentinel", "-source-master", "mymaster"}); err != nil {
+		t.Fatal(err)
+	}
+	topo, err := build("s1:26379")
+	if err != nil || topo.mode != modeSentinel || topo.master != "mymaster" {
+		t.Fatalf("expected a sentinel topology of mymaster, got %+v %v", topo, err)
+	}
+	if fs.Lookup("source-mode").DefValue != modeCluster {
+		t.Fatalf("expected the cluster mode by default, got %s", fs.Lookup("source-mode").DefValue)
+	}
+}
+
+func TestTopologyMasters(t *testing.T) {
+	nodes := "07c3 10.0.0.1:7000@17000 myself,master - 0 0 1 connected 0-5460\n" +
+		"67ed 10.0.0.2:7001@17001 master - 0 0 2 connected 5461-10922\n" +
+		"292f 10.0.0.3:7002@17002 slave 67ed 0 0 2 connected\n" +
+		"e7d1 10.0.0.4:7003@17003 master,fail - 0 0 3 disconnected\n" +
+		"a1b2 :0@0 master,noaddr - 0 0 0 disconnected\n"
+	cluster := fakeCluster(t, nodes)
+	tests := []struct {
+		topo    *topology
+		masters []string
+	}{
+		{&topology{mode: modeStandalone, addrs: []string{"a:6379"}}, []string{"a:6379"}},
+		{&topology{mode: modeStandalone, addrs: []string{"a:6379", "b:6379"}}, []string{"a:6379"}},
+		// no sentinel answers
+		{&topology{mode: modeSentinel, addrs: []string{"127.0.0.1:1"}, master: "mymaster"}, nil},
+		{&topology{mode: modeCluster, addrs: []string{cluster}},
+			[]string{"10.0.0.1:7000", "10.0.0.2:7001", "10.0.0.4:7003"}},
+	}
+	for _, tt := range tests {
+		client := tt.topo.client(0)
+		if masters := tt.topo.masters(client); !reflect.DeepEqual(masters, tt.masters) {
+			t.Errorf("%s: expected %v, got %v", tt.topo, tt.masters, masters)
+		}
+		client.Close()
+	}
+}
+
+func TestTopologyClient(t *testing.T) {
+	tests := []struct {
+		topo    *topology
+		db      int
+		cluster bool
+	}{
+		{&topology{mode: modeStandalone, addrs: []string{"a:6379"}}, 2, false},
+		{&topology{mode: modeSentinel, addrs: []string{"s:26379"}, master: "m"}, 3, false},
+		{&topology{mode: modeCluster, addrs: []string{"a:7000"}}, 0, true},
+	}
+	for _, tt := range tests {
+		client := tt.topo.client(tt.db)
+		switch c := client.(type) {
+		case *redis.ClusterClient:
+			if !tt.cluster {
+				t.Errorf("%s: expected a client, got a cluster client", tt.topo)
+			}
+		case *redis.Client:
+			if tt.cluster || c.Options().DB != tt.db {
+				t.Errorf("%s: expected a client of db %d, got db %d", tt.topo, tt.db, c.Options().DB)
+			}
+		}
+		client.Close()
+	}
+}
+
+func TestSelectDB(t *testing.T) {
+	a := &topology{mode: modeStandalone, addrs: []string{"a:6379"}}
+	b := &topology{mode: modeStandalone, addrs: []string{"b:6379"}}
+	client := a.client(0)
+	defer client.Close()
+	if c, err := a.selectDB(client, 0); c != client || err != nil {
+		t.Fatalf("db 0: expected the client, got %v %v", c, err)
+	}
+	a2, err := a.selectDB(client, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := a2.(*redis.Client).Options().Addr; addr != "a:6379" {
+		t.Fatalf("expected a client of a:6379, got %s", addr)
+	}
+	if c, _ := a.selectDB(client, 2); c != a2 {
+		t.Fatal("expected the cached client of db 2")
+	}
+	b2, err := b.selectDB(b.client(0), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := b2.(*redis.Client).Options().Addr; addr != "b:6379" {
+		t.Fatalf("expected a client of b:6379, got %s", addr)
+	}
+	cluster := &topology{mode: modeCluster, addrs: []string{"c:7000"}}
+	if _, err := cluster.selectDB(nil, 1); err == nil {
+		t.Fatal("expected an error for db 1 of a cluster")
+	}
+}
+
+// fakeNode serves the commands with handler on a local port and returns
+// its address.
+func fakeNode(t *testing.T, handler func(conn redcon.Conn, cmd redcon.Command)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go redcon.Serve(ln, handler, nil, nil)
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// fakeCluster serves CLUSTER SLOTS and CLUSTER NODES like a cluster node
+// holding every slot, with nodes as the CLUSTER NODES reply.
+func fakeCluster(t *testing.T, nodes string) string {
+	return fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) != 2 || !strings.EqualFold(string(cmd.Args[0]), "cluster") {
+			conn.WriteError("ERR unknown command")
+			return
+		}
+		switch strings.ToLower(string(cmd.Args[1])) {
+		case "slots":
+			local := conn.NetConn().LocalAddr().(*net.TCPAddr)
+			conn.WriteArray(1)
+			conn.WriteArray(3)
+			conn.WriteInt(0)
+			conn.WriteInt(slotCount - 1)
+			conn.WriteArray(2)
+			conn.WriteBulkString(local.IP.String())
+			conn.WriteInt(local.Port)
+		case "nodes":
+			conn.WriteBulkString(nodes)
+		}
+	})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"redisp/redcon"
+)
+
+// session is the state of a client connection, kept in its context.
+type session struct {
+	tx *transaction
+}
+
+// sessionOf returns the session of conn.
+func sessionOf(conn redcon.Conn) *session {
+	s, _ := conn.Context().(*session)
+	if s == nil {
+		s = &session{}
+		conn.SetContext(s)
+	}
+	return s
+}
+
+// transaction is a MULTI block and the WATCH before it. All its keys must
+// hash to the same slot. The commands are queued in the proxy and sent to
+// the primary of the write route with EXEC. A transaction with writes is
+// then replayed on the secondary when the primary committed it, and a
+// failure on the secondary is handled like for a single write.
+type transaction struct {
+	multi bool
+	// dirty is set when a queued command was refused, EXEC then aborts
+	dirty bool
+	// excluded is set when a key is not migrated, the target is skipped
+	excluded bool
+	writes   bool
+	count    int
+
+	slot       int // -1 until a key is queued or watched
+	targetSlot int
+	src        []byte // queued commands for the source
+	tgt        []byte // queued commands for the target, keys renamed
+
+	// watched is the backend connection holding the WATCH, pinned to the
+	// client until EXEC, DISCARD or UNWATCH
+	watched      *backendConn
+	watchPool    *pool
+	watchBackend *upstream
+}
+
+var (
+	multiCmd = []byte("*1\r\n$5\r\nMULTI\r\n")
+	execCmd  = []byte("*1\r\n$4\r\nEXEC\r\n")
+	watchCmd = &commandInfo{arity: -2, flags: cmdRead, first: 1, last: -1, step: 1}
+
+	errWatchMoved = errors.New("ERR the write route changed after WATCH")
+)
+
+func newTransaction() *transaction {
+	return &transaction{slot: -1, targetSlot: -1}
+}
+
+// transaction runs MULTI, EXEC, DISCARD, WATCH and UNWATCH.
+func (p *proxy) transaction(conn redcon.Conn, cmd redcon.Command) {
+	s := sessionOf(conn)
+	name := strings.ToLower(string(cmd.Args[0]))
+	if (name == "watch" && len(cmd.Args) < 2) || (name != "watch" && len(cmd.Args) != 1) {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	switch name {
+	case "multi":
+		if s.tx != nil && s.tx.multi {
+			conn.WriteError("ERR MULTI calls can not be nested")
+			return
+		}
+		if s.tx == nil {
+			s.tx = newTransaction()
+		}
+		s.tx.multi = true
+		conn.WriteString("OK")
+	case "exec":
+		if s.tx == nil || !s.tx.multi {
+			conn.WriteError("ERR EXEC without MULTI")
+			return
+		}
+		tx := s.tx
+		s.tx = nil
+		if tx.dirty {
+			tx.release(false)
+			conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+			return
+		}
+		p.exec(conn, tx)
+	case "discard":
+		if s.tx == nil || !s.tx.multi {
+			conn.WriteError("ERR DISCARD without MULTI")
+			return
+		}
+		s.tx.release(true)
+		s.tx = nil
+		conn.WriteString("OK")
+	case "unwatch":
+		if s.tx != nil && !s.tx.multi {
+			s.tx.release(true)
+			s.tx = nil
+		}
+		conn.WriteString("OK")
+	case "watch":
+		if s.tx != nil && s.tx.multi {
+			conn.WriteError("ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		if s.tx == nil {
+			s.tx = newTransaction()
+		}
+		if err := p.watch(conn, s.tx, cmd); err != nil {
+			conn.WriteError(err.Error())
+		}
+	}
+}
+
+// queue queues cmd when the client is in a MULTI block. It reports false
+// when the command must run now.
+func (p *proxy) queue(conn redcon.Conn, cmd redcon.Command) bool {
+	s, _ := conn.Context().(*session)
+	if s == nil || s.tx == nil || !s.tx.multi {
+		return false
+	}
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "multi", "exec", "discard", "watch", "unwatch", "quit", "reset":
+		return false
+	}
+	tx := s.tx
+	info, errMsg := lookupCommand(cmd)
+	if info == nil {
+		tx.dirty = true
+		conn.WriteError(errMsg)
+		return true
+	}
+	src, tgt, err := tx.keys(info, cmd)
+	if err != nil {
+		tx.dirty = true
+		conn.WriteError(err.Error())
+		return true
+	}
+	tx.src = append(tx.src, src...)
+	tx.tgt = append(tx.tgt, tgt...)
+	tx.count++
+	tx.writes = tx.writes || info.flags&cmdWrite != 0
+	conn.WriteString("QUEUED")
+	return true
+}
+
+// keys checks that the keys of cmd hash to the slot of the transaction and
+// returns the raw command for the source and for the target.
+func (tx *transaction) keys(info *commandInfo, cmd redcon.Command) (src, tgt []byte, err error) {
+	slot, errMsg := commandSlot(info, cmd)
+	if errMsg != "" {
+		return nil, nil, errors.New(errMsg)
+	}
+	tgt, targetSlot, err := keyRules.rewriteCommand(info, cmd, slot)
+	switch err {
+	case nil:
+	case errExcluded:
+		tx.excluded = true
+		tgt, targetSlot = nil, -1
+	default:
+		return nil, nil, err
+	}
+	if (slot != -1 && tx.slot != -1 && slot != tx.slot) ||
+		(targetSlot != -1 && tx.targetSlot != -1 && targetSlot != tx.targetSlot) {
+		return nil, nil, errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+	}
+	if slot != -1 {
+		tx.slot = slot
+	}
+	if targetSlot != -1 {
+		tx.targetSlot = targetSlot
+	}
+	return cmd.Raw, tgt, nil
+}
+
+// watch sends WATCH to the primary of the write route on a connection that
+// stays pinned to the client.
+func (p *proxy) watch(conn redcon.Conn, tx *transaction, cmd redcon.Command) error {
+	src, tgt, err := tx.keys(watchCmd, cmd)
+	if err != nil {
+		return err
+	}
+	primary, _, err := p.writers(p.route(), tx.excluded)
+	if err != nil {
+		return err
+	}
+	if tx.watched != nil && tx.watchBackend != primary {
+		return errWatchMoved
+	}
+	raw, slot := src, tx.slot
+	if primary == p.target {
+		raw, slot = tgt, tx.targetSlot
+	}
+	if tx.watched == nil {
+		pl, err := primary.pool(slot)
+		if err != nil {
+			return err
+		}
+		c, err := pl.get(conn.Protocol())
+		if err != nil {
+			return err
+		}
+		tx.watched, tx.watchPool, tx.watchBackend = c, pl, primary
+	}
+	reply, err := tx.watched.do(raw)
+	if err != nil {
+		tx.release(false)
+		return err
+	}
+	conn.WriteRaw(reply)
+	return nil
+}
+
+// release returns the pinned connection, sending UNWATCH first when unwatch
+// is set.
+func (tx *transaction) release(unwatch bool) {
+	if tx.watched == nil {
+		return
+	}
+	var err error
+	if unwatch {
+		_, err = tx.watched.do([]byte("*1\r\n$7\r\nUNWATCH\r\n"))
+	}
+	tx.watchPool.put(tx.watched, err)
+	tx.watched = nil
+}
+
+// exec commits the transaction on the primary, then on the secondary when
+// the transaction writes and was committed.
+func (p *proxy) exec(conn redcon.Conn, tx *transaction) {
+	r := p.route()
+	primary, secondary, err := p.writers(r, tx.excluded)
+	if err == nil && tx.watched != nil && tx.watchBackend != primary {
+		err = errWatchMoved
+	}
+	if err != nil {
+		tx.release(false)
+		conn.WriteError(err.Error())
+		return
+	}
+	if !tx.writes {
+		secondary = nil
+	}
+	reply, err := p.commit(primary, tx, conn.Protocol())
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	if secondary != nil && reply[0] != '-' && !isNullReply(reply) {
+		sreply, err := p.commit(secondary, tx, conn.Protocol())
+		if err == nil && sreply[0] == '-' {
+			err = errors.New(string(sreply[1 : len(sreply)-2]))
+		}
+		if err != nil {
+			log.Printf("%s exec: %v", secondary.name, err)
+			if r.strict {
+				conn.WriteError("ERR " + secondary.name + " write failed: " + err.Error())
+				return
+			}
+		}
+	}
+	conn.WriteRaw(reply)
+}
+
+// commit sends MULTI, the queued commands and EXEC to u, on the pinned
+// connection when u holds the WATCH or else on a connection speaking proto,
+// and returns the reply of EXEC.
+//
+// A queued command redirected with MOVED or ASK aborts the transaction, it
+// is then sent again to the node of the redirect, after ASKING for an ASK.
+// A transaction holding a WATCH is not sent again since the node of the
+// redirect does not watch its keys, its client gets the EXECABORT.
+func (p *proxy) commit(u *upstream, tx *transaction, proto int) ([]byte, error) {
+	raw, slot := tx.src, tx.slot
+	if u == p.target {
+		raw, slot = tx.tgt, tx.targetSlot
+	}
+	c, pl := tx.watched, tx.watchPool
+	pinned := u == tx.watchBackend && c != nil
+	if pinned {
+		tx.watched = nil
+	} else {
+		var err error
+		if pl, err = u.pool(slot); err != nil {
+			return nil, err
+		}
+		c = nil
+	}
+	b := make([]byte, 0, len(askingCmd)+len(multiCmd)+len(raw)+len(execCmd))
+	b = append(append(append(append(b, askingCmd...), multiCmd...), raw...), execCmd...)
+	asking := false
+	for redirects := 0; ; redirects++ {
+		if c == nil {
+			var err error
+			if c, err = pl.get(proto); err != nil {
+				return nil, err
+			}
+		}
+		cmds, n := b[len(askingCmd):], tx.count+2
+		if asking {
+			cmds, n = b, n+1
+		}
+		var reply, redirect []byte
+		err := c.pipeline(cmds, n, func(i int, r []byte) {
+			switch {
+			case i == n-1:
+				reply = append([]byte(nil), r...)
+			case redirect == nil && (!asking || i > 0):
+				if kind, _, _ := parseRedirect(r); kind == "MOVED" || kind == "ASK" {
+					redirect = append([]byte(nil), r...)
+				}
+			}
+		})
+		pl.put(c, err)
+		c = nil
+		if err != nil {
+			return nil, err
+		}
+		if redirect == nil || pinned || redirects == maxRedirects {
+			return reply, nil
+		}
+		kind, redirectSlot, addr := parseRedirect(redirect)
+		addr = redirectAddr(pl.addr, addr)
+		if kind == "MOVED" {
+			u.moved(redirectSlot, addr)
+		}
+		pl, asking = u.poolAddr(addr), kind == "ASK"
+	}
+}
+
+// closeSession releases the pinned connection of a client closed by the
+// server. The session of a detached client is closed by the proxy.
+func closeSession(conn redcon.Conn, err error) {
+	if err == redcon.ErrDetached {
+		return
+	}
+	if s, _ := conn.Context().(*session); s != nil {
+		s.close()
+	}
+}
+
+// resetSession runs RESET: the transaction and the WATCH of the client are
+// dropped and it speaks RESP2 again. The backend connections, shared with
+// the other clients, are left as they are.
+func resetSession(conn redcon.Conn) {
+	sessionOf(conn).close()
+	conn.SetProtocol(2)
+	conn.WriteString("RESET")
+}
+
+// close releases the pinned connection of the session.
+func (s *session) close() {
+	if s.tx != nil {
+		s.tx.release(true)
+		s.tx = nil
+	}
+}
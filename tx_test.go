@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"redisp/redcon"
+)
+
+// parseCommand returns the command of the arguments separated by spaces.
+func parseCommand(cmd string) redcon.Command {
+	args := parseArgs(cmd)
+	raw := redcon.AppendArray(nil, len(args))
+	for _, arg := range args {
+		raw = redcon.AppendBulk(raw, arg)
+	}
+	return redcon.Command{Raw: raw, Args: args}
+}
+
+func TestTransactionKeys(t *testing.T) {
+	const crossSlot = "CROSSSLOT Keys in request don't hash to the same slot"
+	type queued struct {
+		cmd string
+		tgt string // the command for the target, empty when skipped
+		err string
+	}
+	tests := []struct {
+		rules    []string
+		cmds     []queued
+		excluded bool
+		slot     int
+	}{
+		{nil, []queued{{"set {a}1 v", "set {a}1 v", ""}, {"get {a}2", "get {a}2", ""}, {"ping", "ping", ""}},
+			false, keySlot([]byte("a"))},
+		{nil, []queued{{"get {a}1", "get {a}1", ""}, {"get {b}1", "", crossSlot}},
+			false, keySlot([]byte("a"))},
+		{nil, []queued{{"mget {a}1 {b}1", "", crossSlot}}, false, -1},
+		{nil, []queued{{"ping", "ping", ""}, {"echo s", "echo s", ""}}, false, -1},
+		// the keys must also hash to a single slot once renamed
+		{[]string{"-rename", `^\{u\}1$=one`}, []queued{{"get {u}1", "get one", ""}, {"get {u}2", "", crossSlot}},
+			false, keySlot([]byte("u"))},
+		{[]string{"-add-prefix", "{t}"}, []queued{{"get {u}1", "get {t}{u}1", ""}, {"get {v}1", "", crossSlot}},
+			false, keySlot([]byte("u"))},
+		// a key that is not migrated skips the target
+		{[]string{"-exclude", "tmp:*"}, []queued{{"set {a}1 v", "set {a}1 v", ""}, {"set tmp:{a} v", "", ""}},
+			true, keySlot([]byte("a"))},
+	}
+	saved := keyRules
+	defer func() { keyRules = saved }()
+	for _, tt := range tests {
+		keyRules = parseRules(t, tt.rules...)
+		tx := newTransaction()
+		for _, q := range tt.cmds {
+			cmd := parseCommand(q.cmd)
+			info, errMsg := lookupCommand(cmd)
+			if info == nil {
+				t.Fatalf("%q: %s", q.cmd, errMsg)
+			}
+			src, tgt, err := tx.keys(info, cmd)
+			if err != nil {
+				if err.Error() != q.err {
+					t.Errorf("%v %q: expected error %q, got %q", tt.rules, q.cmd, q.err, err)
+				}
+				continue
+			}
+			var exp []byte
+			if q.tgt != "" {
+				exp = parseCommand(q.tgt).Raw
+			}
+			if q.err != "" || string(src) != string(cmd.Raw) || string(tgt) != string(exp) {
+				t.Errorf("%v %q: expected %q %q, got %q %q", tt.rules, q.cmd, q.err, exp, src, tgt)
+			}
+		}
+		if tx.excluded != tt.excluded || tx.slot != tt.slot {
+			t.Errorf("%v: expected excluded %v slot %d, got %v %d", tt.rules, tt.excluded, tt.slot, tx.excluded, tx.slot)
+		}
+	}
+}
+
+func TestCommitRedirect(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	// to serves the transaction, queuing its commands after MULTI
+	to := fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		mu.Lock()
+		sent = append(sent, strings.Join(argStrings(cmd.Args), " "))
+		mu.Unlock()
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "asking", "multi":
+			conn.WriteString("OK")
+		case "exec":
+			conn.WriteArray(1)
+			conn.WriteString("OK")
+		default:
+			conn.WriteString("QUEUED")
+		}
+	})
+	slot := keySlot([]byte("a"))
+	for _, kind := range []string{"ASK", "MOVED"} {
+		from := fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "multi":
+				conn.WriteString("OK")
+			case "exec":
+				conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+			default:
+				conn.WriteError(kind + " " + strconv.Itoa(slot) + " " + to)
+			}
+		})
+		u := &upstream{
+			name:  "target",
+			topo:  &topology{mode: modeStandalone, addrs: []string{to}},
+			pools: map[string]*pool{from: {addr: from}},
+		}
+		for i := range u.slots {
+			u.slots[i] = from
+		}
+		p := &proxy{source: u}
+		tx := newTransaction()
+		tx.src, tx.slot, tx.count = parseCommand("set a 1").Raw, slot, 1
+		mu.Lock()
+		sent = nil
+		mu.Unlock()
+		reply, err := p.commit(u, tx, 2)
+		if err != nil || string(reply) != "*1\r\n+OK\r\n" {
+			t.Fatalf("%s: expected the reply of %s, got %q %v", kind, to, reply, err)
+		}
+		exp := "MULTI,set a 1,EXEC"
+		if kind == "ASK" {
+			exp = "ASKING," + exp
+		}
+		mu.Lock()
+		if strings.Join(sent, ",") != exp {
+			t.Fatalf("%s: expected %s, got %q", kind, exp, sent)
+		}
+		mu.Unlock()
+		if pl, _ := u.pool(slot); (kind == "MOVED") != (pl.addr == to) {
+			t.Fatalf("%s: slot %d served by %s", kind, slot, pl.addr)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// mismatch kinds
+const (
+	mismatchMissing = "missing"
+	mismatchExtra   = "extra"
+	mismatchType    = "type"
+	mismatchTTL     = "ttl"
+	mismatchValue   = "value"
+)
+
+var mismatchKinds = []string{mismatchMissing, mismatchExtra, mismatchType, mismatchTTL, mismatchValue}
+
+// mismatch is a key of a source db that differs between the source and
+// the target.
+type mismatch struct {
+	Key  string
+	DB   int
+	Slot int
+	Kind string
+}
+
+// verifier compares the keys of the source and target clusters. source
+// and target are clients of db 0.
+type verifier struct {
+	source    redis.UniversalClient
+	target    redis.UniversalClient
+	tolerance time.Duration
+
+	mu         sync.Mutex
+	checked    int64
+	mismatches []mismatch
+	// failed are the nodes that could not be scanned
+	failed []string
+}
+
+// verifyMain runs the verify command, which reports the keys that differ
+// between the source and the target.
+func verifyMain(args []string) {
+	var (
+		tolerance time.Duration
+		recheck   time.Duration
+		sample    int
+		extra     bool
+	)
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.StringVar(&sourceAddr, "s", "localhost:6379", "source redis addresses, comma separated")
+	fs.StringVar(&targetAddr, "t", "localhost:6379", "target redis addresses, comma separated")
+	fs.DurationVar(&tolerance, "ttl-tolerance", 2*time.Second, "highest ttl difference of equal keys")
+	fs.DurationVar(&recheck, "recheck", time.Second, "delay before mismatches are checked again, to filter out in-flight writes")
+	fs.IntVar(&sample, "sample", 10, "number of mismatched keys reported per kind")
+	fs.BoolVar(&extra, "extra", true, "also scan the target for keys missing in the source")
+	buildSource := topologyFlags(fs, "source")
+	buildTarget := topologyFlags(fs, "target")
+	buildRules := ruleFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: redisp verify [-s source] [-t target] [-source-mode mode] [-target-mode mode]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	var err error
+	if keyRules, err = buildRules(); err != nil {
+		log.Fatal(err)
+	}
+	if sourceTopo, err = buildSource(sourceAddr); err != nil {
+		log.Fatal("source: ", err)
+	}
+	if targetTopo, err = buildTarget(targetAddr); err != nil {
+		log.Fatal("target: ", err)
+	}
+	if extra && keyRules != nil && keyRules.renames() {
+		// the source name of a renamed target key is unknown
+		log.Println("renamed keys, the target is not scanned for extra keys")
+		extra = false
+	}
+
+	v := &verifier{
+		source:    sourceTopo.client(0),
+		target:    targetTopo.client(0),
+		tolerance: tolerance,
+	}
+	log.Printf("verify\nsource: %s\ntarget: %s\n", sourceTopo, targetTopo)
+	v.run(extra, recheck)
+	v.report(os.Stdout, sample)
+	if len(v.mismatches) > 0 || len(v.failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// run scans every db of the masters of the source, and those of the
+// target when extra is set, then checks the mismatches again after recheck.
+func (v *verifier) run(extra bool, recheck time.Duration) {
+	var wg sync.WaitGroup
+	scan := func(addr string, db int, target bool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.scan(addr, db, target)
+		}()
+	}
+	for _, addr := range sourceTopo.masters(v.source) {
+		for _, db := range topologyDBs(sourceTopo, v.source) {
+			if _, ok := keyRules.targetDB(db); ok {
+				scan(addr, db, false)
+			}
+		}
+	}
+	if extra {
+		for _, addr := range targetTopo.masters(v.target) {
+			for _, db := range topologyDBs(targetTopo, v.target) {
+				if len(keyRules.sourceDBs(db)) > 0 {
+					scan(addr, db, true)
+				}
+			}
+		}
+	}
+	wg.Wait()
+
+	if len(v.mismatches) > 0 && recheck > 0 {
+		log.Println("recheck", len(v.mismatches), "mismatches in", recheck)
+		time.Sleep(recheck)
+		v.recheck()
+	}
+}
+
+// topologyDBs returns the dbs holding keys of a standalone or sentinel
+// topology, and db 0 of a cluster.
+func topologyDBs(topo *topology, client redis.UniversalClient) []int {
+	if topo.mode == modeCluster {
+		return []int{0}
+	}
+	return keyspaceDBs(client)
+}
+
+// scan compares the keys of db of a node with the other cluster. The keys
+// of a target node are only checked for existence in the source dbs mapped
+// to db. A node that fails more than maxRetries scans in a row is reported
+// as failed.
+func (v *verifier) scan(addr string, db int, target bool) {
+	name := addr
+	if db != 0 {
+		name += "/" + strconv.Itoa(db)
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: "", // no password set
+		DB:       db,
+	})
+	defer client.Close()
+	var cursor uint64
+	var retries int
+	for {
+		page, next, err := client.Scan(cursor, "*", 1000).Result()
+		if err != nil {
+			if retries++; retries > maxRetries {
+				log.Println("scan", name, "failed:", err)
+				v.mu.Lock()
+				v.failed = append(v.failed, name)
+				v.mu.Unlock()
+				return
+			}
+			log.Println("scan", name, err)
+			time.Sleep(time.Duration(retries) * retryBackoff)
+			continue
+		}
+		retries = 0
+		for _, key := range page {
+			var kind string
+			srcDB := db
+			if target {
+				srcDB = keyRules.sourceDBs(db)[0]
+				var found bool
+				found, err = v.inSource(key, db)
+				if err == nil && !found {
+					kind = mismatchExtra
+				}
+			} else {
+				if !keyRules.matchName(key) {
+					continue
+				}
+				kind, err = v.compare(key, db)
+			}
+			if err != nil {
+				log.Println("verify key:", key, err)
+				continue
+			}
+			v.mu.Lock()
+			if !target {
+				v.checked++
+			}
+			if kind != "" {
+				v.mismatches = append(v.mismatches, mismatch{
+					Key:  key,
+					DB:   srcDB,
+					Slot: keySlot([]byte(key)),
+					Kind: kind,
+				})
+			}
+			v.mu.Unlock()
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+// inSource reports whether key of db of the target exists in one of the
+// source dbs mapped to db.
+func (v *verifier) inSource(key string, db int) (bool, error) {
+	for _, src := range keyRules.sourceDBs(db) {
+		source, err := sourceTopo.selectDB(v.source, src)
+		if err != nil {
+			return false, err
+		}
+		n, err := source.Exists(key).Result()
+		if err != nil || n > 0 {
+			return n > 0, err
+		}
+	}
+	return false, nil
+}
+
+// compare returns the kind of difference of key of db between the source
+// and its renamed key in the mapped db of the target, or "" when the key
+// is equal on both. Keys not selected by the rules are equal.
+func (v *verifier) compare(key string, db int) (string, error) {
+	dst, ok := keyRules.targetDB(db)
+	if !ok {
+		return "", nil
+	}
+	source, err := sourceTopo.selectDB(v.source, db)
+	if err != nil {
+		return "", err
+	}
+	target, err := targetTopo.selectDB(v.target, dst)
+	if err != nil {
+		return "", err
+	}
+	se, err := readEntry(source, key)
+	if err != nil {
+		return "", err
+	}
+	if se != nil && !keyRules.matchValue(se.Type, se.TTL, -1) {
+		return "", nil
+	}
+	te, err := readEntry(target, keyRules.rename(key))
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case se == nil && te == nil:
+		return "", nil
+	case se == nil:
+		return mismatchExtra, nil
+	case te == nil:
+		return mismatchMissing, nil
+	case se.Type != te.Type:
+		return mismatchType, nil
+	case digest(se) != digest(te):
+		return mismatchValue, nil
+	}
+	if (se.TTL == 0) != (te.TTL == 0) {
+		return mismatchTTL, nil
+	}
+	if d := se.TTL - te.TTL; d > v.tolerance || d < -v.tolerance {
+		return mismatchTTL, nil
+	}
+	return "", nil
+}
+
+// recheck compares the mismatched keys again and keeps those that still
+// differ, filtering out keys that were being written during the scan.
+func (v *verifier) recheck() {
+	var mismatches []mismatch
+	for _, m := range v.mismatches {
+		kind, err := v.compare(m.Key, m.DB)
+		if err != nil {
+			log.Println("verify key:", m.Key, err)
+			kind = m.Kind
+		}
+		if kind != "" {
+			m.Kind = kind
+			mismatches = append(mismatches, m)
+		}
+	}
+	v.mismatches = mismatches
+}
+
+// report writes the totals, the per slot summary and a sample of the
+// mismatched keys of each kind.
+func (v *verifier) report(w io.Writer, sample int) {
+	totals := make(map[string]int)
+	slots := make(map[int]map[string]int)
+	samples := make(map[string][]mismatch)
+	for _, m := range v.mismatches {
+		totals[m.Kind]++
+		if slots[m.Slot] == nil {
+			slots[m.Slot] = make(map[string]int)
+		}
+		slots[m.Slot][m.Kind]++
+		if len(samples[m.Kind]) < sample {
+			samples[m.Kind] = append(samples[m.Kind], m)
+		}
+	}
+	fmt.Fprintf(w, "keys checked: %d\n", v.checked)
+	fmt.Fprintf(w, "mismatches: %d", len(v.mismatches))
+	for _, kind := range mismatchKinds {
+		fmt.Fprintf(w, ", %s: %d", kind, totals[kind])
+	}
+	fmt.Fprintln(w)
+	if len(v.failed) > 0 {
+		failed := append([]string(nil), v.failed...)
+		sort.Strings(failed)
+		fmt.Fprintf(w, "failed nodes: %s\n", strings.Join(failed, ", "))
+	}
+	if len(v.mismatches) == 0 {
+		return
+	}
+	var ids []int
+	for slot := range slots {
+		ids = append(ids, slot)
+	}
+	sort.Ints(ids)
+	fmt.Fprintln(w, "slots:")
+	for _, slot := range ids {
+		fmt.Fprintf(w, "  %d:", slot)
+		for _, kind := range mismatchKinds {
+			if n := slots[slot][kind]; n > 0 {
+				fmt.Fprintf(w, " %s %d", kind, n)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "sample:")
+	for _, kind := range mismatchKinds {
+		for _, m := range samples[kind] {
+			if m.DB != 0 {
+				fmt.Fprintf(w, "  %s %q (db %d, slot %d)\n", kind, m.Key, m.DB, m.Slot)
+			} else {
+				fmt.Fprintf(w, "  %s %q (slot %d)\n", kind, m.Key, m.Slot)
+			}
+		}
+	}
+}
+
+// digest returns a hash of the value of e that does not depend on the
+// order redis returns the members of sets and the fields of hashes in.
+func digest(e *entry) [sha1.Size]byte {
+	h := sha1.New()
+	writeField(h, e.Type)
+	switch v := e.Value.(type) {
+	case string:
+		writeField(h, v)
+	case []string:
+		if e.Type == "set" {
+			v = append([]string(nil), v...)
+			sort.Strings(v)
+		}
+		for _, s := range v {
+			writeField(h, s)
+		}
+	case map[string]string:
+		writeMap(h, v)
+	case []redis.Z:
+		for _, z := range v {
+			writeField(h, fmt.Sprint(z.Member))
+			writeField(h, strconv.FormatFloat(z.Score, 'g', -1, 64))
+		}
+	case []redis.XMessage:
+		for _, msg := range v {
+			writeField(h, msg.ID)
+			fields := make(map[string]string, len(msg.Values))
+			for k, val := range msg.Values {
+				fields[k] = fmt.Sprint(val)
+			}
+			writeMap(h, fields)
+		}
+	}
+	var sum [sha1.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// writeField writes s prefixed by its length, so that the boundaries of
+// the fields are part of the digest.
+func writeField(h hash.Hash, s string) {
+	io.WriteString(h, strconv.Itoa(len(s)))
+	io.WriteString(h, ":")
+	io.WriteString(h, s)
+}
+
+// writeMap writes the pairs of m sorted by key.
+func writeMap(h hash.Hash, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeField(h, k)
+		writeField(h, m[k])
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"redisp/redcon"
+
+	"github.com/go-redis/redis"
+)
+
+// fakeKeyspace serves the string and set keys of dbs, enough of redis for
+// readEntry and a single page SCAN.
+func fakeKeyspace(t *testing.T, dbs map[int]map[string]interface{}) string {
+	var mu sync.Mutex
+	return fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		mu.Lock()
+		defer mu.Unlock()
+		db, _ := conn.Context().(int)
+		keys := dbs[db]
+		var key string
+		if len(cmd.Args) > 1 {
+			key = string(cmd.Args[1])
+		}
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "select":
+			n, _ := strconv.Atoi(key)
+			conn.SetContext(n)
+			conn.WriteString("OK")
+		case "info":
+			var info string
+			for db, keys := range dbs {
+				if len(keys) > 0 {
+					info += "db" + strconv.Itoa(db) + ":keys=" + strconv.Itoa(len(keys)) + "\r\n"
+				}
+			}
+			conn.WriteBulkString("# Keyspace\r\n" + info)
+		case "scan":
+			conn.WriteArray(2)
+			conn.WriteBulkString("0")
+			conn.WriteArray(len(keys))
+			for k := range keys {
+				conn.WriteBulkString(k)
+			}
+		case "exists":
+			if _, ok := keys[key]; ok {
+				conn.WriteInt(1)
+			} else {
+				conn.WriteInt(0)
+			}
+		case "type":
+			switch keys[key].(type) {
+			case string:
+				conn.WriteString("string")
+			case []string:
+				conn.WriteString("set")
+			default:
+				conn.WriteString("none")
+			}
+		case "get":
+			if s, ok := keys[key].(string); ok {
+				conn.WriteBulkString(s)
+			} else {
+				conn.WriteNull()
+			}
+		case "smembers":
+			members, _ := keys[key].([]string)
+			conn.WriteArray(len(members))
+			for _, m := range members {
+				conn.WriteBulkString(m)
+			}
+		case "pttl":
+			conn.WriteInt(-1)
+		default:
+			conn.WriteError("ERR unknown command")
+		}
+	})
+}
+
+func TestDigest(t *testing.T) {
+	tests := []struct {
+		a, b  *entry
+		equal bool
+	}{
+		{&entry{Type: "string", Value: "v"}, &entry{Type: "string", Value: "v"}, true},
+		{&entry{Type: "string", Value: "v"}, &entry{Type: "string", Value: "w"}, false},
+		{&entry{Type: "set", Value: []string{"a", "b"}}, &entry{Type: "set", Value: []string{"b", "a"}}, true},
+		{&entry{Type: "list", Value: []string{"a", "b"}}, &entry{Type: "list", Value: []string{"b", "a"}}, false},
+		{&entry{Type: "list", Value: []string{"ab", "c"}}, &entry{Type: "list", Value: []string{"a", "bc"}}, false},
+		{&entry{Type: "hash", Value: map[string]string{"f": "1", "g": "2"}}, &entry{Type: "hash", Value: map[string]string{"g": "2", "f": "1"}}, true},
+		{&entry{Type: "hash", Value: map[string]string{"f": "1"}}, &entry{Type: "hash", Value: map[string]string{"f": "2"}}, false},
+		{&entry{Type: "zset", Value: []redis.Z{{Score: 1, Member: "a"}}}, &entry{Type: "zset", Value: []redis.Z{{Score: 2, Member: "a"}}}, false},
+		{&entry{Type: "list", Value: []string{"v"}}, &entry{Type: "set", Value: []string{"v"}}, false},
+	}
+	for _, tt := range tests {
+		if equal := digest(tt.a) == digest(tt.b); equal != tt.equal {
+			t.Errorf("%+v %+v: expected equal %v, got %v", tt.a, tt.b, tt.equal, equal)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	source := fakeKeyspace(t, map[int]map[string]interface{}{
+		0: {"a": "1", "b": "x", "s": []string{"m", "n"}, "gone": "1"},
+		1: {"c": "2", "d": "3"},
+	})
+	target := fakeKeyspace(t, map[int]map[string]interface{}{
+		0: {"a": "1", "b": "y", "s": []string{"n", "m"}, "e": "extra"},
+		3: {"c": "2", "d": []string{"3"}},
+	})
+	keyRules = parseRules(t, "-db-map", "0:0", "-db-map", "1:3")
+	sourceTopo = &topology{mode: modeStandalone, addrs: []string{source}}
+	targetTopo = &topology{mode: modeStandalone, addrs: []string{target}}
+	defer func() { keyRules, sourceTopo, targetTopo = nil, nil, nil }()
+	v := &verifier{
+		source:    sourceTopo.client(0),
+		target:    targetTopo.client(0),
+		tolerance: time.Second,
+	}
+	defer v.source.Close()
+	defer v.target.Close()
+
+	tests := []struct {
+		key  string
+		db   int
+		kind string
+	}{
+		{"a", 0, ""},
+		{"s", 0, ""},
+		{"b", 0, mismatchValue},
+		{"gone", 0, mismatchMissing},
+		{"e", 0, mismatchExtra},
+		{"c", 1, ""},
+		{"d", 1, mismatchType},
+		{"missing", 0, ""},
+	}
+	for _, tt := range tests {
+		kind, err := v.compare(tt.key, tt.db)
+		if kind != tt.kind || err != nil {
+			t.Errorf("%s db %d: expected %q, got %q %v", tt.key, tt.db, tt.kind, kind, err)
+		}
+	}
+
+	v.run(true, 0)
+	if v.checked != 6 || len(v.failed) != 0 {
+		t.Fatalf("expected 6 keys checked and no failure, got %d %v", v.checked, v.failed)
+	}
+	found := make(map[string]mismatch)
+	for _, m := range v.mismatches {
+		found[m.Key] = m
+	}
+	exp := map[string]mismatch{
+		"b":    {Key: "b", DB: 0, Slot: keySlot([]byte("b")), Kind: mismatchValue},
+		"gone": {Key: "gone", DB: 0, Slot: keySlot([]byte("gone")), Kind: mismatchMissing},
+		"d":    {Key: "d", DB: 1, Slot: keySlot([]byte("d")), Kind: mismatchType},
+		"e":    {Key: "e", DB: 0, Slot: keySlot([]byte("e")), Kind: mismatchExtra},
+	}
+	if len(found) != len(exp) {
+		t.Fatalf("expected %v, got %v", exp, v.mismatches)
+	}
+	for key, m := range exp {
+		if found[key] != m {
+			t.Errorf("%s: expected %+v, got %+v", key, m, found[key])
+		}
+	}
+}
+
+func TestVerifyScanFailed(t *testing.T) {
+	addr := fakeNode(t, func(conn redcon.Conn, cmd redcon.Command) {
+		conn.WriteError("ERR scan disabled")
+	})
+	v := &verifier{}
+	v.scan(addr, 2, false)
+	if len(v.failed) != 1 || v.failed[0] != addr+"/2" {
+		t.Fatalf("expected %s/2 to fail, got %v", addr, v.failed)
+	}
+}
+
+func TestReport(t *testing.T) {
+	v := &verifier{
+		checked: 10,
+		mismatches: []mismatch{
+			{Key: "b", Slot: 3300, Kind: mismatchValue},
+			{Key: "a", Slot: 15495, Kind: mismatchMissing},
+			{Key: "c", DB: 2, Slot: 7365, Kind: mismatchMissing},
+			{Key: "d", Slot: 3300, Kind: mismatchTTL},
+		},
+		failed: []string{"b:6379", "a:6379/1"},
+	}
+	var buf bytes.Buffer
+	v.report(&buf, 1)
+	exp := `keys checked: 10
+mismatches: 4, missing: 2, extra: 0, type: 0, ttl: 1, value: 1
+failed nodes: a:6379/1, b:6379
+slots:
+  3300: ttl 1 value 1
+  7365: missing 1
+  15495: missing 1
+sample:
+  missing "a" (slot 15495)
+  ttl "d" (slot 3300)
+  value "b" (slot 3300)
+`
+	if buf.String() != exp {
+		t.Fatalf("expected\n%s\ngot\n%s", exp, buf.String())
+	}
+
+	buf.Reset()
+	v = &verifier{checked: 2, mismatches: []mismatch{{Key: "c", DB: 2, Slot: 7365, Kind: mismatchExtra}}}
+	v.report(&buf, 10)
+	if !strings.HasSuffix(buf.String(), "sample:\n  extra \"c\" (db 2, slot 7365)\n") {
+		t.Fatalf("expected the db of the sample, got\n%s", buf.String())
+	}
+}